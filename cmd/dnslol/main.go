@@ -5,9 +5,11 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	_ "net/http/pprof"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -15,13 +17,37 @@ import (
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+	"github.com/letsencrypt/dns-lots-of-lookups/input"
+)
+
+const (
+	// modeServe runs a long-running lookup service instead of reading names.
+	modeServe = "serve"
+	// modeCoordinator hands out the input names to workers instead of looking
+	// them up.
+	modeCoordinator = "coordinator"
+	// modeWorker looks up names leased from a coordinator instead of reading
+	// them.
+	modeWorker = "worker"
+
+	// invalidSkip skips invalid input names.
+	invalidSkip = "skip"
+	// invalidFail stops with an error at the first invalid input name.
+	invalidFail = "fail"
+	// invalidRejectFile skips invalid input names, writing them to the
+	// -rejectFile.
+	invalidRejectFile = "reject-file"
 )
 
 var (
 	metricsAddrFlag = flag.String(
 		"metricsAddr",
-		":6363",
-		"Bind address for HTTP metrics server")
+		"127.0.0.1:6363",
+		"Bind address for HTTP metrics server and status and control API")
+	controlTokenFlag = flag.String(
+		"controlToken",
+		"",
+		`Bearer token required by the control API endpoints that change the experiment (empty for none), and by the coordinator's API ("coordinator" and "worker" modes require it)`)
 	dbConnFlag = flag.String(
 		"db",
 		"dnslol:dnslol@tcp(10.10.10.2:3306)/dnslol-results",
@@ -37,27 +63,207 @@ var (
 	timeoutFlag = flag.Duration(
 		"timeout",
 		30*time.Second,
-		"DNS query timeout duration")
+		"DNS query timeout duration, across all attempts when queries are retried")
+	dialTimeoutFlag = flag.Duration(
+		"dialTimeout",
+		0,
+		"Timeout for connecting to a server, e.g. the TCP handshake (0 for the attempt's timeout)")
+	tlsHandshakeTimeoutFlag = flag.Duration(
+		"tlsHandshakeTimeout",
+		0,
+		"Timeout for the TLS handshake with -proto tcp-tls (0 for the attempt's timeout)")
+	writeTimeoutFlag = flag.Duration(
+		"writeTimeout",
+		0,
+		"Timeout for sending a query (0 for the attempt's timeout)")
+	readTimeoutFlag = flag.Duration(
+		"readTimeout",
+		0,
+		"Timeout for waiting for a response once a query is sent (0 for the attempt's timeout)")
+	attemptsFlag = flag.Int(
+		"attempts",
+		1,
+		"Most times each query is sent, retrying queries with a -retryOn outcome")
+	attemptTimeoutFlag = flag.Duration(
+		"attemptTimeout",
+		0,
+		"Timeout of each attempt of a retried query (0 for -timeout)")
+	retryBackoffFlag = flag.Duration(
+		"retryBackoff",
+		0,
+		"Delay before the first retry of a query, doubled for each later retry")
+	retryOnFlag = flag.String(
+		"retryOn",
+		strings.Join(dnslol.DefaultRetryOn, ","),
+		"Comma-separated outcomes that are retried: outcome classes, rcodes or \"network\" for any network error")
+	failoverFlag = flag.Bool(
+		"failover",
+		false,
+		"Send retries to the next server instead of the server that failed")
+	resolverSetFlag = flag.String(
+		"resolverSet",
+		"",
+		"Query the servers as one resolver set like a client would, in \"ordered\", \"random\", \"roundrobin\" or \"hedged\" order")
+	hedgeDelayFlag = flag.Duration(
+		"hedgeDelay",
+		0,
+		"How long a -resolverSet=hedged query waits for the first server before also querying the second")
+	hedgePercentileFlag = flag.Float64(
+		"hedgePercentile",
+		0,
+		"Hedge after this quantile (e.g. 0.95) of the first server's observed latency instead of -hedgeDelay, once known")
+	breakerFailuresFlag = flag.Int(
+		"breakerFailures",
+		0,
+		"Consecutive failures (timeouts, network errors, SERVFAILs) after which a server's queries are skipped (0 to disable)")
+	breakerCooldownFlag = flag.Duration(
+		"breakerCooldown",
+		10*time.Second,
+		"How long a server's queries are skipped before a probe query is sent, with -breakerFailures")
+	healthCheckFlag = flag.Bool(
+		"healthCheck",
+		false,
+		"Check that every server answers before sending any queries, exiting if one doesn't")
+	maxDurationFlag = flag.Duration(
+		"maxDuration",
+		0,
+		"Stop the experiment after this long (0 for no limit)")
+	maxQueriesFlag = flag.Int64(
+		"maxQueries",
+		0,
+		"Stop the experiment once this many queries, including retries and hedges, have been sent (0 for no limit)")
+	abortErrorRateFlag = flag.Float64(
+		"abortErrorRate",
+		0,
+		"Stop the experiment when a server's fraction of failures (timeouts, network errors, SERVFAILs) over -abortWindow is above this (0 to disable)")
+	abortWindowFlag = flag.Duration(
+		"abortWindow",
+		30*time.Second,
+		"The sliding window over which a server's error rate is checked against -abortErrorRate")
+	abortMinQueriesFlag = flag.Int(
+		"abortMinQueries",
+		100,
+		"The fewest queries to a server in the -abortWindow before its error rate can stop the experiment")
 	protoFlag = flag.String(
 		"proto",
 		"udp",
-		"DNS protocol (tcp or udp)")
+		"DNS protocol (tcp, udp or tcp-tls)")
 	reverseNamesFlag = flag.Bool(
 		"reverse",
 		false,
 		"Label-wise reverse input domains (e.g `com.google.www` -> `www.google.com`)")
+	inputFormatFlag = flag.String(
+		"inputFormat",
+		input.FormatAuto,
+		`Format of the input files ("auto", "lines", "csv", "jsonl", "zone", "cert", "ct" or "ptr")`)
+	inputFieldFlag = flag.String(
+		"inputField",
+		"",
+		`CSV column (name or 1 based index) or JSON field holding the names (default first column or "name")`)
+	inputTypeFieldFlag = flag.String(
+		"inputTypeField",
+		"",
+		"Optional CSV column or JSON field holding the query types for each name")
+	zoneOriginFlag = flag.String(
+		"zoneOrigin",
+		"",
+		"Origin for relative names in zone files without an $ORIGIN")
+	ptrMaxAddressesFlag = flag.Int(
+		"ptrMaxAddresses",
+		input.DefaultPTRMaxAddresses,
+		`Most addresses looked up per CIDR prefix with -inputFormat "ptr", larger prefixes are sampled by -seed`)
+	dedupFlag = flag.String(
+		"dedup",
+		input.DedupNone,
+		`How to remove duplicate input names ("none", "exact" or "bloom")`)
+	dedupCapacityFlag = flag.Int(
+		"dedupCapacity",
+		input.DefaultDedupCapacity,
+		`Number of distinct input names the -dedup "bloom" filter is sized for`)
+	sampleFlag = flag.Float64(
+		"sample",
+		1,
+		"Fraction of input names to look up, chosen deterministically by -seed")
+	seedFlag = flag.Uint64(
+		"seed",
+		0,
+		"Seed for choosing the -sample of input names and the addresses of sampled PTR prefixes")
+	shardFlag = flag.String(
+		"shard",
+		"",
+		`Look up one shard of the input names, given as "i/n" for shard i (0 based) of n, in one of n processes (requires -parent)`)
+	parentFlag = flag.String(
+		"parent",
+		"",
+		"Name of the parent experiment shared by every -shard of a run")
+	idnaFlag = flag.Bool(
+		"idna",
+		false,
+		"Convert Unicode input and lookup service names to ASCII (IDNA2008/UTS #46)")
+	onInvalidFlag = flag.String(
+		"onInvalid",
+		invalidFail,
+		`What to do with invalid input names ("skip", "fail" or "reject-file")`)
+	rejectFileFlag = flag.String(
+		"rejectFile",
+		"",
+		`File to write invalid input names to with -onInvalid "reject-file"`)
 	parallelFlag = flag.Int(
 		"parallel",
 		5,
-		"Number of parallel queries to perform")
-	spawnRateFlag = flag.Int(
-		"spawnRate",
-		100,
-		"Number of goroutines to spawn per spawnInterval")
-	spawnIntervalFlag = flag.Duration(
-		"spawnInterval",
+		"Number of names to perform queries for in parallel")
+	maxInflightFlag = flag.Int(
+		"maxInflight",
+		0,
+		"Most queries in flight at once across all servers (0 for the queries of -parallel names)")
+	serverMaxInflightFlag = flag.Int(
+		"serverMaxInflight",
+		0,
+		"Most queries in flight at once to each server (0 for an equal share of -maxInflight)")
+	poolConnsFlag = flag.Int(
+		"poolConns",
+		0,
+		"Number of long-lived connections to each server shared by all queries (0 to dial a new connection for every query)")
+	qpsFlag = flag.Float64(
+		"qps",
+		0,
+		"Target queries per second across all servers (0 for no limit)")
+	serverQPSFlag = flag.Float64(
+		"serverQPS",
+		0,
+		"Target queries per second for each server (0 for no limit)")
+	rampFlag = flag.String(
+		"ramp",
+		dnslol.RampNone,
+		`Load ramp schedule ("none", "linear" or "step")`)
+	rampDurationFlag = flag.Duration(
+		"rampDuration",
 		1*time.Minute,
-		"Interval on which to spawn goroutines")
+		"Duration over which to ramp up to full load")
+	rampStepsFlag = flag.Int(
+		"rampSteps",
+		10,
+		`Number of steps used by the "step" ramp schedule`)
+	capacitySearchFlag = flag.Bool(
+		"capacitySearch",
+		false,
+		"Search for the highest QPS each server sustains within the SLO, starting at -serverQPS")
+	sloErrorRateFlag = flag.Float64(
+		"sloErrorRate",
+		0.01,
+		"Highest fraction of failed queries allowed by the capacity search SLO (0 to disable)")
+	sloLatencyFlag = flag.Duration(
+		"sloLatency",
+		500*time.Millisecond,
+		"Highest p99 latency allowed by the capacity search SLO (0 to disable)")
+	searchIntervalFlag = flag.Duration(
+		"searchInterval",
+		30*time.Second,
+		"How long each rate is held during a capacity search")
+	searchStepFlag = flag.Float64(
+		"searchStep",
+		1.5,
+		"Factor by which a capacity search increases the rate until the SLO breaks")
 	checkAFlag = flag.Bool(
 		"checkA",
 		true,
@@ -70,61 +276,195 @@ var (
 		"checkTXT",
 		false,
 		"Whether to check TXT records")
+	latencyBucketsFlag = flag.String(
+		"latencyBuckets",
+		"",
+		"Comma-separated list of latency histogram bucket upper bounds (e.g. 5ms,10ms,100ms,1s). Defaults to 1ms to ~33s in powers of two")
+	nativeHistogramFactorFlag = flag.Float64(
+		"nativeHistogramFactor",
+		0,
+		"Also expose the latency histograms as native histograms with buckets growing by at most this factor, e.g. 1.1 (0 to disable)")
+	tldLabelsFlag = flag.Int(
+		"tldLabels",
+		20,
+		`Number of the most common TLDs that get their own "tld" metric label value (others are "other")`)
+	tldsFlag = flag.String(
+		"tlds",
+		"",
+		`Comma-separated list of TLDs that get their own "tld" metric label value instead of the -tldLabels most common TLDs`)
+	progressFlag = flag.Duration(
+		"progress",
+		10*time.Second,
+		"Interval between progress lines (0 to disable)")
+	expectedFlag = flag.Int64(
+		"expected",
+		0,
+		"Expected number of input names, for progress ETA")
+	countInputsFlag = flag.Bool(
+		"countInputs",
+		false,
+		"Count the input names before the run for progress ETA, reading file inputs twice (ignored with -expected)")
+	serveAddrFlag = flag.String(
+		"serveAddr",
+		":6464",
+		`Bind address for the HTTP lookup service ("serve" mode only)`)
+	serveMaxRequestsFlag = flag.Int(
+		"serveMaxRequests",
+		10,
+		`Max number of lookup requests served at once ("serve" mode only)`)
+	serveConcurrencyFlag = flag.Int(
+		"serveConcurrency",
+		50,
+		`Max number of names from one lookup request looked up at once ("serve" mode only)`)
+	serveMaxNamesFlag = flag.Int(
+		"serveMaxNames",
+		10000,
+		`Max number of names in one lookup request ("serve" mode only)`)
+	coordinatorAddrFlag = flag.String(
+		"coordinatorAddr",
+		":6565",
+		`Bind address for the HTTP API workers lease names from ("coordinator" mode only)`)
+	leaseTimeoutFlag = flag.Duration(
+		"leaseTimeout",
+		5*time.Minute,
+		`How long a worker has to complete a leased batch of names before they are given to another worker ("coordinator" mode only)`)
+	coordinatorFlag = flag.String(
+		"coordinator",
+		"",
+		`URL of the coordinator to lease names from, e.g. http://10.0.0.1:6565 ("worker" mode only)`)
+	batchSizeFlag = flag.Int(
+		"batchSize",
+		100,
+		`Number of names to lease from the coordinator at once ("worker" mode only)`)
 	printResultsFlag = flag.Bool(
 		"print",
 		true,
-		"Print lookup results to stdout")
+		"Print lookup results to stdout (or -outputFile)")
+	outputFlag = flag.String(
+		"output",
+		dnslol.OutputText,
+		`Format of printed lookup results ("text", "logfmt" or "json")`)
+	outputFilterFlag = flag.String(
+		"outputFilter",
+		dnslol.FilterAll,
+		`Which lookup results to print ("all", "failures" or "disagreements")`)
+	outputFileFlag = flag.String(
+		"outputFile",
+		"",
+		"File to print lookup results to instead of stdout")
+	outputMaxSizeFlag = flag.Int64(
+		"outputMaxSize",
+		0,
+		"Size in bytes after which -outputFile is rotated (0 to disable rotation)")
+	outputMaxFilesFlag = flag.Int(
+		"outputMaxFiles",
+		5,
+		"Number of rotated -outputFile files to keep")
 	countFlag = flag.Int(
 		"count",
 		1,
 		"How many times to repeat the same query against each server")
 )
 
-// checkUlimit checks the *parallelFlag value against the system RLIMIT_NOFILE
-// value controlling the number of files a process can have open. If the
-// *parallelFlag value is larger than the current RLIMIT_NOFILE an error is
-// returned. Allowing the experiment to proceed without fixing the ulimit will
-// result in running out of file handles.
-func checkUlimit() error {
+// checkUlimit checks the experiment's file descriptor budget (see
+// dnslol.Experiment.FDBudget) against the system RLIMIT_NOFILE value
+// controlling the number of files a process can have open. If the budget is
+// larger than the current RLIMIT_NOFILE an error is returned. Allowing the
+// experiment to proceed without fixing the ulimit will result in running out
+// of file handles.
+func checkUlimit(budget int) error {
 	var rLimit syscall.Rlimit
 	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
 		return err
 	}
-	if *parallelFlag > int(rLimit.Cur) {
+	if uint64(budget) > uint64(rLimit.Cur) {
 		return fmt.Errorf(
-			`current ulimit for "nofile" lower than requested -parallel: %d vs %d"`,
-			rLimit.Cur, *parallelFlag)
+			`current ulimit for "nofile" lower than the file descriptor budget for -maxInflight, -serverMaxInflight and -dbMaxConns: %d vs %d`,
+			rLimit.Cur, budget)
 	}
 	return nil
 }
 
-// reverseName performs a label-wise reversal of the given domain name. E.g.
-// "com.google.www" -> "www.google.com".
-func reverseName(domain string) string {
-	labels := strings.Split(domain, ".")
-	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
-		labels[i], labels[j] = labels[j], labels[i]
+// readInput sends the targets read from the input at the given path that are
+// kept by the filter to the names channel, adding each to the WaitGroup.
+// Invalid names are passed to the onInvalid function, which can return an
+// error to stop. readInput returns true if it stopped early because the
+// experiment was stopped.
+func readInput(
+	path string, opts input.Options, filter *input.Filter,
+	exp dnslol.Experiment, names chan<- dnslol.Target, wg *sync.WaitGroup,
+	onInvalid func(*input.InvalidNameError) error) (bool, error) {
+	src, err := input.Open(path, opts)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	for {
+		target, err := src.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if invalid, ok := err.(*input.InvalidNameError); ok {
+			if err := onInvalid(invalid); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if !filter.Keep(target) {
+			continue
+		}
+		wg.Add(1)
+		select {
+		case names <- target:
+		case <-exp.Stopped():
+			wg.Done()
+			return true, nil
+		}
 	}
-	return strings.Join(labels, ".")
 }
 
-// isDNSCharacter returns true if the given byte is a valid character for a DNS
-// name, or is a wildcard label ("*").
-func isDNSCharacter(ch byte) bool {
-	return ('a' <= ch && ch <= 'z') ||
-		('A' <= ch && ch <= 'Z') ||
-		('0' <= ch && ch <= '9') ||
-		ch == '.' || ch == '-' || ch == '*'
+// parseBuckets splits a raw latencyBucketsFlag string containing zero or more
+// comma-separated durations, returning a slice of parsed durations.
+func parseBuckets(raw string) ([]time.Duration, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var buckets []time.Duration
+	for _, field := range strings.Split(raw, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency bucket %q: %v", field, err)
+		}
+		buckets = append(buckets, d)
+	}
+	return buckets, nil
 }
 
-// isValidName returns true if the given name only has valid DNS characters.
-func isValidName(domain string) bool {
-	for _, ch := range []byte(domain) {
-		if !isDNSCharacter(ch) {
-			return false
-		}
+// parseShard parses a raw shardFlag string of the form "i/n", returning the
+// shard i and the number of shards n. An empty string returns zero shards.
+func parseShard(raw string) (int, int, error) {
+	if raw == "" {
+		return 0, 0, nil
+	}
+	fields := strings.Split(raw, "/")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid shard %q, must be of the form i/n", raw)
+	}
+	shard, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q: %v", raw, err)
+	}
+	shards, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q: %v", raw, err)
 	}
-	return true
+	if shards < 1 || shard < 0 || shard >= shards {
+		return 0, 0, fmt.Errorf("invalid shard %q, i must be between 0 and n-1", raw)
+	}
+	return shard, shards, nil
 }
 
 // parseServers splits a raw serversFlag string containing one or more DNS
@@ -142,41 +482,219 @@ func parseServers(raw string) []string {
 }
 
 func main() {
-	flag.Parse()
-
-	// There's no point using a -parallel higher than ulimits allow
-	if err := checkUlimit(); err != nil {
-		log.Fatalf("Error: %v\n", err)
+	// "dnslol serve [flags]" runs a long-running lookup service instead of
+	// reading names from standard input. "dnslol coordinator [flags] [inputs]"
+	// hands out the input names to "dnslol worker [flags]" processes, which
+	// look them up.
+	var mode string
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case modeServe, modeCoordinator, modeWorker:
+			mode = os.Args[1]
+		}
+	}
+	if mode != "" {
+		// The flag package would stop at the mode argument.
+		_ = flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
 	}
 
 	// Split the -servers input and construct a selector to use
 	dnsServerAddresses := parseServers(*serversFlag)
 
+	latencyBuckets, err := parseBuckets(*latencyBucketsFlag)
+	if err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+
+	var tlds []string
+	if *tldsFlag != "" {
+		tlds = strings.Split(*tldsFlag, ",")
+	}
+
+	shard, shards, err := parseShard(*shardFlag)
+	if err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if (shards > 0) != (*parentFlag != "") {
+		log.Fatalf("Error: -shard and -parent must be used together\n")
+	}
+
+	// Read names from the files given as arguments, or standard input if there
+	// are none
+	inputOpts := input.Options{
+		Format:          *inputFormatFlag,
+		NameField:       *inputFieldFlag,
+		TypeField:       *inputTypeFieldFlag,
+		ZoneOrigin:      *zoneOriginFlag,
+		Reverse:         *reverseNamesFlag,
+		IDNA:            *idnaFlag,
+		PTRMaxAddresses: *ptrMaxAddressesFlag,
+		Dedup:           *dedupFlag,
+		DedupCapacity:   *dedupCapacityFlag,
+		Sample:          *sampleFlag,
+		Seed:            *seedFlag,
+		Shard:           shard,
+		Shards:          shards,
+	}
+	if err := inputOpts.Valid(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+
+	// Check the invalid name policy and open the reject file if there is one
+	var rejects *bufio.Writer
+	switch *onInvalidFlag {
+	case invalidSkip, invalidFail:
+	case invalidRejectFile:
+		if *rejectFileFlag == "" {
+			log.Fatalf("Error: -onInvalid %q requires a -rejectFile\n", invalidRejectFile)
+		}
+		f, err := os.Create(*rejectFileFlag)
+		if err != nil {
+			log.Fatalf("Error creating reject file: %v\n", err)
+		}
+		defer f.Close()
+		rejects = bufio.NewWriter(f)
+	default:
+		log.Fatalf("Error: -onInvalid must be %q, %q or %q\n",
+			invalidSkip, invalidFail, invalidRejectFile)
+	}
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{input.Stdin}
+	}
+
+	// Use the expected name count from the command line or, if asked, from
+	// counting the names in the inputs. Counting reads every input in full
+	// before the run starts, which takes a while for large inputs.
+	expected := *expectedFlag
+	if expected == 0 && *countInputsFlag && mode != modeServe && mode != modeWorker {
+		expected, err = input.Count(inputs, inputOpts)
+		if err != nil {
+			log.Fatalf("Error counting input names: %v\n", err)
+		}
+	}
+
 	// Construct an Experiment with the command line flag options
 	exp := dnslol.Experiment{
-		MetricsAddr:   *metricsAddrFlag,
-		CommandLine:   strings.Join(os.Args, " "),
-		Servers:       dnsServerAddresses,
-		Proto:         *protoFlag,
-		Timeout:       *timeoutFlag,
-		Parallel:      *parallelFlag,
-		SpawnRate:     *spawnRateFlag,
-		SpawnInterval: *spawnIntervalFlag,
-		CheckA:        *checkAFlag,
-		CheckAAAA:     *checkAAAAFlag,
-		CheckTXT:      *checkTXTFlag,
-		PrintResults:  *printResultsFlag,
-		Count:         *countFlag,
+		MetricsAddr:       *metricsAddrFlag,
+		ControlToken:      *controlTokenFlag,
+		CommandLine:       strings.Join(os.Args, " "),
+		Servers:           dnsServerAddresses,
+		Proto:             *protoFlag,
+		Timeout:           *timeoutFlag,
+		Attempts:          *attemptsFlag,
+		AttemptTimeout:    *attemptTimeoutFlag,
+		RetryBackoff:      *retryBackoffFlag,
+		RetryOn:           strings.Split(*retryOnFlag, ","),
+		Failover:          *failoverFlag,
+		ResolverSet:       *resolverSetFlag,
+		HedgeDelay:        *hedgeDelayFlag,
+		HedgePercentile:   *hedgePercentileFlag,
+		BreakerFailures:   *breakerFailuresFlag,
+		BreakerCooldown:   *breakerCooldownFlag,
+		HealthCheck:       *healthCheckFlag,
+		MaxDuration:       *maxDurationFlag,
+		MaxQueries:        *maxQueriesFlag,
+		AbortErrorRate:    *abortErrorRateFlag,
+		AbortWindow:       *abortWindowFlag,
+		AbortMinQueries:   *abortMinQueriesFlag,
+		Parallel:          *parallelFlag,
+		MaxInflight:       *maxInflightFlag,
+		ServerMaxInflight: *serverMaxInflightFlag,
+		PoolConns:         *poolConnsFlag,
+		QPS:               *qpsFlag,
+		ServerQPS:         *serverQPSFlag,
+		RampMode:          *rampFlag,
+		RampDuration:      *rampDurationFlag,
+		RampSteps:         *rampStepsFlag,
+		CapacitySearch:    *capacitySearchFlag,
+		SLOErrorRate:      *sloErrorRateFlag,
+		SLOLatency:        *sloLatencyFlag,
+		SearchInterval:    *searchIntervalFlag,
+		SearchStep:        *searchStepFlag,
+		CheckA:            *checkAFlag,
+		CheckAAAA:         *checkAAAAFlag,
+		CheckTXT:          *checkTXTFlag,
+		LatencyBuckets:    latencyBuckets,
+		TLDLabels:         *tldLabelsFlag,
+		TLDs:              tlds,
+		ProgressInterval:  *progressFlag,
+		ExpectedNames:     expected,
+		ServeAddr:         *serveAddrFlag,
+		ServeMaxRequests:  *serveMaxRequestsFlag,
+		ServeConcurrency:  *serveConcurrencyFlag,
+		ServeMaxNames:     *serveMaxNamesFlag,
+		IDNA:              *idnaFlag,
+		CoordinatorAddr:   *coordinatorAddrFlag,
+		LeaseTimeout:      *leaseTimeoutFlag,
+		Coordinator:       *coordinatorFlag,
+		BatchSize:         *batchSizeFlag,
+		PrintResults:      *printResultsFlag,
+		OutputFormat:      *outputFlag,
+		OutputFilter:      *outputFilterFlag,
+		OutputFile:        *outputFileFlag,
+		OutputMaxSize:     *outputMaxSizeFlag,
+		OutputMaxFiles:    *outputMaxFilesFlag,
+		Count:             *countFlag,
+		Parent:            *parentFlag,
+		Shard:             shard,
+		Shards:            shards,
+
+		DialTimeout:         *dialTimeoutFlag,
+		TLSHandshakeTimeout: *tlsHandshakeTimeoutFlag,
+		WriteTimeout:        *writeTimeoutFlag,
+		ReadTimeout:         *readTimeoutFlag,
+
+		NativeHistogramFactor: *nativeHistogramFactorFlag,
+	}
+
+	// There's no point allowing more queries in flight than ulimits allow.
+	// Workers don't use the database and the coordinator doesn't perform
+	// queries.
+	dbConns := *dbMaxConnsFlag
+	if mode == modeWorker {
+		dbConns = 0
+	}
+	if mode != modeCoordinator {
+		if err := checkUlimit(exp.FDBudget(dbConns)); err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
+	}
+
+	switch mode {
+	case modeServe:
+		// Serve lookups until the experiment is stopped through the control API
+		if err := dnslol.Serve(&exp, *dbConnFlag, *dbMaxConnsFlag); err != nil {
+			log.Fatalf("Error serving lookups: %v\n", err)
+		}
+		if err := exp.Close(); err != nil {
+			log.Fatalf("Error closing experiment: %v\n", err)
+		}
+		return
+	case modeWorker:
+		// Look up leased names until the coordinator has no more. Workers don't
+		// use the database.
+		if err := dnslol.Work(&exp); err != nil {
+			log.Fatalf("Error working for coordinator: %v\n", err)
+		}
+		return
 	}
 
 	// Create a channel for feeding domain names to the experiment
-	names := make(chan string)
+	names := make(chan dnslol.Target)
 	// Create a waitgroup so we can tell when all domain names have been processed
 	wg := sync.WaitGroup{}
 
 	// Start the experiment - it will initially be blocked waiting for domain
-	// names
-	err := dnslol.Start(&exp, names, &wg, *dbConnFlag, *dbMaxConnsFlag)
+	// names. A coordinator hands the names out to workers instead of looking
+	// them up.
+	start := dnslol.Start
+	if mode == modeCoordinator {
+		start = dnslol.Coordinate
+	}
+	err = start(&exp, names, &wg, *dbConnFlag, *dbMaxConnsFlag)
 	if err != nil {
 		log.Fatalf("Error running experiment: %v\n", err)
 	}
@@ -188,25 +706,48 @@ func main() {
 		}
 	}()
 
-	// Read domain names from standard input
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		name := scanner.Text()
-		if name == "" {
-			continue
+	// Invalid names stop the experiment or are skipped, depending on the
+	// -onInvalid policy
+	var skipped int
+	onInvalid := func(invalid *input.InvalidNameError) error {
+		switch *onInvalidFlag {
+		case invalidFail:
+			return invalid
+		case invalidRejectFile:
+			if _, err := fmt.Fprintln(rejects, invalid.Name); err != nil {
+				return err
+			}
 		}
-		if *reverseNamesFlag {
-			name = reverseName(name)
+		skipped++
+		return nil
+	}
+
+	// Read targets from the inputs until they are exhausted or the experiment
+	// is stopped, removing duplicates and sampling across all of the inputs
+	filter := input.NewFilter(inputOpts)
+	for _, path := range inputs {
+		stopped, err := readInput(path, inputOpts, filter, exp, names, &wg, onInvalid)
+		if err != nil {
+			log.Fatalf("Error reading names: %v\n", err)
 		}
-		if !isValidName(name) {
-			log.Fatalf("Domain %q is not a valid ASCII encoded domain name\n", name)
+		if stopped {
+			break
 		}
-		wg.Add(1)
-		names <- name
 	}
-
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading names from standard input: %s\n", err)
+	if rejects != nil {
+		if err := rejects.Flush(); err != nil {
+			log.Fatalf("Error writing reject file: %v\n", err)
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d invalid names\n", skipped)
+	}
+	if filter.OtherShards > 0 {
+		log.Printf("Skipped %d names in other shards\n", filter.OtherShards)
+	}
+	if filter.Duplicates > 0 || filter.Unsampled > 0 {
+		log.Printf("Skipped %d duplicate names and %d names not in the sample\n",
+			filter.Duplicates, filter.Unsampled)
 	}
 
 	// Close the names channel and wait for the experiment to be finished
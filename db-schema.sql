@@ -7,7 +7,16 @@ CREATE TABLE `experiments` (
 	`start` DATETIME NOT NULL,
 	`end` DATETIME,
 	`commandline` VARCHAR(255) NOT NULL,
-	PRIMARY KEY (`id`)
+	`summary` MEDIUMTEXT,
+	`summaryState` MEDIUMBLOB,
+	`name` VARCHAR(255) DEFAULT NULL,
+	`parentID` INT DEFAULT NULL,
+	`shard` INT DEFAULT NULL,
+	`shards` INT DEFAULT NULL,
+	`stopReason` VARCHAR(255) DEFAULT NULL,
+	PRIMARY KEY (`id`),
+	UNIQUE KEY `experiments_name_idx` (`name`),
+	CONSTRAINT `experiments_parentID_experiments` FOREIGN KEY (`parentID`) REFERENCES `experiments` (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
 CREATE TABLE `servers` (
@@ -22,12 +31,21 @@ CREATE TABLE `results` (
 	`id` INT NOT NULL AUTO_INCREMENT,
 	`name` VARCHAR(255) NOT NULL,
 	`type` INT NOT NULL,
+	`source` VARCHAR(255) NOT NULL DEFAULT '',
+	`outcome` VARCHAR(32) NOT NULL,
 	`error` MEDIUMBLOB DEFAULT NULL,
 	`serverID` INT NOT NULL,
 	`experimentID` INT NOT NULL,
+	`attempt` INT NOT NULL DEFAULT 1,
+	`retried` BOOL NOT NULL DEFAULT FALSE,
+	`hedge` BOOL NOT NULL DEFAULT FALSE,
+	`superseded` BOOL NOT NULL DEFAULT FALSE,
+	`timeoutPhase` VARCHAR(8) DEFAULT NULL,
 	PRIMARY KEY (`id`),
 	KEY `results_name_idx` (`name`),
 	KEY `results_type_idx` (`type`),
+	KEY `results_source_idx` (`source`),
+	KEY `results_outcome_idx` (`outcome`),
 	KEY `results_error_idx` (`error`(20)),
 	CONSTRAINT `results_serverID_servers` FOREIGN KEY (`serverID`) REFERENCES servers (`id`),
 	CONSTRAINT `results_experimentID_experiments` FOREIGN KEY (`experimentID`) REFERENCES experiments (`id`)
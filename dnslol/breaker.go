@@ -0,0 +1,225 @@
+package dnslol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// The states of a breaker, which are also the values of its breakerState
+// metric.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// errBreakerOpen is the error of a query that was skipped because its server's
+// circuit breaker was open.
+var errBreakerOpen = errors.New("query skipped, server circuit breaker is open")
+
+// healthCheckAttempts is the number of queries sent to each server by the
+// health check before it is considered unhealthy.
+const healthCheckAttempts = 3
+
+// validBreaker checks the Experiment's circuit breaker settings.
+func (e Experiment) validBreaker() error {
+	if e.BreakerFailures < 0 {
+		return errors.New("Experiment must not have a negative BreakerFailures")
+	}
+	if e.BreakerFailures > 0 && e.BreakerCooldown <= 0 {
+		return errors.New("Experiment must have a BreakerCooldown greater than 0 to use a circuit breaker")
+	}
+	return nil
+}
+
+// breakerFailure returns whether a query with the given error counts as a
+// failure of its server for its circuit breaker: it timed out, failed with a
+// network or TLS error, or got a SERVFAIL response. Other errors, e.g.
+// NXDOMAIN, are answers and show that the server is up.
+func breakerFailure(err error) bool {
+	switch class := outcome(err); class {
+	case outcomeTimeout, outcomeTLSHandshake, dns.RcodeToString[dns.RcodeServerFailure]:
+		return true
+	default:
+		for _, c := range networkOutcomes {
+			if class == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newBreakers creates a closed circuit breaker for each of the Experiment's
+// servers.
+func newBreakers(e Experiment) map[string]*breaker {
+	breakers := make(map[string]*breaker, len(e.servers))
+	for _, srv := range e.servers {
+		breakers[srv.address] = &breaker{
+			address:  srv.address,
+			failures: e.BreakerFailures,
+			cooldown: e.BreakerCooldown,
+			state:    stats.breakerState.With(prom.Labels{"server": srv.address}),
+		}
+		breakers[srv.address].state.Set(breakerClosed)
+	}
+	return breakers
+}
+
+// A breaker is the circuit breaker of one server. It opens after the given
+// number of consecutive failed queries to the server, and while it is open the
+// server's queries are skipped instead of being sent. Once the cooldown has
+// passed the breaker is half-open: one probe query is sent, and the breaker
+// closes if it succeeds or opens again for another cooldown if it fails.
+type breaker struct {
+	address  string
+	failures int
+	cooldown time.Duration
+	state    prom.Gauge
+
+	sync.Mutex
+	current int
+	// consecutive is the number of failed queries in a row while closed.
+	consecutive int
+	// opened is when the breaker last opened.
+	opened time.Time
+	// probing is whether the half-open breaker's probe is in flight.
+	probing bool
+}
+
+// allow returns whether a query may be sent to the server and whether it is
+// the probe of a half-open breaker.
+func (b *breaker) allow() (bool, bool) {
+	b.Lock()
+	defer b.Unlock()
+	switch b.current {
+	case breakerOpen:
+		if time.Since(b.opened) < b.cooldown {
+			return false, false
+		}
+		b.set(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// abandonProbe lets another query probe the half-open breaker when the probe
+// allowed by allow wasn't sent.
+func (b *breaker) abandonProbe() {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+}
+
+// record updates the breaker with the result of a query allowed by allow.
+// Results of queries sent before the breaker opened don't change an open or
+// half-open breaker.
+func (b *breaker) record(probe bool, err error) {
+	b.Lock()
+	defer b.Unlock()
+	failed := breakerFailure(err)
+	switch {
+	case probe:
+		b.probing = false
+		if failed {
+			b.open()
+			log.Printf("Circuit breaker for %s probe failed, open for another %s\n",
+				b.address, b.cooldown)
+			return
+		}
+		b.consecutive = 0
+		b.set(breakerClosed)
+		log.Printf("Circuit breaker for %s closed\n", b.address)
+	case b.current != breakerClosed:
+		// The query was sent before the breaker opened.
+	case !failed:
+		b.consecutive = 0
+	default:
+		b.consecutive++
+		if b.consecutive >= b.failures {
+			b.open()
+			log.Printf("Circuit breaker for %s opened after %d consecutive failures\n",
+				b.address, b.consecutive)
+		}
+	}
+}
+
+// stateName returns the name of the breaker's state.
+func (b *breaker) stateName() string {
+	b.Lock()
+	defer b.Unlock()
+	switch b.current {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// open opens the breaker. The caller must hold b.
+func (b *breaker) open() {
+	b.opened = time.Now()
+	b.set(breakerOpen)
+}
+
+// set changes the breaker's state. The caller must hold b.
+func (b *breaker) set(state int) {
+	b.current = state
+	b.state.Set(float64(state))
+}
+
+// checkHealth checks that every one of the Experiment's servers answers a
+// query for the root NS records with a NOERROR response, sending each up to
+// healthCheckAttempts queries. It returns an error naming the servers that
+// didn't.
+func (e Experiment) checkHealth() error {
+	dnsClient := &dns.Client{Net: e.Proto}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var unhealthy []string
+	for _, address := range e.Servers {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			var err error
+			for i := 0; i < healthCheckAttempts; i++ {
+				m := new(dns.Msg)
+				m.SetQuestion(".", dns.TypeNS)
+				var in *dns.Msg
+				var rtt time.Duration
+				in, rtt, err = e.exchange(dnsClient, m, address, e.attemptTimeout(time.Time{}))
+				if err == nil && in.Rcode != dns.RcodeSuccess {
+					err = rcodeError(in.Rcode)
+				}
+				if err == nil {
+					log.Printf("Health check of %s passed in %s\n", address, roundLatency(rtt))
+					return
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%v)", address, err))
+		}(address)
+	}
+	wg.Wait()
+	if len(unhealthy) > 0 {
+		sort.Strings(unhealthy)
+		return fmt.Errorf("health check failed for %s", strings.Join(unhealthy, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package dnslol
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// testBreaker returns a closed breaker for the given address that opens after
+// the given number of failures.
+func testBreaker(address string, failures int, cooldown time.Duration) *breaker {
+	return &breaker{
+		address:  address,
+		failures: failures,
+		cooldown: cooldown,
+		state:    prom.NewGauge(prom.GaugeOpts{Name: "test_breaker_state"}),
+	}
+}
+
+func TestBreakerFailure(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "success", err: nil},
+		{name: "NXDOMAIN", err: rcodeError(dns.RcodeNameError)},
+		{name: "REFUSED", err: rcodeError(dns.RcodeRefused)},
+		{name: "SERVFAIL", err: rcodeError(dns.RcodeServerFailure), expected: true},
+		{name: "timeout", err: &queryError{class: outcomeTimeout, err: errors.New("i/o timeout")}, expected: true},
+		{name: "connection refused", err: &queryError{class: outcomeConnRefused, err: errors.New("refused")}, expected: true},
+		{name: "TLS handshake", err: &queryError{class: outcomeTLSHandshake, err: errors.New("tls: bad certificate")}, expected: true},
+		{name: "malformed", err: &queryError{class: outcomeMalformed, err: dns.ErrShortRead}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if failed := breakerFailure(tc.err); failed != tc.expected {
+				t.Errorf("expected failure %v, got %v", tc.expected, failed)
+			}
+		})
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	servfail := rcodeError(dns.RcodeServerFailure)
+	nxdomain := rcodeError(dns.RcodeNameError)
+	// The steps of a test case are one of:
+	//  - "fail", "answer" or "ok": record a query with a SERVFAIL, an NXDOMAIN
+	//    or a NOERROR response that wasn't a probe.
+	//  - "probe fail" or "probe ok": record the result of the probe.
+	//  - "cooldown": let the open breaker's cooldown pass.
+	//  - "allow" or "deny": check whether allow lets the next query through.
+	testCases := []struct {
+		name     string
+		steps    []string
+		expected string
+	}{
+		{name: "new", expected: "closed"},
+		{name: "failures below the threshold", steps: []string{"fail", "fail", "allow"}, expected: "closed"},
+		{name: "answers aren't failures", steps: []string{"answer", "answer", "answer"}, expected: "closed"},
+		{name: "success resets the failures", steps: []string{"fail", "fail", "ok", "fail", "fail"}, expected: "closed"},
+		{name: "consecutive failures", steps: []string{"fail", "fail", "fail", "deny"}, expected: "open"},
+		{name: "late results while open", steps: []string{"fail", "fail", "fail", "ok", "deny"}, expected: "open"},
+		{name: "one probe at a time", steps: []string{"fail", "fail", "fail", "cooldown", "allow", "deny"}, expected: "half-open"},
+		{name: "probe succeeds", steps: []string{"fail", "fail", "fail", "cooldown", "allow", "probe ok", "allow"}, expected: "closed"},
+		{name: "probe fails", steps: []string{"fail", "fail", "fail", "cooldown", "allow", "probe fail", "deny"}, expected: "open"},
+		{name: "reopened breaker cools down again", steps: []string{"fail", "fail", "fail", "cooldown", "allow", "probe fail", "cooldown", "allow", "probe ok"}, expected: "closed"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := testBreaker("127.0.0.1:53", 3, time.Hour)
+			for i, step := range tc.steps {
+				switch step {
+				case "fail":
+					b.record(false, servfail)
+				case "answer":
+					b.record(false, nxdomain)
+				case "ok":
+					b.record(false, nil)
+				case "probe fail":
+					b.record(true, servfail)
+				case "probe ok":
+					b.record(true, nil)
+				case "cooldown":
+					b.opened = b.opened.Add(-b.cooldown)
+				case "allow", "deny":
+					if allowed, _ := b.allow(); allowed != (step == "allow") {
+						t.Fatalf("step %d: expected allowed %v, got %v", i+1, step == "allow", allowed)
+					}
+				default:
+					t.Fatalf("unknown step %q", step)
+				}
+			}
+			if state := b.stateName(); state != tc.expected {
+				t.Errorf("expected state %q, got %q", tc.expected, state)
+			}
+		})
+	}
+}
+
+func TestValidBreaker(t *testing.T) {
+	testCases := []struct {
+		name    string
+		exp     Experiment
+		wantErr bool
+	}{
+		{name: "disabled", exp: Experiment{}},
+		{name: "enabled", exp: Experiment{BreakerFailures: 5, BreakerCooldown: time.Second}},
+		{name: "negative failures", exp: Experiment{BreakerFailures: -1}, wantErr: true},
+		{name: "no cooldown", exp: Experiment{BreakerFailures: 5}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.exp.validBreaker(); (err != nil) != tc.wantErr {
+				t.Errorf("expected an error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package dnslol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// searchPrecision is how close (as a fraction of the highest sustainable
+	// rate) the lowest failing rate must be before a capacity search is
+	// considered converged.
+	searchPrecision = 0.05
+	// searchMinOffered is the fraction of the target rate that must actually be
+	// sent during a search interval for the interval to count. If dnslol can't
+	// offer the load (e.g. Parallel is too low) the result says nothing about
+	// the server.
+	searchMinOffered = 0.9
+)
+
+// serverSearch holds the capacity search state for a single server.
+type serverSearch struct {
+	server server
+
+	// Stats for the current search interval.
+	attempts uint64
+	failures uint64
+	latency  latencyHist
+
+	// rate is the QPS currently being offered to the server.
+	rate float64
+	// best is the highest achieved QPS for which the SLO held.
+	best float64
+	// ceiling is the lowest QPS for which the SLO was broken, or zero if the SLO
+	// has not been broken yet.
+	ceiling float64
+	// done is true once the search has converged.
+	done bool
+}
+
+// capacitySearch is a control loop that adjusts the QPS offered to each of an
+// Experiment's servers to find the highest rate each server can sustain
+// without breaking the Experiment's SLO. The rate is increased by the
+// Experiment's SearchStep factor until the SLO breaks, after which the
+// highest passing and lowest failing rates are bisected until they are within
+// searchPrecision of each other.
+type capacitySearch struct {
+	sync.Mutex
+	exp     Experiment
+	servers map[string]*serverSearch
+	// finished is closed when the search has converged for every server.
+	finished chan struct{}
+}
+
+// newCapacitySearch creates a capacitySearch for the given Experiment. The
+// Experiment's servers must have rate limiters.
+func newCapacitySearch(e Experiment) *capacitySearch {
+	cs := &capacitySearch{
+		exp:      e,
+		servers:  make(map[string]*serverSearch, len(e.servers)),
+		finished: make(chan struct{}),
+	}
+	for _, s := range e.servers {
+		cs.servers[s.address] = &serverSearch{
+			server: s,
+			rate:   e.ServerQPS,
+		}
+	}
+	return cs
+}
+
+// validSearch checks the capacity search settings of the Experiment.
+func (e Experiment) validSearch() error {
+	if e.ServerQPS <= 0 {
+		return errors.New(
+			"Experiment must have a ServerQPS starting rate to use CapacitySearch")
+	}
+	if e.RampMode != RampNone {
+		return errors.New(`Experiment must have a RampMode of "none" to use CapacitySearch`)
+	}
+	if e.SLOErrorRate <= 0 && e.SLOLatency <= 0 {
+		return errors.New(
+			"Experiment must have an SLOErrorRate or SLOLatency to use CapacitySearch")
+	}
+	if e.SearchInterval <= 0 {
+		return errors.New("Experiment must have a positive SearchInterval")
+	}
+	if e.SearchStep <= 1 {
+		return errors.New("Experiment must have a SearchStep greater than 1")
+	}
+	return nil
+}
+
+// observe records the result of one query to the given server in the current
+// search interval.
+func (cs *capacitySearch) observe(address string, rtt time.Duration, err error) {
+	cs.Lock()
+	defer cs.Unlock()
+	s, ok := cs.servers[address]
+	if !ok {
+		return
+	}
+	s.attempts++
+	if err != nil {
+		s.failures++
+	}
+	s.latency.Observe(rtt)
+}
+
+// run applies the initial rates and then evaluates and adjusts them every
+// SearchInterval until the search has converged for all servers or the
+// Experiment is finished.
+func (cs *capacitySearch) run() {
+	cs.Lock()
+	for _, s := range cs.servers {
+		s.server.limiter.SetRate(s.rate)
+		stats.searchRate.With(prom.Labels{"server": s.server.address}).Set(s.rate)
+	}
+	cs.Unlock()
+
+	ticker := time.NewTicker(cs.exp.SearchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.exp.done:
+			return
+		case <-ticker.C:
+			if cs.step() {
+				close(cs.finished)
+				log.Printf("Capacity search finished:\n%s", cs.Report())
+				return
+			}
+		}
+	}
+}
+
+// step evaluates the interval that just ended for each server and adjusts the
+// offered rate. It returns true once every server's search has converged.
+func (cs *capacitySearch) step() bool {
+	cs.Lock()
+	defer cs.Unlock()
+
+	allDone := true
+	for _, s := range cs.servers {
+		if !s.done {
+			cs.stepServer(s)
+		}
+		allDone = allDone && s.done
+		// Reset the interval stats even for finished servers so that the next
+		// interval starts fresh.
+		s.attempts, s.failures = 0, 0
+		s.latency.Reset()
+	}
+	return allDone
+}
+
+// stepServer evaluates the interval that just ended for one server and
+// adjusts its offered rate. The caller must hold the lock.
+func (cs *capacitySearch) stepServer(s *serverSearch) {
+	labels := prom.Labels{"server": s.server.address}
+	achieved := float64(s.attempts) / cs.exp.SearchInterval.Seconds()
+	var errRate float64
+	if s.attempts > 0 {
+		errRate = float64(s.failures) / float64(s.attempts)
+	}
+	p99 := s.latency.Quantile(0.99)
+	ok := (cs.exp.SLOErrorRate <= 0 || errRate <= cs.exp.SLOErrorRate) &&
+		(cs.exp.SLOLatency <= 0 || p99 <= cs.exp.SLOLatency)
+
+	// A saturated server answers slowly, which holds the queries in flight
+	// up to the Parallel limit and lowers the achieved rate, so an interval
+	// that didn't offer the target rate still counts if it broke the SLO.
+	// If the SLO held dnslol couldn't offer the load, which says nothing
+	// about the server.
+	if ok && achieved < s.rate*searchMinOffered {
+		log.Printf(
+			"Capacity search for %s: only sent %.1f of target %.1f QPS, "+
+				"holding rate (is -parallel too low?)\n",
+			s.server.address, achieved, s.rate)
+		return
+	}
+	log.Printf(
+		"Capacity search for %s: %.1f QPS, error rate %.4f, p99 %s, SLO ok: %v\n",
+		s.server.address, achieved, errRate, p99, ok)
+
+	if ok {
+		if achieved > s.best {
+			s.best = achieved
+			stats.searchSustainable.With(labels).Set(s.best)
+		}
+	} else if s.ceiling == 0 || s.rate < s.ceiling {
+		s.ceiling = s.rate
+	}
+
+	switch {
+	case s.ceiling == 0:
+		// The SLO hasn't broken yet, keep stepping up.
+		s.rate *= cs.exp.SearchStep
+	case s.ceiling-s.best <= s.best*searchPrecision:
+		// Converged. Back off to the highest sustainable rate.
+		s.done = true
+		s.rate = s.best
+	case s.best == 0:
+		// The SLO broke at the first rate tried, back off until it holds.
+		s.rate /= cs.exp.SearchStep
+	default:
+		// Bisect between the highest passing and lowest failing rates.
+		s.rate = (s.best + s.ceiling) / 2
+	}
+	if s.rate > 0 {
+		s.server.limiter.SetRate(s.rate)
+	}
+	stats.searchRate.With(labels).Set(s.rate)
+}
+
+// Report returns a human readable table with the highest sustainable QPS found
+// for each server so far.
+func (cs *capacitySearch) Report() string {
+	cs.Lock()
+	defer cs.Unlock()
+
+	addrs := make([]string, 0, len(cs.servers))
+	for addr := range cs.servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var report strings.Builder
+	fmt.Fprintf(&report, "%-30s %15s %15s %10s\n",
+		"Server", "Sustainable QPS", "Failing QPS", "Converged")
+	for _, addr := range addrs {
+		s := cs.servers[addr]
+		fmt.Fprintf(&report, "%-30s %15.1f %15.1f %10v\n",
+			addr, s.best, s.ceiling, s.done)
+	}
+	return report.String()
+}
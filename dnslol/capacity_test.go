@@ -0,0 +1,102 @@
+package dnslol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStepServer(t *testing.T) {
+	exp := Experiment{
+		SLOErrorRate:   0.01,
+		SLOLatency:     500 * time.Millisecond,
+		SearchInterval: time.Second,
+		SearchStep:     2,
+	}
+	testCases := []struct {
+		name        string
+		attempts    uint64
+		failures    uint64
+		latency     time.Duration
+		wantRate    float64
+		wantCeiling float64
+	}{
+		{
+			name:     "SLO holds at the target rate",
+			attempts: 100,
+			latency:  10 * time.Millisecond,
+			wantRate: 200,
+		},
+		{
+			name:        "SLO breaks at the target rate",
+			attempts:    100,
+			failures:    10,
+			latency:     10 * time.Millisecond,
+			wantRate:    50,
+			wantCeiling: 100,
+		},
+		{
+			name:     "SLO holds below the target rate",
+			attempts: 50,
+			latency:  10 * time.Millisecond,
+			wantRate: 100,
+		},
+		{
+			name:        "saturated server breaks the SLO below the target rate",
+			attempts:    50,
+			latency:     2 * time.Second,
+			wantRate:    50,
+			wantCeiling: 100,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := &capacitySearch{exp: exp}
+			s := &serverSearch{
+				server:   server{address: "127.0.0.1:53", limiter: newRateLimiter(0)},
+				attempts: tc.attempts,
+				failures: tc.failures,
+				rate:     100,
+			}
+			for i := uint64(0); i < tc.attempts; i++ {
+				s.latency.Observe(tc.latency)
+			}
+			cs.stepServer(s)
+			if s.rate != tc.wantRate {
+				t.Errorf("expected rate %g, got %g", tc.wantRate, s.rate)
+			}
+			if s.ceiling != tc.wantCeiling {
+				t.Errorf("expected ceiling %g, got %g", tc.wantCeiling, s.ceiling)
+			}
+		})
+	}
+}
+
+func TestCapacitySearchDone(t *testing.T) {
+	e := Experiment{
+		ServerQPS:      100,
+		SLOErrorRate:   0.01,
+		SLOLatency:     500 * time.Millisecond,
+		SearchInterval: time.Hour,
+		SearchStep:     2,
+		servers:        []server{{address: "127.0.0.1:53", limiter: newRateLimiter(0)}},
+		done:           make(chan struct{}),
+	}
+	cs := newCapacitySearch(e)
+	returned := make(chan struct{})
+	go func() {
+		cs.run()
+		close(returned)
+	}()
+
+	close(e.done)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the search to stop once the Experiment is finished")
+	}
+	select {
+	case <-cs.finished:
+		t.Error("expected an unfinished search not to report that it finished")
+	default:
+	}
+}
@@ -0,0 +1,539 @@
+package dnslol
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// runControl holds the state of a running Experiment that can be changed while
+// it runs: the number of workers, the target query rates, whether dispatch is
+// paused and whether the Experiment has been stopped.
+type runControl struct {
+	sync.Mutex
+	// startWorker starts one new worker goroutine.
+	startWorker func()
+	// workers is the number of workers that should be running.
+	workers int
+	// running is the number of workers currently running.
+	running int
+	// qps and serverQPS are the current target query rates at full load.
+	qps       float64
+	serverQPS float64
+	// manualWorkers and manualRates are true once the workers or the rates
+	// have been changed through the control API. The ramp schedule stops
+	// adjusting them after that.
+	manualWorkers bool
+	manualRates   bool
+	// resume is non-nil while dispatch is paused and is closed to resume it.
+	resume chan struct{}
+	// stop is closed when the Experiment is stopped.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// stopReason is why the Experiment was stopped, set before stop is
+	// closed.
+	stopReason string
+}
+
+// newRunControl creates a runControl for the given Experiment. The worker count
+// starts at zero; spawn raises it according to the ramp schedule.
+func newRunControl(e Experiment) *runControl {
+	return &runControl{
+		qps:       e.QPS,
+		serverQPS: e.ServerQPS,
+		stop:      make(chan struct{}),
+	}
+}
+
+// setWorkers sets the number of workers that should be running, starting new
+// workers if needed. Surplus workers exit before taking their next name. If
+// the Experiment has no workers (e.g. it is serving lookups) only the count is
+// changed.
+func (c *runControl) setWorkers(n int) {
+	c.Lock()
+	defer c.Unlock()
+	c.workers = n
+	if c.startWorker == nil {
+		return
+	}
+	for ; c.running < c.workers; c.running++ {
+		go c.startWorker()
+	}
+}
+
+// retire returns true if the calling worker should exit because there are more
+// workers running than wanted, counting it as no longer running. The caller
+// must exit if true is returned.
+func (c *runControl) retire() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.running > c.workers {
+		c.running--
+		return true
+	}
+	return false
+}
+
+// workerExited records that a worker exited because there are no more names.
+func (c *runControl) workerExited() {
+	c.Lock()
+	defer c.Unlock()
+	c.running--
+}
+
+// work runs a worker: it calls process with each name received from names
+// until names is closed or the worker is retired. Paused workers wait before
+// taking their next name.
+func (c *runControl) work(names <-chan Target, process func(Target)) {
+	for !c.retire() {
+		c.waitIfPaused()
+		target, ok := <-names
+		if !ok {
+			c.workerExited()
+			return
+		}
+		process(target)
+	}
+}
+
+// rates returns the current target QPS and per-server QPS.
+func (c *runControl) rates() (qps, serverQPS float64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.qps, c.serverQPS
+}
+
+// pause stops the dispatch of new names and queries until resume is called.
+// Queries already sent are allowed to complete.
+func (c *runControl) pause() {
+	c.Lock()
+	defer c.Unlock()
+	if c.resume == nil {
+		c.resume = make(chan struct{})
+	}
+}
+
+// unpause resumes dispatch after pause.
+func (c *runControl) unpause() {
+	c.Lock()
+	defer c.Unlock()
+	if c.resume != nil {
+		close(c.resume)
+		c.resume = nil
+	}
+}
+
+// paused returns true if dispatch is paused.
+func (c *runControl) paused() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.resume != nil
+}
+
+// waitIfPaused blocks while dispatch is paused. It returns early if the
+// Experiment is stopped.
+func (c *runControl) waitIfPaused() {
+	c.Lock()
+	resume := c.resume
+	c.Unlock()
+	if resume == nil {
+		return
+	}
+	select {
+	case <-resume:
+	case <-c.stop:
+	}
+}
+
+// Stop asks the Experiment to stop gracefully: the caller feeding names should
+// stop sending names (see Stopped), and names that are already being processed
+// are completed. It is safe to call Stop more than once.
+func (e Experiment) Stop() {
+	e.stopFor(stopRequested)
+}
+
+// stopFor stops the Experiment like Stop, recording the given reason in its
+// status. Only the reason of the first stop is kept.
+func (e Experiment) stopFor(reason string) {
+	c := e.control
+	c.stopOnce.Do(func() {
+		log.Printf("Stopping experiment: %s\n", reason)
+		c.Lock()
+		c.stopReason = reason
+		c.Unlock()
+		close(c.stop)
+	})
+}
+
+// StopReason returns why the Experiment was stopped, or "" if it hasn't been.
+func (e Experiment) StopReason() string {
+	c := e.control
+	c.Lock()
+	defer c.Unlock()
+	return c.stopReason
+}
+
+// Stopped returns a channel that is closed when the Experiment has been asked
+// to stop. Callers feeding names to the Experiment should stop sending names
+// once it is closed.
+func (e Experiment) Stopped() <-chan struct{} {
+	return e.control.stop
+}
+
+// isStopped returns true if the Experiment has been asked to stop.
+func (e Experiment) isStopped() bool {
+	select {
+	case <-e.control.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// serverStatus is the /status representation of one server's health.
+type serverStatus struct {
+	Address     string            `json:"address"`
+	Attempts    uint64            `json:"attempts"`
+	Successes   uint64            `json:"successes"`
+	SuccessRate float64           `json:"successRate"`
+	Inflight    int64             `json:"inflight"`
+	Outcomes    map[string]uint64 `json:"outcomes"`
+	LatencyP50  float64           `json:"latencyP50"`
+	LatencyP99  float64           `json:"latencyP99"`
+	RateLimit   float64           `json:"rateLimit"`
+	// The queries first sent to the server whose last attempt has completed
+	// and the fraction of them that succeeded, which differ from the attempts
+	// when queries are retried.
+	Queries              uint64  `json:"queries"`
+	EffectiveSuccessRate float64 `json:"effectiveSuccessRate"`
+	// The hedges sent for a hedged resolver set's queries.
+	Hedges uint64 `json:"hedges,omitempty"`
+	// The queries skipped while the server's circuit breaker was open and
+	// the breaker's state: "closed", "open" or "half-open".
+	Skipped      uint64 `json:"skipped,omitempty"`
+	BreakerState string `json:"breakerState,omitempty"`
+}
+
+// statusSettings are the settings of an Experiment reported by the /status
+// endpoint. They are an allow-list of the Experiment's fields: the others,
+// e.g. the CommandLine which may include the database password, are left out
+// because the endpoint isn't authenticated.
+type statusSettings struct {
+	Servers           []string
+	Proto             string
+	Timeout           time.Duration
+	Attempts          int
+	Failover          bool
+	ResolverSet       string
+	BreakerFailures   int
+	Parallel          int
+	MaxInflight       int
+	ServerMaxInflight int
+	PoolConns         int
+	QPS               float64
+	ServerQPS         float64
+	RampMode          string
+	RampDuration      time.Duration
+	RampSteps         int
+	CapacitySearch    bool
+	CheckA            bool
+	CheckAAAA         bool
+	CheckTXT          bool
+	Count             int
+	MaxDuration       time.Duration
+	MaxQueries        int64
+	AbortErrorRate    float64
+	Parent            string
+	Shard, Shards     int
+}
+
+// settings returns the Experiment's statusSettings.
+func (e Experiment) settings() statusSettings {
+	return statusSettings{
+		Servers:           e.Servers,
+		Proto:             e.Proto,
+		Timeout:           e.Timeout,
+		Attempts:          e.Attempts,
+		Failover:          e.Failover,
+		ResolverSet:       e.ResolverSet,
+		BreakerFailures:   e.BreakerFailures,
+		Parallel:          e.Parallel,
+		MaxInflight:       e.MaxInflight,
+		ServerMaxInflight: e.ServerMaxInflight,
+		PoolConns:         e.PoolConns,
+		QPS:               e.QPS,
+		ServerQPS:         e.ServerQPS,
+		RampMode:          e.RampMode,
+		RampDuration:      e.RampDuration,
+		RampSteps:         e.RampSteps,
+		CapacitySearch:    e.CapacitySearch,
+		CheckA:            e.CheckA,
+		CheckAAAA:         e.CheckAAAA,
+		CheckTXT:          e.CheckTXT,
+		Count:             e.Count,
+		MaxDuration:       e.MaxDuration,
+		MaxQueries:        e.MaxQueries,
+		AbortErrorRate:    e.AbortErrorRate,
+		Parent:            e.Parent,
+		Shard:             e.Shard,
+		Shards:            e.Shards,
+	}
+}
+
+// experimentStatus is the JSON body returned by the /status endpoint.
+type experimentStatus struct {
+	ID            int64          `json:"id"`
+	ParentID      int64          `json:"parentID,omitempty"`
+	Experiment    statusSettings `json:"experiment"`
+	Elapsed       float64        `json:"elapsed"`
+	Names         uint64         `json:"names"`
+	ExpectedNames int64          `json:"expectedNames"`
+	Workers       int            `json:"workers"`
+	QPS           float64        `json:"qps"`
+	ServerQPS     float64        `json:"serverQPS"`
+	Paused        bool           `json:"paused"`
+	Stopped       bool           `json:"stopped"`
+	StopReason    string         `json:"stopReason,omitempty"`
+	Servers       []serverStatus `json:"servers"`
+}
+
+// status returns the current status of the Experiment.
+func (e Experiment) status() experimentStatus {
+	c := e.control
+	c.Lock()
+	st := experimentStatus{
+		ID:            e.id,
+		ParentID:      e.parentID,
+		Experiment:    e.settings(),
+		ExpectedNames: e.ExpectedNames,
+		Workers:       c.workers,
+		QPS:           c.qps,
+		ServerQPS:     c.serverQPS,
+		Paused:        c.resume != nil,
+		StopReason:    c.stopReason,
+	}
+	c.Unlock()
+	st.Stopped = e.isStopped()
+
+	rs := e.summary
+	rs.Lock()
+	defer rs.Unlock()
+	st.Elapsed = time.Since(rs.start).Seconds()
+	st.Names = rs.names
+	for _, addr := range rs.addresses() {
+		s := rs.servers[addr]
+		outcomes := make(map[string]uint64, len(s.outcomes))
+		for class, n := range s.outcomes {
+			outcomes[class] = n
+		}
+		st.Servers = append(st.Servers, serverStatus{
+			Address:     addr,
+			Attempts:    s.attempts,
+			Successes:   s.successes,
+			SuccessRate: percent(s.successes, s.attempts) / 100,
+			Inflight:    s.inflight,
+			Outcomes:    outcomes,
+			LatencyP50:  s.latency.Quantile(0.5).Seconds(),
+			LatencyP99:  s.latency.Quantile(0.99).Seconds(),
+
+			Queries:              s.queries,
+			EffectiveSuccessRate: percent(s.effectiveSuccesses, s.queries) / 100,
+			Hedges:               s.hedges,
+			Skipped:              s.skipped,
+		})
+	}
+	for i := range st.Servers {
+		for _, srv := range e.servers {
+			if srv.address == st.Servers[i].Address {
+				st.Servers[i].RateLimit = srv.limiter.Rate()
+			}
+		}
+		if b := e.breakers[st.Servers[i].Address]; b != nil {
+			st.Servers[i].BreakerState = b.stateName()
+		}
+	}
+	return st
+}
+
+// writeJSON writes v to w as an indented JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Error writing JSON response: %v\n", err)
+	}
+}
+
+// postOnly wraps a handler so that it only accepts POST requests.
+func postOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// authorized wraps a control handler so that, if the Experiment has a
+// ControlToken, it only accepts requests with the token as their bearer
+// token.
+func (e Experiment) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if e.ControlToken != "" {
+			want := "Bearer " + e.ControlToken
+			got := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// handleStatus serves the Experiment's configuration, progress and per-server
+// health as JSON.
+func (e Experiment) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, e.status())
+}
+
+// handlePause pauses the dispatch of new names and queries.
+func (e Experiment) handlePause(w http.ResponseWriter, r *http.Request) {
+	e.control.pause()
+	log.Printf("Dispatch paused\n")
+	writeJSON(w, e.status())
+}
+
+// handleResume resumes the dispatch of names and queries after a pause.
+func (e Experiment) handleResume(w http.ResponseWriter, r *http.Request) {
+	e.control.unpause()
+	// Time spent paused shouldn't count against the latency correction.
+	e.limiter.resetSchedule()
+	for _, s := range e.servers {
+		s.limiter.resetSchedule()
+	}
+	log.Printf("Dispatch resumed\n")
+	writeJSON(w, e.status())
+}
+
+// handleStop asks the Experiment to stop gracefully.
+func (e Experiment) handleStop(w http.ResponseWriter, r *http.Request) {
+	e.Stop()
+	writeJSON(w, e.status())
+}
+
+// handleParallelism changes the number of workers and/or the target query
+// rates of the Experiment. The new values are given by the "workers", "qps"
+// and "serverQPS" form values. A rate of zero removes the limit. The ramp
+// schedule keeps adjusting whichever of the workers and the rates aren't
+// given. The workers can only be raised above Parallel if the Experiment has
+// a MaxInflight.
+func (e Experiment) handleParallelism(w http.ResponseWriter, r *http.Request) {
+	workers, err := formInt(r, "workers")
+	if err != nil || workers < 0 {
+		http.Error(w, "workers must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	// Without a MaxInflight the scheduler's in-flight limit is sized for
+	// Parallel workers, which would cap any more.
+	if workers > e.Parallel && e.MaxInflight == 0 {
+		http.Error(w, fmt.Sprintf(
+			"workers must be at most the parallel setting (%d) without a maxInflight limit",
+			e.Parallel), http.StatusBadRequest)
+		return
+	}
+	qps, err := formFloat(r, "qps")
+	if err != nil || qps < 0 {
+		http.Error(w, "qps must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+	serverQPS, err := formFloat(r, "serverQPS")
+	if err != nil || serverQPS < 0 {
+		http.Error(w, "serverQPS must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+	if e.search != nil && r.FormValue("serverQPS") != "" {
+		http.Error(w, "serverQPS is controlled by the capacity search",
+			http.StatusConflict)
+		return
+	}
+
+	c := e.control
+	c.Lock()
+	setQPS, setServerQPS := r.FormValue("qps") != "", r.FormValue("serverQPS") != ""
+	if setQPS {
+		c.qps = qps
+	}
+	if setServerQPS {
+		c.serverQPS = serverQPS
+	}
+	if setQPS || setServerQPS {
+		c.manualRates = true
+	}
+	newWorkers, newQPS, newServerQPS := c.workers, c.qps, c.serverQPS
+	if workers > 0 {
+		c.manualWorkers = true
+		newWorkers = workers
+	}
+	c.Unlock()
+	if workers > 0 {
+		c.setWorkers(workers)
+	}
+	if setQPS || setServerQPS {
+		if e.search == nil {
+			e.setRateLevel(1)
+		} else {
+			e.limiter.SetRate(newQPS)
+		}
+	}
+	log.Printf("Parallelism changed: workers=%d qps=%g serverQPS=%g\n",
+		newWorkers, newQPS, newServerQPS)
+	writeJSON(w, e.status())
+}
+
+// formInt returns the named form value as an int, or zero if it is empty.
+func formInt(r *http.Request, key string) (int, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// formFloat returns the named form value as a float64, or zero if it is empty.
+// Values that aren't finite numbers are rejected.
+func formFloat(r *http.Request, key string) (float64, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid %s: %q is not a finite number", key, v)
+	}
+	return f, nil
+}
+
+// registerControlHandlers adds the Experiment's status and control endpoints to
+// the given mux.
+func (e Experiment) registerControlHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/status", e.handleStatus)
+	mux.HandleFunc("/pause", postOnly(e.authorized(e.handlePause)))
+	mux.HandleFunc("/resume", postOnly(e.authorized(e.handleResume)))
+	mux.HandleFunc("/parallelism", postOnly(e.authorized(e.handleParallelism)))
+	mux.HandleFunc("/stop", postOnly(e.authorized(e.handleStop)))
+	mux.HandleFunc("/events", e.handleEvents)
+}
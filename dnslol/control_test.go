@@ -0,0 +1,349 @@
+package dnslol
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// controlExperiment returns the given Experiment prepared with two Parallel
+// workers querying one server, and a test server serving its status and
+// control API.
+func controlExperiment(t *testing.T, e Experiment) (Experiment, *httptest.Server) {
+	t.Helper()
+	e.Servers = []string{"192.0.2.1:53"}
+	e.Proto = "udp"
+	e.Timeout = time.Second
+	e.Parallel = 2
+	e.CheckA = true
+	e.CommandLine = "dnslol -db user:secret@tcp(db:3306)/dnslol"
+	e.servers = []server{{address: "192.0.2.1:53"}}
+	if _, err := e.prepare(0); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	e.registerControlHandlers(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return e, srv
+}
+
+// controlRequest sends a request to the control API and returns the response
+// status code and, for successful requests, the decoded status.
+func controlRequest(
+	t *testing.T, srv *httptest.Server, method, path, token string) (int, experimentStatus) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st experimentStatus
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, st
+}
+
+func TestControlAuthorization(t *testing.T) {
+	testCases := []struct {
+		name         string
+		controlToken string
+		method       string
+		path         string
+		token        string
+		expected     int
+	}{
+		{
+			name:     "status needs no token",
+			method:   http.MethodGet,
+			path:     "/status",
+			expected: http.StatusOK,
+		},
+		{
+			name:         "status ignores the control token",
+			controlToken: "s3cret",
+			method:       http.MethodGet,
+			path:         "/status",
+			expected:     http.StatusOK,
+		},
+		{
+			name:     "control endpoints are POST only",
+			method:   http.MethodGet,
+			path:     "/pause",
+			expected: http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "no control token configured",
+			method:   http.MethodPost,
+			path:     "/pause",
+			expected: http.StatusOK,
+		},
+		{
+			name:         "missing token",
+			controlToken: "s3cret",
+			method:       http.MethodPost,
+			path:         "/pause",
+			expected:     http.StatusUnauthorized,
+		},
+		{
+			name:         "wrong token",
+			controlToken: "s3cret",
+			method:       http.MethodPost,
+			path:         "/parallelism?workers=1",
+			token:        "guess",
+			expected:     http.StatusUnauthorized,
+		},
+		{
+			name:         "correct token",
+			controlToken: "s3cret",
+			method:       http.MethodPost,
+			path:         "/parallelism?workers=1",
+			token:        "s3cret",
+			expected:     http.StatusOK,
+		},
+		{
+			name:         "stop requires the token",
+			controlToken: "s3cret",
+			method:       http.MethodPost,
+			path:         "/stop",
+			expected:     http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, srv := controlExperiment(t, Experiment{ControlToken: tc.controlToken})
+			if code, _ := controlRequest(t, srv, tc.method, tc.path, tc.token); code != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, code)
+			}
+			if tc.expected == http.StatusUnauthorized {
+				if st := e.status(); st.Paused || st.Stopped || st.Workers != 0 {
+					t.Errorf("expected unauthorized request to change nothing")
+				}
+			}
+		})
+	}
+}
+
+func TestControlPauseResumeStop(t *testing.T) {
+	e, srv := controlExperiment(t, Experiment{})
+
+	_, st := controlRequest(t, srv, http.MethodPost, "/pause", "")
+	if !st.Paused || !e.status().Paused {
+		t.Errorf("expected the experiment to be paused")
+	}
+	// Pausing twice keeps it paused.
+	if _, st = controlRequest(t, srv, http.MethodPost, "/pause", ""); !st.Paused {
+		t.Errorf("expected the experiment to stay paused")
+	}
+
+	_, st = controlRequest(t, srv, http.MethodPost, "/resume", "")
+	if st.Paused || e.status().Paused {
+		t.Errorf("expected the experiment to be resumed")
+	}
+
+	_, st = controlRequest(t, srv, http.MethodPost, "/stop", "")
+	if !st.Stopped || st.StopReason != stopRequested {
+		t.Errorf("expected stopped with reason %q, got stopped %t reason %q",
+			stopRequested, st.Stopped, st.StopReason)
+	}
+	select {
+	case <-e.Stopped():
+	default:
+		t.Errorf("expected the Stopped channel to be closed")
+	}
+	// Stopping again is harmless.
+	if code, _ := controlRequest(t, srv, http.MethodPost, "/stop", ""); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestControlParallelism(t *testing.T) {
+	testCases := []struct {
+		name              string
+		maxInflight       int
+		query             string
+		expectedCode      int
+		expectedWorkers   int
+		expectedQPS       float64
+		expectedServerQPS float64
+	}{
+		{
+			name:         "workers",
+			query:        "workers=1",
+			expectedCode: http.StatusOK, expectedWorkers: 1,
+		},
+		{
+			name:         "workers above parallel",
+			query:        "workers=8",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "workers above parallel with maxInflight",
+			maxInflight:  100,
+			query:        "workers=8",
+			expectedCode: http.StatusOK, expectedWorkers: 8,
+		},
+		{
+			name:         "rates",
+			query:        "qps=50&serverQPS=10",
+			expectedCode: http.StatusOK, expectedQPS: 50, expectedServerQPS: 10,
+		},
+		{
+			name:         "negative workers",
+			query:        "workers=-1",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "invalid workers",
+			query:        "workers=many",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "negative qps",
+			query:        "qps=-5",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "NaN qps",
+			query:        "qps=NaN",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "infinite qps",
+			query:        "qps=%2BInf",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "infinite serverQPS",
+			query:        "serverQPS=Inf",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, srv := controlExperiment(t, Experiment{MaxInflight: tc.maxInflight})
+			code, _ := controlRequest(t, srv, http.MethodPost, "/parallelism?"+tc.query, "")
+			if code != tc.expectedCode {
+				t.Fatalf("expected status %d, got %d", tc.expectedCode, code)
+			}
+			st := e.status()
+			if st.Workers != tc.expectedWorkers {
+				t.Errorf("expected %d workers, got %d", tc.expectedWorkers, st.Workers)
+			}
+			if st.QPS != tc.expectedQPS || st.ServerQPS != tc.expectedServerQPS {
+				t.Errorf("expected qps %g serverQPS %g, got qps %g serverQPS %g",
+					tc.expectedQPS, tc.expectedServerQPS, st.QPS, st.ServerQPS)
+			}
+			if rate := e.limiter.Rate(); rate != tc.expectedQPS {
+				t.Errorf("expected limiter rate %g, got %g", tc.expectedQPS, rate)
+			}
+			if rate := e.servers[0].limiter.Rate(); rate != tc.expectedServerQPS {
+				t.Errorf("expected server limiter rate %g, got %g", tc.expectedServerQPS, rate)
+			}
+		})
+	}
+}
+
+func TestStatusSettings(t *testing.T) {
+	_, srv := controlExperiment(t, Experiment{ControlToken: "s3cret"})
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret", "s3cret", "CommandLine", "ControlToken"} {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("expected /status not to include %q, got %s", secret, body)
+		}
+	}
+	var st experimentStatus
+	if err := json.Unmarshal(body, &st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Experiment.Servers) != 1 || st.Experiment.Servers[0] != "192.0.2.1:53" {
+		t.Errorf("expected servers [192.0.2.1:53], got %v", st.Experiment.Servers)
+	}
+	if st.Experiment.Parallel != 2 {
+		t.Errorf("expected parallel 2, got %d", st.Experiment.Parallel)
+	}
+}
+
+func TestRunControlWorkers(t *testing.T) {
+	c := newRunControl(Experiment{})
+	names := make(chan Target)
+	var live int64
+	c.startWorker = func() {
+		atomic.AddInt64(&live, 1)
+		defer atomic.AddInt64(&live, -1)
+		c.work(names, func(Target) {})
+	}
+	// feedUntil sends names to the workers until n of them are live and the
+	// control's count of running workers agrees.
+	feedUntil := func(n int64) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			c.Lock()
+			running := c.running
+			c.Unlock()
+			if atomic.LoadInt64(&live) == n && running == int(n) {
+				return
+			}
+			select {
+			case names <- Target{Name: "example.com"}:
+			case <-time.After(10 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("expected %d live workers, got %d (%d running)",
+					n, atomic.LoadInt64(&live), running)
+			}
+		}
+	}
+
+	for _, workers := range []int{4, 2, 1, 5, 3, 6} {
+		c.setWorkers(workers)
+		feedUntil(int64(workers))
+		// The count stays put while the workers take more names.
+		for i := 0; i < 2*workers; i++ {
+			names <- Target{Name: "example.com"}
+		}
+		if got := atomic.LoadInt64(&live); got != int64(workers) {
+			t.Errorf("expected %d live workers, got %d", workers, got)
+		}
+	}
+
+	close(names)
+	deadline := time.After(5 * time.Second)
+	for atomic.LoadInt64(&live) != 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("expected all workers to exit, got %d live", atomic.LoadInt64(&live))
+		case <-time.After(time.Millisecond):
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.running != 0 {
+		t.Errorf("expected 0 running workers, got %d", c.running)
+	}
+}
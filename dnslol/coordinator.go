@@ -0,0 +1,664 @@
+package dnslol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxLeaseSize is the most targets handed out in one lease.
+	maxLeaseSize = 10000
+	// maxLeaseResultsBody is the largest lease completion request body
+	// accepted, in bytes.
+	maxLeaseResultsBody = 256 << 20
+	// leaseWait is the longest a lease request waits for targets from the
+	// input before the lease is granted with the targets it has.
+	leaseWait = time.Second
+	// leasePoll is how long workers wait before asking for another lease when
+	// there were no targets to lease.
+	leasePoll = time.Second
+	// leaseReap is how often expired leases are looked for.
+	leaseReap = time.Second
+)
+
+// workerConfig is the JSON body served to workers by the coordinator's
+// /experiment endpoint. It holds the coordinator's query settings, which
+// workers use in place of their own so that every worker performs the same
+// queries.
+type workerConfig struct {
+	ID        int64         `json:"id"`
+	Servers   []string      `json:"servers"`
+	Proto     string        `json:"proto"`
+	Timeout   time.Duration `json:"timeout"`
+	CheckA    bool          `json:"checkA"`
+	CheckAAAA bool          `json:"checkAAAA"`
+	CheckTXT  bool          `json:"checkTXT"`
+	Count     int           `json:"count"`
+
+	Attempts       int           `json:"attempts"`
+	AttemptTimeout time.Duration `json:"attemptTimeout"`
+	RetryBackoff   time.Duration `json:"retryBackoff"`
+	RetryOn        []string      `json:"retryOn"`
+	Failover       bool          `json:"failover"`
+
+	ResolverSet string        `json:"resolverSet,omitempty"`
+	HedgeDelay  time.Duration `json:"hedgeDelay,omitempty"`
+
+	HedgePercentile float64 `json:"hedgePercentile,omitempty"`
+
+	DialTimeout         time.Duration `json:"dialTimeout,omitempty"`
+	TLSHandshakeTimeout time.Duration `json:"tlsHandshakeTimeout,omitempty"`
+	WriteTimeout        time.Duration `json:"writeTimeout,omitempty"`
+	ReadTimeout         time.Duration `json:"readTimeout,omitempty"`
+
+	BreakerFailures int           `json:"breakerFailures,omitempty"`
+	BreakerCooldown time.Duration `json:"breakerCooldown,omitempty"`
+}
+
+// leaseResponse is the JSON body of a granted or extended lease. The targets
+// are only sent when the lease is granted.
+type leaseResponse struct {
+	ID      int64    `json:"id"`
+	Targets []Target `json:"targets,omitempty"`
+	// When the lease expires and its targets are given to another worker,
+	// unless it is extended before then.
+	Deadline time.Time `json:"deadline"`
+	// How long the lease is held for after it is granted or extended.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// leaseResults is the JSON body of a lease completion request. It holds the
+// results of every target of the lease, one slice of results per target.
+type leaseResults struct {
+	Targets [][]workerResult `json:"targets"`
+}
+
+// workerResult is a query result sent by a worker to the coordinator. The
+// response is sent in wire format so that the coordinator can handle the
+// result exactly like the result of one of its own queries.
+type workerResult struct {
+	Sent     time.Time     `json:"sent"`
+	Server   string        `json:"server"`
+	Name     string        `json:"name"`
+	Type     uint16        `json:"type"`
+	Source   string        `json:"source,omitempty"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+	RTT      time.Duration `json:"rtt"`
+	Delay    time.Duration `json:"delay"`
+	Response []byte        `json:"response,omitempty"`
+	Attempt  int           `json:"attempt"`
+	Primary  string        `json:"primary"`
+	Started  time.Time     `json:"started"`
+	Retried  bool          `json:"retried,omitempty"`
+
+	Hedge      bool `json:"hedge,omitempty"`
+	Superseded bool `json:"superseded,omitempty"`
+	// The phase of the attempt that timed out, if it did.
+	TimeoutPhase string `json:"timeoutPhase,omitempty"`
+}
+
+// newWorkerResult returns the workerResult for a queryResult.
+func newWorkerResult(r queryResult) workerResult {
+	wr := workerResult{
+		Sent:    r.Sent,
+		Server:  r.Server.address,
+		Name:    r.Name,
+		Type:    r.Type,
+		Source:  r.Source,
+		Outcome: outcome(r.Err),
+		RTT:     r.RTT,
+		Delay:   r.Delay,
+		Attempt: r.Attempt,
+		Primary: r.Primary.address,
+		Started: r.Started,
+		Retried: r.Retried,
+
+		Hedge:      r.Hedge,
+		Superseded: r.Superseded,
+	}
+	if r.Err != nil {
+		wr.Error = r.Err.Error()
+		wr.TimeoutPhase = timeoutPhase(r.Err)
+	}
+	if r.Response != nil {
+		// A response that was received was unpacked, so it can be packed.
+		wr.Response, _ = r.Response.Pack()
+	}
+	return wr
+}
+
+// workerQueryResult returns the queryResult for a result sent by a worker. An
+// error is returned if the result's servers aren't the Experiment's servers, or
+// its resolver set for the primary, if its outcome or timeout phase is
+// unknown, or if its response can't be unpacked.
+func (e Experiment) workerQueryResult(wr workerResult) (queryResult, error) {
+	srv, ok := e.serverByAddress(wr.Server)
+	if !ok {
+		return queryResult{}, fmt.Errorf("server %q is not one of the experiment's servers", wr.Server)
+	}
+	primary, ok := e.serverByAddress(wr.Primary)
+	if e.ResolverSet != "" && wr.Primary == resolverSetAddress {
+		primary, ok = resolverSet(), true
+	}
+	if !ok {
+		return queryResult{}, fmt.Errorf("server %q is not one of the experiment's servers", wr.Primary)
+	}
+	r := queryResult{
+		query: query{
+			Server:  srv,
+			Name:    wr.Name,
+			Type:    wr.Type,
+			Source:  wr.Source,
+			Attempt: wr.Attempt,
+			Primary: primary,
+			Started: wr.Started,
+			Hedge:   wr.Hedge,
+		},
+		Sent:    wr.Sent,
+		Delay:   wr.Delay,
+		RTT:     wr.RTT,
+		Retried: wr.Retried,
+
+		Superseded: wr.Superseded,
+	}
+	// The outcome and timeout phase are metric label values, so they must be
+	// from the fixed sets of them.
+	if !knownOutcome(wr.Outcome) {
+		return queryResult{}, fmt.Errorf("unknown outcome %q for %q", wr.Outcome, wr.Name)
+	}
+	if wr.TimeoutPhase != "" && !knownPhase(wr.TimeoutPhase) {
+		return queryResult{}, fmt.Errorf("unknown timeout phase %q for %q", wr.TimeoutPhase, wr.Name)
+	}
+	if wr.Outcome != outcomeOK {
+		var err error = errors.New(wr.Error)
+		if wr.TimeoutPhase != "" {
+			err = &phaseError{phase: wr.TimeoutPhase, err: err}
+		}
+		r.Err = &queryError{class: wr.Outcome, err: err}
+	}
+	if len(wr.Response) > 0 {
+		r.Response = new(dns.Msg)
+		if err := r.Response.Unpack(wr.Response); err != nil {
+			return queryResult{}, fmt.Errorf("invalid response for %q: %v", wr.Name, err)
+		}
+	}
+	return r, nil
+}
+
+// recordWorkerResult updates the metrics and run summary for a result sent by
+// a worker as if the coordinator had performed the query itself, saves it to
+// the database and publishes it to result event stream subscribers.
+func (e Experiment) recordWorkerResult(r queryResult) {
+	labels := e.queryLabels(r.query)
+	stats.sendDelays.With(prom.Labels{"server": r.Server.address}).Observe(r.Delay.Seconds())
+	stats.attempts.With(labels).Add(1)
+	stats.queryTimes.With(labels).Observe(r.RTT.Seconds())
+	e.summary.queryStarted(r.Server.address)
+	e.summary.queryFinished(r.Server.address, r.RTT, r.Delay, r.Err)
+	// The workers don't have the coordinator's MaxQueries budget, so it is
+	// counted as their results arrive.
+	if e.stopConditions != nil && outcome(r.Err) != outcomeSkipped {
+		if reason := e.stopConditions.counted(); reason != "" {
+			e.stopFor(reason)
+		}
+	}
+	e.recordResult(r, labels)
+}
+
+// A lease is a batch of targets handed out to a worker.
+type lease struct {
+	worker   string
+	targets  []Target
+	deadline time.Time
+}
+
+// check returns an error if the given results, one slice per target, aren't
+// the results of the lease's targets in order.
+func (l *lease) check(results [][]queryResult) error {
+	if len(results) != len(l.targets) {
+		return fmt.Errorf("lease has %d targets, not %d", len(l.targets), len(results))
+	}
+	for i, target := range results {
+		for _, r := range target {
+			if r.Name != l.targets[i].Name {
+				return fmt.Errorf("result for %q is not a result of target %d %q",
+					r.Name, i, l.targets[i].Name)
+			}
+		}
+	}
+	return nil
+}
+
+// coordinator hands out the targets of an Experiment to workers in leased
+// batches over HTTP and records the results the workers send back. The
+// targets of leases that aren't completed before they expire are given to
+// other workers.
+type coordinator struct {
+	exp   Experiment
+	names <-chan Target
+	// wg is the WaitGroup of the caller feeding names. Done is called for each
+	// target once its results are recorded.
+	wg  *sync.WaitGroup
+	srv *http.Server
+
+	sync.Mutex
+	nextID int64
+	leases map[int64]*lease
+	// requeued holds the targets of expired leases to hand out again.
+	requeued []Target
+	// exhausted is true once the names channel is closed.
+	exhausted bool
+	// workers holds when each worker last contacted the coordinator.
+	workers map[string]time.Time
+}
+
+// validCoordinator checks the coordinator settings of the Experiment.
+func (e Experiment) validCoordinator() error {
+	if e.CoordinatorAddr == "" {
+		return errors.New("Experiment must have a non-empty CoordinatorAddr to coordinate workers")
+	}
+	if e.LeaseTimeout <= 0 {
+		return errors.New("Experiment must have a positive LeaseTimeout")
+	}
+	if e.ControlToken == "" {
+		return errors.New("Experiment must have a ControlToken for workers to authenticate with to coordinate workers")
+	}
+	return nil
+}
+
+// handleExperiment serves the workerConfig for the Experiment.
+func (c *coordinator) handleExperiment(w http.ResponseWriter, r *http.Request) {
+	e := c.exp
+	writeJSON(w, workerConfig{
+		ID:        e.id,
+		Servers:   e.Servers,
+		Proto:     e.Proto,
+		Timeout:   e.Timeout,
+		CheckA:    e.CheckA,
+		CheckAAAA: e.CheckAAAA,
+		CheckTXT:  e.CheckTXT,
+		Count:     e.Count,
+
+		Attempts:       e.Attempts,
+		AttemptTimeout: e.AttemptTimeout,
+		RetryBackoff:   e.RetryBackoff,
+		RetryOn:        e.RetryOn,
+		Failover:       e.Failover,
+
+		ResolverSet: e.ResolverSet,
+		HedgeDelay:  e.HedgeDelay,
+
+		HedgePercentile: e.HedgePercentile,
+
+		DialTimeout:         e.DialTimeout,
+		TLSHandshakeTimeout: e.TLSHandshakeTimeout,
+		WriteTimeout:        e.WriteTimeout,
+		ReadTimeout:         e.ReadTimeout,
+
+		BreakerFailures: e.BreakerFailures,
+		BreakerCooldown: e.BreakerCooldown,
+	})
+}
+
+// handleLease grants a lease of at most "size" targets to the worker named by
+// the "worker" form value. If there are no targets to lease right now, or
+// dispatch is paused, the response is 204 No Content and the worker should
+// ask again later. Once every target has been completed, or the Experiment
+// has been stopped, the response is 410 Gone and the worker should exit.
+func (c *coordinator) handleLease(w http.ResponseWriter, r *http.Request) {
+	worker := r.FormValue("worker")
+	size, err := formInt(r, "size")
+	if worker == "" || err != nil || size < 1 {
+		http.Error(w, "worker and a positive size are required", http.StatusBadRequest)
+		return
+	}
+	if size > maxLeaseSize {
+		size = maxLeaseSize
+	}
+
+	c.Lock()
+	c.workers[worker] = time.Now()
+	c.Unlock()
+
+	if c.exp.isStopped() {
+		c.Lock()
+		c.drop(c.requeued)
+		c.requeued = nil
+		c.Unlock()
+		http.Error(w, "experiment stopped", http.StatusGone)
+		return
+	}
+	if c.exp.control.paused() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(leasePoll.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	targets := c.take(size)
+	if len(targets) == 0 {
+		if c.finished() {
+			http.Error(w, "experiment finished", http.StatusGone)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(leasePoll.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	c.Lock()
+	c.nextID++
+	l := &lease{
+		worker:   worker,
+		targets:  targets,
+		deadline: time.Now().Add(c.exp.LeaseTimeout),
+	}
+	c.leases[c.nextID] = l
+	resp := leaseResponse{
+		ID:       c.nextID,
+		Targets:  targets,
+		Deadline: l.deadline,
+		Timeout:  c.exp.LeaseTimeout,
+	}
+	c.Unlock()
+	stats.leases.With(prom.Labels{"event": "granted"}).Inc()
+	stats.leasedNames.Add(float64(len(targets)))
+	writeJSON(w, resp)
+}
+
+// take returns up to size targets to lease, first from expired leases and
+// then from the names channel. It waits at most leaseWait for targets from
+// the names channel.
+func (c *coordinator) take(size int) []Target {
+	c.Lock()
+	n := size
+	if n > len(c.requeued) {
+		n = len(c.requeued)
+	}
+	targets := append([]Target(nil), c.requeued[:n]...)
+	c.requeued = c.requeued[n:]
+	exhausted := c.exhausted
+	c.Unlock()
+	if exhausted {
+		return targets
+	}
+
+	timer := time.NewTimer(leaseWait)
+	defer timer.Stop()
+	for len(targets) < size {
+		select {
+		case target, ok := <-c.names:
+			if !ok {
+				c.Lock()
+				c.exhausted = true
+				c.Unlock()
+				return targets
+			}
+			targets = append(targets, target)
+		case <-timer.C:
+			return targets
+		}
+	}
+	return targets
+}
+
+// finished returns true if every target has been read and completed.
+func (c *coordinator) finished() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.exhausted && len(c.leases) == 0 && len(c.requeued) == 0
+}
+
+// drop gives up on the given targets, which will not be looked up. The
+// coordinator must be locked.
+func (c *coordinator) drop(targets []Target) {
+	for range targets {
+		c.wg.Done()
+	}
+}
+
+// handleLeasePath handles the requests for a lease: "/leases/<id>" completes
+// the lease and "/leases/<id>/extend" extends it.
+func (c *coordinator) handleLeasePath(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/leases/")
+	extend := strings.HasSuffix(path, "/extend")
+	id, err := strconv.ParseInt(strings.TrimSuffix(path, "/extend"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid lease ID", http.StatusNotFound)
+		return
+	}
+	if extend {
+		c.handleExtend(w, r, id)
+	} else {
+		c.handleComplete(w, r, id)
+	}
+}
+
+// handleExtend extends the lease with the given ID held by the worker named by
+// the "worker" form value, so that it expires the LeaseTimeout from now.
+// Workers extend their leases while they work through them, so that only the
+// leases of workers that died expire. The response is 409 Conflict if the
+// worker doesn't hold the lease.
+func (c *coordinator) handleExtend(w http.ResponseWriter, r *http.Request, id int64) {
+	worker := r.FormValue("worker")
+	c.Lock()
+	l, ok := c.leases[id]
+	held := ok && l.worker == worker
+	var resp leaseResponse
+	if held {
+		now := time.Now()
+		l.deadline = now.Add(c.exp.LeaseTimeout)
+		c.workers[worker] = now
+		resp = leaseResponse{ID: id, Deadline: l.deadline, Timeout: c.exp.LeaseTimeout}
+	}
+	c.Unlock()
+	if !held {
+		http.Error(w, fmt.Sprintf("lease %d is not held by %q", id, worker), http.StatusConflict)
+		return
+	}
+	stats.leases.With(prom.Labels{"event": "extended"}).Inc()
+	writeJSON(w, resp)
+}
+
+// handleComplete records the results of the lease with the given ID. The
+// response is 409 Conflict if the lease isn't held: it has already been
+// completed, or it expired and its targets were given to another worker. The
+// results are discarded in that case so that every target's results are
+// recorded once. The response is 400 Bad Request if the results aren't the
+// results of the lease's targets.
+func (c *coordinator) handleComplete(w http.ResponseWriter, r *http.Request, id int64) {
+	var body leaseResults
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLeaseResultsBody)).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	results := make([][]queryResult, len(body.Targets))
+	for i, target := range body.Targets {
+		for _, wr := range target {
+			qr, err := c.exp.workerQueryResult(wr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			results[i] = append(results[i], qr)
+		}
+	}
+
+	c.Lock()
+	l, ok := c.leases[id]
+	var err error
+	if ok {
+		if err = l.check(results); err == nil {
+			delete(c.leases, id)
+			c.workers[l.worker] = time.Now()
+		}
+	}
+	c.Unlock()
+	if !ok {
+		stats.leases.With(prom.Labels{"event": "rejected"}).Inc()
+		http.Error(w, fmt.Sprintf("lease %d is not held", id), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid results for lease %d: %v", id, err), http.StatusBadRequest)
+		return
+	}
+
+	for _, target := range results {
+		for _, qr := range target {
+			c.exp.recordWorkerResult(qr)
+		}
+		if c.exp.output != nil && len(target) > 0 {
+			if err := c.exp.output.write(target); err != nil {
+				log.Fatalf("Failed to write results for %q: %v\n", target[0].Name, err)
+			}
+		}
+		c.exp.summary.nameFinished()
+		c.wg.Done()
+	}
+	stats.leases.With(prom.Labels{"event": "completed"}).Inc()
+	stats.leasedNames.Sub(float64(len(l.targets)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reap reassigns the targets of expired leases and updates the worker count
+// every leaseReap until the Experiment is closed.
+func (c *coordinator) reap() {
+	ticker := time.NewTicker(leaseReap)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.exp.done:
+			return
+		case now := <-ticker.C:
+			c.expire(now)
+		}
+	}
+}
+
+// expire reassigns the targets of leases that expired before now, or drops
+// them if the Experiment has been stopped, and forgets workers that haven't
+// been seen for the LeaseTimeout.
+func (c *coordinator) expire(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	stopped := c.exp.isStopped()
+	for id, l := range c.leases {
+		if now.Before(l.deadline) {
+			continue
+		}
+		delete(c.leases, id)
+		log.Printf("Lease %d of worker %q expired, reassigning its %d names\n",
+			id, l.worker, len(l.targets))
+		stats.leases.With(prom.Labels{"event": "expired"}).Inc()
+		stats.leasedNames.Sub(float64(len(l.targets)))
+		if stopped {
+			c.drop(l.targets)
+		} else {
+			c.requeued = append(c.requeued, l.targets...)
+		}
+	}
+	if stopped {
+		c.drop(c.requeued)
+		c.requeued = nil
+	}
+	for worker, seen := range c.workers {
+		if now.Sub(seen) > c.exp.LeaseTimeout {
+			delete(c.workers, worker)
+		}
+	}
+	stats.workers.Set(float64(len(c.workers)))
+}
+
+// close shuts down the coordinator's HTTP server. If any workers are active
+// it first waits long enough for polling workers to be told that the
+// Experiment is finished.
+func (c *coordinator) close() {
+	c.Lock()
+	active := len(c.workers) > 0
+	c.Unlock()
+	if active {
+		time.Sleep(2*leasePoll + leaseWait)
+	}
+	if err := c.srv.Shutdown(context.Background()); err != nil {
+		log.Printf("Error shutting down coordinator: %v\n", err)
+	}
+}
+
+// newCoordinator returns a coordinator handing out the given prepared
+// Experiment's targets read from names.
+func newCoordinator(e Experiment, names <-chan Target, wg *sync.WaitGroup) *coordinator {
+	return &coordinator{
+		exp:     e,
+		names:   names,
+		wg:      wg,
+		leases:  make(map[int64]*lease),
+		workers: make(map[string]time.Time),
+	}
+}
+
+// handler returns the handler of the coordinator's HTTP API. Every request
+// must have the Experiment's ControlToken as its bearer token.
+func (c *coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/experiment", c.exp.authorized(c.handleExperiment))
+	mux.HandleFunc("/leases", postOnly(c.exp.authorized(c.handleLease)))
+	mux.HandleFunc("/leases/", postOnly(c.exp.authorized(c.handleLeasePath)))
+	return mux
+}
+
+// Coordinate runs the given Experiment as the coordinator of a distributed
+// run. Like Start it initializes the Experiment and runs a metrics server with
+// the status and control API, but instead of performing queries itself it
+// hands out the targets read from the provided names channel in leased
+// batches to workers (see Work) over HTTP on the Experiment's
+// CoordinatorAddr, and records the results they send back. Workers
+// authenticate with the Experiment's ControlToken. A lease expires if it
+// isn't completed or extended within the LeaseTimeout, and its targets are
+// then given to another worker. When the results of a target have been recorded the
+// provided WaitGroup's Done function is called. Pausing the Experiment pauses
+// the granting of leases and stopping it tells workers to exit once their
+// current leases are complete. The Experiment's ramp schedule, rate limits and
+// capacity search are not used by the coordinator.
+func Coordinate(e *Experiment, names <-chan Target, wg *sync.WaitGroup, dsn string, maxConns int) error {
+	if err := e.validCoordinator(); err != nil {
+		return err
+	}
+	if e.CapacitySearch {
+		return errors.New("Experiment can't use CapacitySearch to coordinate workers")
+	}
+	if _, err := e.setup(dsn, maxConns); err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", e.CoordinatorAddr)
+	if err != nil {
+		return err
+	}
+
+	c := newCoordinator(*e, names, wg)
+	c.srv = &http.Server{Handler: c.handler()}
+	e.coordinator = c
+	c.exp = *e
+
+	go func() {
+		if err := c.srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatalf("coordinator server failed: %v", err)
+		}
+	}()
+	go c.reap()
+	e.startMetrics()
+	log.Printf("Coordinating workers on %s\n", e.CoordinatorAddr)
+	return nil
+}
@@ -0,0 +1,413 @@
+package dnslol
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testToken  = "s3cret"
+	testServer = "192.0.2.1:53"
+)
+
+// testCoordinator returns a coordinator handing out the given names, which
+// are added to the returned WaitGroup, and a client for a test server serving
+// its API. Leases expire after leaseTimeout.
+func testCoordinator(
+	t *testing.T, leaseTimeout time.Duration, names ...string) (*coordinator, *coordinatorClient, *sync.WaitGroup) {
+	t.Helper()
+	e := Experiment{
+		Servers:         []string{testServer},
+		Proto:           "udp",
+		Timeout:         time.Second,
+		CheckA:          true,
+		ControlToken:    testToken,
+		CoordinatorAddr: "127.0.0.1:0",
+		LeaseTimeout:    leaseTimeout,
+		servers:         []server{{address: testServer}},
+	}
+	if _, err := e.prepare(0); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan Target, len(names))
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		ch <- Target{Name: name}
+	}
+	close(ch)
+	c := newCoordinator(e, ch, &wg)
+	srv := httptest.NewServer(c.handler())
+	t.Cleanup(srv.Close)
+	cc := &coordinatorClient{url: srv.URL, worker: "w1", token: testToken, http: srv.Client()}
+	return c, cc, &wg
+}
+
+// testResults returns the encoded leaseResults of a lease with a successful A
+// query result for each of the given names.
+func testResults(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var results leaseResults
+	for _, name := range names {
+		results.Targets = append(results.Targets, []workerResult{testResult(name)})
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// testResult returns a successful A query result for name sent by a worker.
+func testResult(name string) workerResult {
+	return workerResult{
+		Sent:    time.Now(),
+		Server:  testServer,
+		Primary: testServer,
+		Name:    name,
+		Type:    dns.TypeA,
+		Outcome: outcomeOK,
+		Attempt: 1,
+		Started: time.Now(),
+	}
+}
+
+// otherClient returns a client for the same coordinator as cc with the given
+// worker name and token.
+func otherClient(cc *coordinatorClient, worker, token string) *coordinatorClient {
+	return &coordinatorClient{url: cc.url, worker: worker, token: token, http: cc.http}
+}
+
+// leaseNames returns the names of a lease's targets.
+func leaseNames(l *leaseResponse) string {
+	var names []string
+	for _, target := range l.Targets {
+		names = append(names, target.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// held returns true if the coordinator holds the lease with the given ID.
+func (c *coordinator) held(id int64) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.leases[id]
+	return ok
+}
+
+func TestCoordinatorLeases(t *testing.T) {
+	c, cc, wg := testCoordinator(t, time.Minute, "a.example", "b.example", "c.example")
+
+	first, err := cc.lease(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaseNames(first); got != "a.example,b.example" {
+		t.Errorf("expected first lease of a.example,b.example, got %s", got)
+	}
+	if first.Timeout != time.Minute {
+		t.Errorf("expected lease timeout %s, got %s", time.Minute, first.Timeout)
+	}
+	second, err := cc.lease(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaseNames(second); got != "c.example" {
+		t.Errorf("expected second lease of c.example, got %s", got)
+	}
+
+	// The input is exhausted but the leases aren't complete, so there may
+	// be names to lease again.
+	if l, err := cc.lease(1); l != nil || err != nil {
+		t.Errorf("expected no lease and no error, got %v, %v", l, err)
+	}
+
+	if err := cc.post(first.ID, testResults(t, "a.example", "b.example")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.post(second.ID, testResults(t, "c.example")); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if _, err := cc.lease(1); err != errLeasesDone {
+		t.Errorf("expected %v once every lease is complete, got %v", errLeasesDone, err)
+	}
+	if n := c.exp.summary.names; n != 3 {
+		t.Errorf("expected 3 names finished, got %d", n)
+	}
+}
+
+func TestCoordinatorExpire(t *testing.T) {
+	c, cc, wg := testCoordinator(t, time.Minute, "a.example", "b.example")
+
+	dead, err := cc.lease(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lease is held until its deadline.
+	c.expire(dead.Deadline.Add(-time.Second))
+	if !c.held(dead.ID) {
+		t.Fatalf("expected lease %d to be held before its deadline", dead.ID)
+	}
+	c.expire(dead.Deadline)
+	if c.held(dead.ID) {
+		t.Fatalf("expected lease %d to expire at its deadline", dead.ID)
+	}
+
+	// The targets of the expired lease are given to another worker.
+	other := otherClient(cc, "w2", testToken)
+	requeued, err := other.lease(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaseNames(requeued); got != "a.example,b.example" {
+		t.Errorf("expected requeued lease of a.example,b.example, got %s", got)
+	}
+
+	// The first worker's late results are discarded.
+	if err := cc.post(dead.ID, testResults(t, "a.example", "b.example")); err != errLeaseExpired {
+		t.Errorf("expected %v for late results, got %v", errLeaseExpired, err)
+	}
+	if err := cc.extend(dead.ID); err != errLeaseExpired {
+		t.Errorf("expected %v extending an expired lease, got %v", errLeaseExpired, err)
+	}
+	if err := other.post(requeued.ID, testResults(t, "a.example", "b.example")); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if n := c.exp.summary.names; n != 2 {
+		t.Errorf("expected 2 names finished, got %d", n)
+	}
+}
+
+func TestCoordinatorExtend(t *testing.T) {
+	c, cc, _ := testCoordinator(t, time.Minute, "a.example")
+
+	l, err := cc.lease(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := cc.extend(l.ID); err != nil {
+		t.Fatal(err)
+	}
+	// The lease is held past its original deadline.
+	c.expire(l.Deadline)
+	if !c.held(l.ID) {
+		t.Errorf("expected extended lease %d to be held past its original deadline", l.ID)
+	}
+
+	other := otherClient(cc, "w2", testToken)
+	if err := other.extend(l.ID); err != errLeaseExpired {
+		t.Errorf("expected %v extending another worker's lease, got %v", errLeaseExpired, err)
+	}
+	if err := cc.extend(l.ID + 1); err != errLeaseExpired {
+		t.Errorf("expected %v extending an unknown lease, got %v", errLeaseExpired, err)
+	}
+}
+
+func TestCoordinatorStopped(t *testing.T) {
+	c, cc, wg := testCoordinator(t, time.Minute, "a.example", "b.example", "c.example")
+
+	l, err := cc.lease(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.exp.Stop()
+	if _, err := cc.lease(1); err != errLeasesDone {
+		t.Errorf("expected %v once stopped, got %v", errLeasesDone, err)
+	}
+	// The lease granted before the stop can still be completed.
+	if err := cc.post(l.ID, testResults(t, "a.example")); err != nil {
+		t.Fatal(err)
+	}
+	// The names left in the input are never leased. The caller feeding
+	// names stops sending them once the Experiment is stopped.
+	for range c.names {
+		wg.Done()
+	}
+	wg.Wait()
+}
+
+func TestCoordinatorInvalidResults(t *testing.T) {
+	resultsBody := func(targets ...[]workerResult) leaseResults {
+		return leaseResults{Targets: targets}
+	}
+	withOutcome := func(outcome, phase string) workerResult {
+		r := testResult("a.example")
+		r.Outcome, r.Error, r.TimeoutPhase = outcome, "failed", phase
+		return r
+	}
+	testCases := []struct {
+		name     string
+		results  leaseResults
+		expected string
+	}{
+		{
+			name:     "too few targets",
+			results:  resultsBody([]workerResult{testResult("a.example")}),
+			expected: "lease has 2 targets, not 1",
+		},
+		{
+			name: "too many targets",
+			results: resultsBody(
+				[]workerResult{testResult("a.example")},
+				[]workerResult{testResult("b.example")},
+				[]workerResult{testResult("c.example")}),
+			expected: "lease has 2 targets, not 3",
+		},
+		{
+			name: "other name",
+			results: resultsBody(
+				[]workerResult{testResult("a.example")},
+				[]workerResult{testResult("evil.example")}),
+			expected: `result for "evil.example" is not a result of target 1 "b.example"`,
+		},
+		{
+			name: "targets out of order",
+			results: resultsBody(
+				[]workerResult{testResult("b.example")},
+				[]workerResult{testResult("a.example")}),
+			expected: `result for "b.example" is not a result of target 0 "a.example"`,
+		},
+		{
+			name: "unknown outcome",
+			results: resultsBody(
+				[]workerResult{withOutcome("made_up", "")},
+				[]workerResult{testResult("b.example")}),
+			expected: `unknown outcome "made_up"`,
+		},
+		{
+			name: "unknown timeout phase",
+			results: resultsBody(
+				[]workerResult{withOutcome(outcomeTimeout, "lunch")},
+				[]workerResult{testResult("b.example")}),
+			expected: `unknown timeout phase "lunch"`,
+		},
+		{
+			name: "unknown server",
+			results: resultsBody(func() []workerResult {
+				r := testResult("a.example")
+				r.Server = "198.51.100.1:53"
+				return []workerResult{r}
+			}(), []workerResult{testResult("b.example")}),
+			expected: `server "198.51.100.1:53" is not one of the experiment's servers`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, cc, _ := testCoordinator(t, time.Minute, "a.example", "b.example")
+			l, err := cc.lease(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := json.Marshal(tc.results)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cc.post(l.ID, body)
+			if err == nil || !strings.Contains(err.Error(), "400 Bad Request") ||
+				!strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("expected 400 Bad Request error containing %q, got %v", tc.expected, err)
+			}
+			// The invalid results are discarded and the lease is still held.
+			if !c.held(l.ID) {
+				t.Errorf("expected lease %d to still be held", l.ID)
+			}
+			if err := cc.post(l.ID, testResults(t, "a.example", "b.example")); err != nil {
+				t.Errorf("expected valid results to be accepted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCoordinatorAuthorization(t *testing.T) {
+	testCases := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{name: "experiment", method: http.MethodGet, path: "/experiment"},
+		{name: "lease", method: http.MethodPost, path: "/leases?worker=w1&size=1"},
+		{name: "complete", method: http.MethodPost, path: "/leases/1"},
+		{name: "extend", method: http.MethodPost, path: "/leases/1/extend?worker=w1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, cc, _ := testCoordinator(t, time.Minute, "a.example")
+			for _, token := range []string{"", "guess"} {
+				resp, err := otherClient(cc, "w1", token).do(tc.method, tc.path, "", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusUnauthorized {
+					t.Errorf("expected status %d with token %q, got %d",
+						http.StatusUnauthorized, token, resp.StatusCode)
+				}
+			}
+			if len(c.leases) != 0 {
+				t.Errorf("expected no leases to be granted, got %d", len(c.leases))
+			}
+		})
+	}
+
+	_, cc, _ := testCoordinator(t, time.Minute, "a.example")
+	cfg, err := cc.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Servers) != 1 || cfg.Servers[0] != testServer || !cfg.CheckA {
+		t.Errorf("expected the coordinator's query settings, got %+v", cfg)
+	}
+}
+
+func TestValidCoordinator(t *testing.T) {
+	testCases := []struct {
+		name     string
+		exp      Experiment
+		expected string
+	}{
+		{
+			name: "valid",
+			exp: Experiment{
+				CoordinatorAddr: ":6565", LeaseTimeout: time.Minute, ControlToken: testToken,
+			},
+		},
+		{
+			name:     "no address",
+			exp:      Experiment{LeaseTimeout: time.Minute, ControlToken: testToken},
+			expected: "Experiment must have a non-empty CoordinatorAddr to coordinate workers",
+		},
+		{
+			name:     "no lease timeout",
+			exp:      Experiment{CoordinatorAddr: ":6565", ControlToken: testToken},
+			expected: "Experiment must have a positive LeaseTimeout",
+		},
+		{
+			name:     "no token",
+			exp:      Experiment{CoordinatorAddr: ":6565", LeaseTimeout: time.Minute},
+			expected: "Experiment must have a ControlToken for workers to authenticate with to coordinate workers",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.exp.validCoordinator()
+			if tc.expected == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if tc.expected != "" && (err == nil || err.Error() != tc.expected) {
+				t.Errorf("expected error %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -4,13 +4,13 @@ package dnslol
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
-	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -22,48 +22,295 @@ const (
 	maxInsertRetries = 3
 )
 
+// A Target is a name to look up read from the Experiment's input.
+type Target struct {
+	// The name to look up. It is looked up as it is, so it should already be
+	// normalized, e.g. with dnsname.Normalize.
+	Name string `json:"name"`
+	// The query types to perform for the name. If empty the types selected by
+	// the Experiment's CheckA, CheckAAAA and CheckTXT settings are used.
+	Types []uint16 `json:"types,omitempty"`
+	// Where the name came from, e.g. the serial of the certificate it was
+	// found in. Optional.
+	Source string `json:"source,omitempty"`
+
+	// batch is the leased batch the target belongs to when the Experiment is
+	// run as a worker, and batchIndex is the target's index in it. batch is
+	// nil otherwise.
+	batch      *workerBatch
+	batchIndex int
+}
+
 type server struct {
 	id      int64
 	address string
+	// limiter paces queries to this server when the Experiment has a ServerQPS
+	// target. Its rate is zero (unlimited) otherwise.
+	limiter *rateLimiter
 }
 
 // Experiment is a struct that holds settings related to the lookups that will
 // be performed when the Experiment is started with the `Start` function.
 type Experiment struct {
-	// The HTTP bind address for the Prometheus metrics server.
+	// The HTTP bind address for the Prometheus metrics server, which also
+	// serves the status and control API.
 	MetricsAddr string
+	// An optional token that requests to the control API endpoints that change
+	// the Experiment (/pause, /resume, /parallelism and /stop) must send as a
+	// bearer token in their Authorization header. It is required to coordinate
+	// workers, which send it with their requests to the coordinator.
+	ControlToken string
 	// The command line that was used to construct the Experiment (e.g. the
 	// arguments passed to the `dnslol` command).
 	CommandLine string
 	// One or more DNS server addresses with port numbers
 	Servers []string
-	// The protocol used to talk to selected DNS Servers ("tcp" or "udp").
+	// The protocol used to talk to selected DNS Servers ("tcp", "udp" or
+	// "tcp-tls" for DNS over TLS).
 	Proto string
 	// A Duration after which DNS queries are considered to have timed out.
+	// When queries are retried it is the overall time a client waits for an
+	// answer across all of the attempts. It must be greater than zero.
 	Timeout time.Duration
-	// The number of queries to perform in parallel.
+	// The timeouts of the phases of each attempt of a query: connecting to the
+	// server, which includes resolving nothing for UDP but the TCP handshake
+	// for TCP and DNS over TLS, the TLS handshake of DNS over TLS, sending the
+	// query and waiting for the response. Zero limits a phase only by the
+	// timeout of the attempt, which every phase is also limited by. The phase
+	// that timed out is recorded in the results.
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	WriteTimeout        time.Duration
+	ReadTimeout         time.Duration
+	// The most times a query is sent. Like a real DNS client, queries whose
+	// outcome is one of the RetryOn classes are sent again until they succeed,
+	// the Attempts are used up or the Timeout passes. Every attempt is
+	// recorded, and the outcome of the last is the effective outcome a client
+	// would see. Zero or one means queries are never retried.
+	Attempts int
+	// The timeout of each attempt of a query. Zero uses Timeout.
+	AttemptTimeout time.Duration
+	// How long to wait before the second attempt of a query. It is doubled for
+	// each later attempt.
+	RetryBackoff time.Duration
+	// The outcome classes that are retried, e.g. "timeout" or "SERVFAIL", or
+	// RetryNetwork for any network error. DefaultRetryOn is used if empty.
+	RetryOn []string
+	// Whether retries are sent to the next of the Servers instead of the
+	// server that failed.
+	Failover bool
+	// How the Servers are used as a single resolver set, simulating a client
+	// configured with several resolvers: one of the Set constants, or empty to
+	// send every query to every server. With a ResolverSet each query is sent
+	// to the servers of the set in the order chosen by the strategy, failing
+	// over to the next server on each retry, and has one effective result for
+	// the whole set.
+	ResolverSet string
+	// How long a hedged query waits for an answer from the first server before
+	// it is also sent to the second.
+	HedgeDelay time.Duration
+	// If greater than 0 a hedged query instead waits for this quantile, e.g.
+	// 0.95, of the latency observed so far from the first server, once enough
+	// of the server's queries have completed to estimate it.
+	HedgePercentile float64
+	// The number of consecutive failed queries to a server (timeouts, network
+	// errors and SERVFAILs) after which its circuit breaker opens. While a
+	// breaker is open the server's queries are skipped instead of sent and
+	// recorded with the "skipped" outcome. Zero disables the circuit breakers.
+	BreakerFailures int
+	// How long an open circuit breaker skips queries before it lets a probe
+	// query through, closing if the probe succeeds.
+	BreakerCooldown time.Duration
+	// Whether to check that every server answers before any queries are sent.
+	HealthCheck bool
+	// The conditions that stop the Experiment early, like the Stop method: the
+	// longest it runs and the most queries it sends, including retries and
+	// hedges. Names already being looked up are completed, but once
+	// MaxQueries have been sent their remaining queries are skipped. Zero
+	// disables either limit.
+	MaxDuration time.Duration
+	MaxQueries  int64
+	// If greater than 0 the Experiment is stopped when the fraction of a
+	// server's queries over the last AbortWindow that failed (timeouts,
+	// network errors and SERVFAILs) is above AbortErrorRate, once the window
+	// holds at least AbortMinQueries queries. This protects a production
+	// server from a load test that overwhelms it.
+	AbortErrorRate  float64
+	AbortWindow     time.Duration
+	AbortMinQueries int
+	// The number of names to perform queries for in parallel.
 	Parallel int
-	// The rate at which to spawn new query goroutines.
-	SpawnRate int
-	// A Duration to sleep between starting SpawnRate new queries.
-	SpawnInterval time.Duration
+	// The most queries in flight at once across all servers. Zero means the
+	// number of queries for Parallel names: Parallel times the number of
+	// servers, query types and Count. The workers can only be raised above
+	// Parallel through the control API if it is set.
+	MaxInflight int
+	// The most queries in flight at once to each server. Zero means an equal
+	// share of MaxInflight. Keeping it below MaxInflight stops a slow server
+	// from holding up queries to the other servers.
+	ServerMaxInflight int
+	// The number of long-lived connections kept open to each server and
+	// shared by all of the queries to it. Responses are matched to queries by
+	// their ID, so TCP and DNS over TLS queries are pipelined. Zero dials a new
+	// connection for every query.
+	PoolConns int
+	// An optional target number of queries per second to send across all
+	// servers. When set queries are sent at this rate regardless of how quickly
+	// the servers answer, as long as Parallel is large enough to hold all of the
+	// queries in flight.
+	QPS float64
+	// An optional target number of queries per second to send to each server.
+	ServerQPS float64
+	// How load is increased at the start of the experiment ("none", "linear" or
+	// "step"). With a QPS or ServerQPS target the rates are ramped, otherwise
+	// the number of Parallel workers is.
+	RampMode string
+	// How long it takes for the ramp to reach full load.
+	RampDuration time.Duration
+	// The number of equal steps used by the "step" RampMode.
+	RampSteps int
+	// Whether to search for the highest QPS each server can sustain without
+	// breaking the SLO (SLOErrorRate and SLOLatency). The search starts at the
+	// ServerQPS rate.
+	CapacitySearch bool
+	// The highest fraction of failed queries allowed by the SLO. Zero disables
+	// the error rate objective.
+	SLOErrorRate float64
+	// The highest p99 query latency allowed by the SLO. Zero disables the
+	// latency objective.
+	SLOLatency time.Duration
+	// How long each rate is held during a capacity search before it is
+	// evaluated against the SLO.
+	SearchInterval time.Duration
+	// The factor by which the rate is increased during a capacity search until
+	// the SLO breaks.
+	SearchStep float64
 	// Whether or not to do queries for A records.
 	CheckA bool
 	// Whether or not to do queries for AAA records.
 	CheckAAAA bool
 	// Whether or not to do queries for `_acme-challenge.` TXT records.
 	CheckTXT bool
-	// Whether or not to print lookup results to stdout.
+	// The upper bounds of the buckets used for the queryTime and sendDelay
+	// latency histograms. DefaultLatencyBuckets is used if empty.
+	LatencyBuckets []time.Duration
+	// If greater than 1 the queryTime and sendDelay histograms are also
+	// exposed as Prometheus native histograms, whose buckets grow by at most
+	// this factor (e.g. 1.1 for buckets within 10% of each other). Zero
+	// exposes only the LatencyBuckets.
+	NativeHistogramFactor float64
+	// The number of the most common TLDs that get their own value for the tld
+	// metric label. Names in other TLDs are labelled "other". Zero labels every
+	// name as "other", except for names in the in-addr.arpa and ip6.arpa
+	// reverse zones, which are always labelled with their zone.
+	TLDLabels int
+	// The TLDs that get their own value for the tld metric label, e.g. the
+	// TLDs of the names being looked up. If empty the TLDLabels most common
+	// TLDs are used.
+	TLDs []string
+	// How often to log a progress line. Zero disables progress lines.
+	ProgressInterval time.Duration
+	// The number of names the Experiment is expected to process, used to
+	// report the completion percentage and time remaining in progress lines.
+	// Zero if unknown.
+	ExpectedNames int64
+	// The HTTP bind address for the lookup service when the Experiment is run
+	// with Serve.
+	ServeAddr string
+	// The maximum number of lookup service requests served at once.
+	ServeMaxRequests int
+	// The maximum number of names from one lookup service request that are
+	// looked up at once.
+	ServeConcurrency int
+	// The maximum number of names in one lookup service request.
+	ServeMaxNames int
+	// Whether Unicode names in lookup service requests are converted to ASCII
+	// using IDNA2008/UTS #46. Otherwise they are rejected.
+	IDNA bool
+	// The HTTP bind address on which workers lease targets when the Experiment
+	// is run with Coordinate.
+	CoordinatorAddr string
+	// How long a worker has to complete a leased batch of targets before the
+	// targets are given to another worker.
+	LeaseTimeout time.Duration
+	// The URL of the coordinator when the Experiment is run as a worker with
+	// Work, e.g. "http://10.0.0.1:6565".
+	Coordinator string
+	// The number of targets a worker leases at once.
+	BatchSize int
+	// Whether or not to print lookup results to stdout (or OutputFile).
 	PrintResults bool
+	// The format printed results are written in ("text", "logfmt" or "json").
+	OutputFormat string
+	// Which printed results are written ("all", "failures" or
+	// "disagreements").
+	OutputFilter string
+	// An optional file to write printed results to instead of stdout.
+	OutputFile string
+	// The size in bytes after which OutputFile is rotated. Zero disables
+	// rotation.
+	OutputMaxSize int64
+	// The number of rotated OutputFiles to keep.
+	OutputMaxFiles int
 	// How many times to repeat the same query against each server
 	Count int
+	// The name of the parent experiment shared by the shards of a sharded run.
+	// Each shard is recorded as a child of the parent experiment, which is
+	// created by the first shard to start, and the parent's summary aggregates
+	// the summaries of the finished shards.
+	Parent string
+	// The shard of the input the Experiment looks up (0 based) and the number
+	// of shards when the input is sharded across several processes. Zero
+	// Shards means the input isn't sharded.
+	Shard, Shards int
 
 	// A DB connection for storing results.
 	db *sql.DB
 	// The ID assigned by the DB for the Experiment row.
 	id int64
+	// The ID of the parent experiment row of a sharded Experiment, or zero.
+	parentID int64
+	// coordinator hands out the Experiment's targets to workers when the
+	// Experiment is run with Coordinate. It is nil otherwise.
+	coordinator *coordinator
 	// The servers that the Experiment will query.
 	servers []server
+	// limiter paces queries across all servers when the Experiment has a QPS
+	// target. Its rate is zero (unlimited) otherwise.
+	limiter *rateLimiter
+	// scheduler runs queries within the Experiment's in-flight limits.
+	scheduler *scheduler
+	// pools holds the connection pool of each server by address when the
+	// Experiment has PoolConns. It is nil otherwise.
+	pools map[string]*connPool
+	// retryOn is the set of lowercased outcome classes that are retried.
+	retryOn map[string]bool
+	// rotation counts the queries of the SetRoundRobin ResolverSet strategy.
+	rotation *uint64
+	// breakers holds the circuit breaker of each server by address, if
+	// BreakerFailures is set.
+	breakers map[string]*breaker
+	// stopConditions checks the MaxQueries and AbortErrorRate stop conditions
+	// if either is set. It is nil otherwise.
+	stopConditions *stopConditions
+	// search is the capacity search control loop when the Experiment has
+	// CapacitySearch enabled. It is nil otherwise.
+	search *capacitySearch
+	// summary collects the statistics reported in progress lines and at the end
+	// of the Experiment.
+	summary *runSummary
+	// done is closed when the Experiment is closed to stop background
+	// goroutines.
+	done chan struct{}
+	// control holds the state that can be changed while the Experiment runs.
+	control *runControl
+	// events publishes query results to result event stream subscribers.
+	events *eventHub
+	// output writes printed results when the Experiment has PrintResults
+	// enabled. It is nil otherwise.
+	output *resultOutput
+	// tlds is the set of TLDs that get their own tld metric label value.
+	tlds map[string]bool
 }
 
 // Valid checks whether a given Experiment is valid. It returns an error if the
@@ -79,17 +326,39 @@ func (e Experiment) Valid() error {
 	if len(e.Servers) < 1 {
 		return errors.New("Experiment must have at least one Servers address")
 	}
-	if e.Proto != "tcp" && e.Proto != "udp" {
-		return errors.New(`Experiment must have a Proto value of "tcp" or "udp"`)
+	if e.Proto != "tcp" && e.Proto != "udp" && e.Proto != "tcp-tls" {
+		return errors.New(
+			`Experiment must have a Proto value of "tcp", "udp" or "tcp-tls"`)
 	}
-	if e.Timeout.Seconds() < 1 {
-		return errors.New("Experiment must have a Timeout greater than 1 second")
+	if err := e.validTimeouts(); err != nil {
+		return err
 	}
 	if e.Parallel < 1 {
 		return errors.New("Experiment must have a Parallel value greater than 1")
 	}
-	if e.SpawnRate < 1 {
-		return errors.New("Experiment must have a SpawnRate value greater than 1")
+	if err := e.validInflight(); err != nil {
+		return err
+	}
+	if err := e.validPool(); err != nil {
+		return err
+	}
+	if err := e.validRetry(); err != nil {
+		return err
+	}
+	if err := e.validResolverSet(); err != nil {
+		return err
+	}
+	if err := e.validBreaker(); err != nil {
+		return err
+	}
+	if err := e.validStop(); err != nil {
+		return err
+	}
+	if e.QPS < 0 || e.ServerQPS < 0 {
+		return errors.New("Experiment must not have a negative QPS or ServerQPS")
+	}
+	if err := validRamp(e.RampMode, e.RampDuration, e.RampSteps); err != nil {
+		return err
 	}
 	if !e.CheckA && !e.CheckAAAA && !e.CheckTXT {
 		return errors.New(
@@ -99,6 +368,37 @@ func (e Experiment) Valid() error {
 	if e.Count < 1 {
 		return errors.New("Experiment must have a Count greater than 0")
 	}
+	if e.ProgressInterval < 0 {
+		return errors.New("Experiment must not have a negative ProgressInterval")
+	}
+	if e.TLDLabels < 0 {
+		return errors.New("Experiment must not have a negative TLDLabels")
+	}
+	if err := e.validTLDs(); err != nil {
+		return err
+	}
+	if e.CapacitySearch {
+		if err := e.validSearch(); err != nil {
+			return err
+		}
+	}
+	if e.NativeHistogramFactor != 0 && e.NativeHistogramFactor <= 1 {
+		return errors.New("Experiment must have a NativeHistogramFactor of 0 or greater than 1")
+	}
+	if e.PrintResults {
+		if err := e.validOutput(); err != nil {
+			return err
+		}
+	}
+	if err := e.validShard(); err != nil {
+		return err
+	}
+	for i, b := range e.LatencyBuckets {
+		if b <= 0 || (i > 0 && b <= e.LatencyBuckets[i-1]) {
+			return errors.New(
+				"Experiment must have positive, increasing LatencyBuckets")
+		}
+	}
 	return nil
 }
 
@@ -110,110 +410,345 @@ type query struct {
 	Name string
 	// The DNS record type to ask the server for
 	Type uint16
+	// Where the name came from, see Target.
+	Source string
+	// The attempt number of the query, starting at 1.
+	Attempt int
+	// The server the first attempt of the query was sent to. Retries may fail
+	// over to other servers.
+	Primary server
+	// When the first attempt of the query was sent. It is zero until then.
+	Started time.Time
+	// The servers the attempts of a query to a resolver set are sent to, in
+	// order. It is empty without a ResolverSet.
+	Order []server
+	// Whether the query is the hedge of a hedged query.
+	Hedge bool
+
+	// client decides which attempt of the query has the effective outcome.
+	client *clientQuery
 }
 
-// spawn will create worker goroutines up to the Experiment's configured
-// Parallel setting. It creates new goroutines in batches based on the
-// Experiment's SpawnRate. After starting a new batch spawn will sleep for the
-// Experiment's configured SpawnInterval. Worker goroutines will call runQueries
-// for each name. Once the queries for a given name are completed the provided
-// waitgroup's Done function is called. If there is an error running queries
-// (not an error result from a query) log.Fatal is called to terminate the
-// experiment.
-func spawn(exp Experiment, dnsClient *dns.Client, names <-chan string, wg *sync.WaitGroup) {
-	for i := 0; i < exp.Parallel; {
-		for j := 0; j < exp.SpawnRate; i, j = i+1, j+1 {
-			go func() {
-				for name := range names {
-					err := exp.runQueries(dnsClient, name)
-					if err != nil {
-						log.Fatalf("Error running queries for %q: %v\n", name, err)
-					}
-					wg.Done()
-				}
-			}()
+// A queryResult is the result of performing a query.
+type queryResult struct {
+	query
+	// When the query was sent.
+	Sent time.Time
+	// The delay between when the query was scheduled to be sent and when it
+	// was actually sent.
+	Delay time.Duration
+	// The round trip time of the query.
+	RTT time.Duration
+	// The response to the query, if one was received.
+	Response *dns.Msg
+	// The error from the query, or nil if the query was successful. Non-nil
+	// errors are usually a *queryError.
+	Err error
+	// Whether the query was retried, or hedged, after this attempt failed.
+	Retried bool
+	// Whether another attempt of the query had already decided its effective
+	// outcome when this attempt completed, e.g. the slower attempt of a
+	// hedged query.
+	Superseded bool
+}
+
+// effective returns whether the result's outcome is the effective outcome of
+// its query that a client sees: the outcome of the attempt that was neither
+// retried nor superseded.
+func (r queryResult) effective() bool {
+	return !r.Retried && !r.Superseded
+}
+
+// effectiveRTT returns the time from when the first attempt of the query was
+// sent until the result, which is how long a client waited.
+func (r queryResult) effectiveRTT() time.Duration {
+	return r.Sent.Add(r.RTT).Sub(r.Started)
+}
+
+// spawn prepares the Experiment's worker goroutines and starts applying the
+// Experiment's ramp schedule, creating workers up to the Experiment's
+// configured Parallel setting. If the Experiment has a QPS or ServerQPS target
+// all of the workers are started immediately and the rate limits are increased
+// over the RampDuration. Otherwise the number of running workers is increased
+// over the RampDuration. Worker goroutines will call runQueries for each
+// target. Once the queries for a given target are completed the provided
+// waitgroup's Done function is called. If there is an error running queries (not an error
+// result from a query) log.Fatal is called to terminate the experiment.
+func spawn(exp Experiment, dnsClient *dns.Client, names <-chan Target, wg *sync.WaitGroup) {
+	c := exp.control
+	c.startWorker = func() {
+		c.work(names, func(target Target) {
+			err := exp.runQueries(dnsClient, target)
+			if err != nil {
+				log.Fatalf("Error running queries for %q: %v\n", target.Name, err)
+			}
+			wg.Done()
+		})
+	}
+
+	// When searching for capacity the search controls the server rates and
+	// there's no ramp.
+	if exp.search != nil {
+		go exp.search.run()
+	}
+
+	go func() {
+		start := time.Now()
+		for {
+			level := exp.rampLevel(time.Since(start))
+			if !exp.applyRamp(level) || level >= 1 {
+				return
+			}
+			time.Sleep(rampTick)
 		}
-		time.Sleep(exp.SpawnInterval)
+	}()
+}
+
+// applyRamp sets the number of workers or the rate limits for the given
+// fraction of the Experiment's full load. The workers or rates that have been
+// changed through the control API are left alone, the control API takes over
+// from the ramp schedule for them. It returns false once both have been.
+func (e Experiment) applyRamp(level float64) bool {
+	c := e.control
+	c.Lock()
+	manualWorkers, manualRates := c.manualWorkers, c.manualRates
+	c.Unlock()
+	if manualWorkers && manualRates {
+		return false
+	}
+
+	workers := e.Parallel
+	rateLevel := 1.0
+	if (e.QPS > 0 || e.ServerQPS > 0) && e.search == nil {
+		rateLevel = level
+	} else {
+		workers = int(math.Ceil(level * float64(e.Parallel)))
+	}
+	if !manualRates {
+		e.setRateLevel(rateLevel)
+	}
+	if !manualWorkers {
+		c.setWorkers(workers)
 	}
+	return true
 }
 
-// runQueries will build & execute queries for the given name based on the
+// setRateLevel sets the Experiment's rate limiters to the given fraction of
+// their current target QPS. The per-server rates are left alone during a
+// capacity search, which controls them itself.
+func (e Experiment) setRateLevel(level float64) {
+	qps, serverQPS := e.control.rates()
+	e.limiter.SetRate(level * qps)
+	if e.search != nil {
+		return
+	}
+	for _, s := range e.servers {
+		s.limiter.SetRate(level * serverQPS)
+	}
+}
+
+// runQueries will build & execute queries for the given target based on the
 // Experiment's settings. The queries will be made with the provided dnsClient
-// and directed to the Experiment's DNS Servers. Each query performed by
-// runQueries will increment the "attempts" stat for the servers queried.
-// A "result" stat will be incremented based on the result of the query for the
-// servers queried. Successful queries will increment the "successes" stat for
-// the servers queried. If the Experiment has a true value for PrintResults each
-// query result will be printed to standard out.
-func (e Experiment) runQueries(dnsClient *dns.Client, name string) error {
+// and directed to the Experiment's DNS Servers using runQuerySet.
+func (e Experiment) runQueries(dnsClient *dns.Client, target Target) error {
 	if dnsClient == nil {
 		return errors.New("runQueries requires a non-nil dnsClient instance")
 	}
 
-	name = strings.TrimLeft(name, "*.")
+	if len(target.Types) == 0 {
+		target.Types = e.queryTypes()
+	}
+
+	// Collect the results of a worker's targets to send to the coordinator
+	var handle func(queryResult)
+	var finished func()
+	if target.batch != nil {
+		handle, finished = target.batch.collect(target.batchIndex)
+	}
 
 	// Build the queries for this name for each of the nameservers
-	queries := e.buildQueries(name)
+	queries := e.buildQueries(target, e.servers)
+	e.runQuerySet(dnsClient, queries, handle)
+	e.summary.nameFinished()
+	if finished != nil {
+		finished()
+	}
+	return nil
+}
 
+// runQuerySet executes the given queries with the provided dnsClient on the
+// Experiment's scheduler and returns when all of them have completed,
+// including their retries. Each attempt performed by
+// runQuerySet will increment the "attempts" stat for the servers queried.
+// A "result" stat will be incremented based on the outcome class of the query
+// for the servers queried. Successful queries will increment the "successes"
+// stat for the servers queried. Every result is saved to the database and
+// published to result event stream subscribers. If handle is not nil it is
+// called with each result. It may be called concurrently. Once all of the
+// queries have completed the results are printed if the Experiment has a true
+// value for PrintResults. The queries should all be for the same name so that
+// disagreements between servers can be found.
+func (e Experiment) runQuerySet(dnsClient *dns.Client, queries []query, handle func(queryResult)) {
 	// Randomize the queries so we don't consistently query one of the nameservers
 	// first, which could introduce a slight bias.
 	rand.Shuffle(len(queries), func(i, j int) {
 		queries[i], queries[j] = queries[j], queries[i]
 	})
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []queryResult
 	// Run the built queries, populating the prometheus result stat according to
 	// the results
-	for _, q := range queries {
-		wg.Add(1)
-		// Run the queries on a goroutine so slowness in one server doesn't impact
-		// the submission rate to the other server.
-		go func(q query) {
-			stats.attempts.With(prom.Labels{"server": q.Server.address}).Add(1)
-			resultLabels := prom.Labels{"server": q.Server.address}
-			err := e.queryOne(dnsClient, q)
-			// If the result was an error, put the error string in the result label
-			if err != nil {
-				resultLabels["result"] = err.Error()
+	var run func(q query)
+	run = func(q query) {
+		// Queue the queries on their server's pool so slowness in one server
+		// doesn't impact the submission rate to the other server.
+		e.scheduler.submit(q.Server.address, func() {
+			defer wg.Done()
+			e.control.waitIfPaused()
+			labels := e.queryLabels(q)
+			b := e.breakers[q.Server.address]
+			allowed, probe, skipErr := e.admit(q)
+			var r queryResult
+			if !allowed {
+				// The query is skipped without waiting for the rate limits
+				// or an in-flight slot.
+				r = queryResult{query: q, Sent: time.Now()}
+				r.Err = &queryError{class: outcomeSkipped, err: skipErr}
+				if r.Started.IsZero() {
+					r.Started = r.Sent
+				}
+				e.summary.querySkipped(q.Server.address)
 			} else {
-				// If the result was successful, increment the success stat and put
-				// "ok" in the result label
-				stats.successes.With(prom.Labels{"server": q.Server.address}).Add(1)
-				resultLabels["result"] = "ok"
+				scheduled := waitFor(e.limiter, q.Server.limiter)
+				e.scheduler.acquire()
+				r = queryResult{query: q, Sent: time.Now()}
+				if r.Started.IsZero() {
+					r.Started = r.Sent
+				}
+				if timeout := e.attemptTimeout(q.Started); timeout <= 0 {
+					// A retry or hedge that waited for the rate limits or
+					// an in-flight slot until its query's Timeout passed
+					// times out without being sent.
+					e.scheduler.release()
+					r.Err = e.expireAttempt(b, probe)
+				} else {
+					if q.Attempt == 1 && e.hedging() {
+						e.hedgeAfter(r, &wg, run)
+					}
+					r.Delay = r.Sent.Sub(scheduled)
+					stats.sendDelays.With(prom.Labels{"server": q.Server.address}).Observe(r.Delay.Seconds())
+					stats.attempts.With(labels).Add(1)
+					inflight := stats.inflight.With(prom.Labels{"server": q.Server.address})
+					inflight.Inc()
+					e.summary.queryStarted(q.Server.address)
+					r.Response, r.RTT, r.Err = e.queryOne(dnsClient, q, timeout)
+					e.scheduler.release()
+					inflight.Dec()
+					e.summary.queryFinished(q.Server.address, r.RTT, r.Delay, r.Err)
+					if e.search != nil {
+						e.search.observe(q.Server.address, r.RTT, r.Err)
+					}
+					if b != nil {
+						b.record(probe, r.Err)
+					}
+				}
 			}
-			if e.PrintResults {
-				printQueryResult(q, err)
+			next, backoff, retry := e.settle(&r)
+			e.recordResult(r, labels)
+			if handle != nil {
+				handle(r)
 			}
-			stats.results.With(resultLabels).Add(1)
-			e.saveQueryResult(q, err)
-			wg.Done()
-		}(q)
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+			// The retry is queued once its backoff has passed so that it
+			// doesn't hold up one of the server's in-flight slots meanwhile.
+			if retry {
+				next.Started = r.Started
+				wg.Add(1)
+				time.AfterFunc(backoff, func() { run(next) })
+			}
+		})
+	}
+	for _, q := range queries {
+		q.client = &clientQuery{pending: 1}
+		wg.Add(1)
+		run(q)
 	}
 	wg.Wait()
-	return nil
+
+	if e.output != nil {
+		if err := e.output.write(results); err != nil {
+			log.Fatalf("Failed to write results for %q: %v\n", queries[0].Name, err)
+		}
+	}
 }
 
-func printQueryResult(q query, err error) {
-	var line strings.Builder
-	fmt.Fprintf(&line, "Server=%s Name=%s QueryType=%s",
-		q.Server.address, q.Name, dns.TypeToString[q.Type])
-	if err != nil {
-		fmt.Fprintf(&line, " Error=%s Outcome=bad", err.Error())
-	} else {
-		fmt.Fprintf(&line, " Outcome=ok")
+// recordResult updates the result metrics for a completed query, saves it to
+// the database and publishes it to result event stream subscribers. The given
+// labels are the query's queryLabels. For the last attempt of a query the
+// effective result metrics and run summary are updated for the server the
+// query was first sent to.
+func (e Experiment) recordResult(r queryResult, labels prom.Labels) {
+	// If the result was successful, increment the success stat. Either way
+	// put the outcome class in the result label
+	if r.Err == nil {
+		stats.successes.With(labels).Add(1)
+	}
+	labels["result"] = outcome(r.Err)
+	stats.results.With(labels).Add(1)
+	if r.Retried {
+		e.summary.queryRetried(r.Server.address)
+	} else if r.effective() {
+		effective := e.queryLabels(query{Server: r.Primary, Name: r.Name, Type: r.Type})
+		effective["result"] = labels["result"]
+		stats.effective.With(effective).Add(1)
+		e.summary.queryCompleted(r.Primary.address, r.effectiveRTT(), r.Err)
+	}
+	if e.hedging() {
+		e.recordHedge(r)
+	}
+	if e.stopConditions != nil && outcome(r.Err) != outcomeSkipped {
+		if reason := e.stopConditions.observe(r.Server.address, r.Sent.Add(r.RTT), r.Err); reason != "" {
+			e.stopFor(reason)
+		}
+	}
+	// Workers don't have a database, the coordinator saves their results.
+	if e.db != nil {
+		e.saveQueryResult(r)
+	}
+	e.events.publish(r)
+}
+
+// queryLabels returns the Prometheus labels for the per-query metrics of the
+// given query.
+func (e Experiment) queryLabels(q query) prom.Labels {
+	return prom.Labels{
+		"server":    q.Server.address,
+		"type":      dns.TypeToString[q.Type],
+		"transport": e.Proto,
+		"tld":       e.tldLabel(q.Name),
 	}
-	log.Printf("%s", line.String())
 }
 
-func (e Experiment) saveQueryResult(q query, err error) {
+func (e Experiment) saveQueryResult(r queryResult) {
+	q := r.query
 	var errBlob []byte
-	if err != nil {
-		errBlob = []byte(err.Error())
+	if r.Err != nil {
+		errBlob = []byte(r.Err.Error())
+	}
+	class := outcome(r.Err)
+	var phase *string
+	if p := timeoutPhase(r.Err); p != "" {
+		phase = &p
 	}
 
+	var err error
 	for i := 0; i < maxInsertRetries; i++ {
 		_, err = e.db.Exec(
-			"INSERT INTO results (`name`, `type`, `error`, `serverID`, `experimentID`) VALUES (?, ?, ?, ?, ?);",
-			q.Name, q.Type, errBlob, q.Server.id, e.id)
+			"INSERT INTO results (`name`, `type`, `source`, `outcome`, `error`, `serverID`, `experimentID`, `attempt`, `retried`, `hedge`, `superseded`, `timeoutPhase`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);",
+			q.Name, q.Type, q.Source, class, errBlob, q.Server.id, e.id, q.Attempt, r.Retried, q.Hedge, r.Superseded, phase)
 		if err == nil {
 			break
 		}
@@ -225,74 +760,103 @@ func (e Experiment) saveQueryResult(q query, err error) {
 	}
 }
 
-// buildQueries creates queries for the given name, e.Count per server. The types of
-// queries that are built depends on the Experiment's CheckA, CheckAAAA,
-// and CheckTXT settings.
-func (e Experiment) buildQueries(name string) []query {
-	// queryPerServer returns a list with one query per server for the given name
-	// and type.
-	queryPerServer := func(name string, typ uint16) []query {
-		var results []query
-		for _, server := range e.servers {
-			for i := 0; i < e.Count; i++ {
-				results = append(results, query{
-					Name:   name,
-					Type:   typ,
-					Server: server,
-				})
-			}
-		}
-		return results
-	}
-
-	var queries []query
+// queryTypes returns the query types selected by the Experiment's CheckA,
+// CheckAAAA, and CheckTXT settings.
+func (e Experiment) queryTypes() []uint16 {
+	var types []uint16
 	if e.CheckA {
-		queries = append(queries,
-			queryPerServer(name, dns.TypeA)...)
+		types = append(types, dns.TypeA)
 	}
 	if e.CheckAAAA {
-		queries = append(queries,
-			queryPerServer(name, dns.TypeAAAA)...)
+		types = append(types, dns.TypeAAAA)
 	}
 	if e.CheckTXT {
-		queries = append(queries,
-			queryPerServer(name, dns.TypeTXT)...)
+		types = append(types, dns.TypeTXT)
 	}
+	return types
+}
 
+// buildQueries creates queries for the given target, e.Count per server for
+// each of the target's types. With a ResolverSet the servers are a single
+// resolver set and e.Count queries are created for each type, each with the
+// order its attempts are sent to the servers in.
+func (e Experiment) buildQueries(target Target, servers []server) []query {
+	var queries []query
+	if e.ResolverSet != "" {
+		for _, typ := range target.Types {
+			for i := 0; i < e.Count; i++ {
+				order := e.setOrder(servers)
+				queries = append(queries, query{
+					Name:    target.Name,
+					Type:    typ,
+					Source:  target.Source,
+					Server:  order[0],
+					Attempt: 1,
+					Primary: resolverSet(),
+					Order:   order,
+				})
+			}
+		}
+		return queries
+	}
+	for _, typ := range target.Types {
+		for _, server := range servers {
+			for i := 0; i < e.Count; i++ {
+				queries = append(queries, query{
+					Name:    target.Name,
+					Type:    typ,
+					Source:  target.Source,
+					Server:  server,
+					Attempt: 1,
+					Primary: server,
+				})
+			}
+		}
+	}
 	return queries
 }
 
-// queryOne performs one single query using the given dnsClient. For successful
-// queries (e.g. resulting in a RcodeSuccess) nil is returned. Queries that
-// result in an error, or an Rcode other than RcodeSuccess return an error. In
-// all cases the queryTimes latency stat is updated for the server and query
-// type performed.
-func (e Experiment) queryOne(dnsClient *dns.Client, q query) error {
+// queryOne performs one single query using the given dnsClient, or the server's
+// connection pool if the Experiment has PoolConns, waiting up to the given
+// timeout for a response, and returns the response (if any) and the time it
+// took. For successful queries (e.g. resulting in a RcodeSuccess) a nil
+// error is returned. Queries that result in an error, a truncated response, or
+// an Rcode other than RcodeSuccess return a *queryError with the outcome class
+// of the failure. In all cases the queryTimes latency stat is updated for the
+// server and query type performed.
+func (e Experiment) queryOne(dnsClient *dns.Client, q query, timeout time.Duration) (*dns.Msg, time.Duration, error) {
 	// Build a DNS msg based on the query details
-	typStr := dns.TypeToString[q.Type]
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(q.Name), q.Type)
 
 	// Query the server and record the time taken
-	in, rtt, err := dnsClient.Exchange(m, q.Server.address)
-	stats.queryTimes.With(prom.Labels{
-		"server": q.Server.address,
-		"type":   typStr}).Observe(rtt.Seconds())
+	var in *dns.Msg
+	var rtt time.Duration
+	var err error
+	if pool := e.pools[q.Server.address]; pool != nil {
+		in, rtt, err = pool.exchange(m, timeout)
+	} else {
+		in, rtt, err = e.exchange(dnsClient, m, q.Server.address, timeout)
+	}
+	stats.queryTimes.With(e.queryLabels(q)).Observe(rtt.Seconds())
 	if err != nil {
-		if ne, ok := err.(*net.OpError); ok && ne.Timeout() {
-			return fmt.Errorf("timeout")
-		} else if _, ok := err.(*net.OpError); ok {
-			return fmt.Errorf("net err")
+		qe := &queryError{class: classifyError(err), err: err}
+		if phase := timeoutPhase(qe); phase != "" {
+			stats.timeouts.With(prom.Labels{"server": q.Server.address, "phase": phase}).Inc()
+		}
+		return in, rtt, qe
+	} else if in.Truncated {
+		return in, rtt, &queryError{
+			class: outcomeTruncated,
+			err:   errors.New("response has the TC (truncated) bit set"),
 		}
-		return err
 	} else if in.Rcode != dns.RcodeSuccess {
 		// If the rcode wasn't a successful rcode, return an error with the rCode as
-		// the string
-		rcodeStr := dns.RcodeToString[in.Rcode]
-		return errors.New(rcodeStr)
+		// the class
+		return in, rtt, rcodeError(in.Rcode)
 	}
 	// Otherwise everything went well! Return nil
-	return nil
+	return in, rtt, nil
 }
 
 func (e *Experiment) saveExperiment() error {
@@ -300,11 +864,25 @@ func (e *Experiment) saveExperiment() error {
 		return errors.New("saveExperiment requires a non-nil db")
 	}
 
+	// Find or create the parent experiment of a sharded Experiment
+	if e.Parent != "" {
+		if err := e.saveParent(); err != nil {
+			return err
+		}
+	}
+
 	// Create the experiment in the DB
+	var parentID, shard, shards interface{}
+	if e.parentID != 0 {
+		parentID, shard, shards = e.parentID, e.Shard, e.Shards
+	}
 	result, err := e.db.Exec(
-		`INSERT INTO experiments (start, commandline) VALUES (?, ?);`,
+		`INSERT INTO experiments (start, commandline, parentID, shard, shards) VALUES (?, ?, ?, ?, ?);`,
 		time.Now(),
-		e.CommandLine)
+		e.CommandLine,
+		parentID,
+		shard,
+		shards)
 	if err != nil {
 		return err
 	}
@@ -335,8 +913,11 @@ func (e *Experiment) saveExperiment() error {
 	return nil
 }
 
-// Close updates the Experiment's end date and closes the Experiment's database
-// connection or return an error.
+// Close logs the run summary, updates the Experiment's end date and summary
+// and closes the Experiment's database connection or return an error. For a
+// sharded Experiment the parent experiment's summary is updated with the
+// aggregate of the finished shards, which is also logged. A coordinator stops
+// serving workers.
 func (e Experiment) Close() error {
 	if e.db == nil {
 		return errors.New("Close requires a non-nil db")
@@ -345,10 +926,32 @@ func (e Experiment) Close() error {
 		return errors.New("Experiment does not have an ID")
 	}
 
+	if e.coordinator != nil {
+		e.coordinator.close()
+	}
+	summary, err := e.finish()
+	if err != nil {
+		return err
+	}
+	var state []byte
+	if e.summary != nil {
+		if state, err = json.Marshal(e.summary); err != nil {
+			return err
+		}
+	}
+
+	var stopReason interface{}
+	if reason := e.StopReason(); reason != "" {
+		stopReason = reason
+	}
+
 	// Update the experiment in the DB
 	result, err := e.db.Exec(
-		`UPDATE experiments SET end=? WHERE id=?;`,
+		`UPDATE experiments SET end=?, summary=?, summaryState=?, stopReason=? WHERE id=?;`,
 		time.Now(),
+		summary,
+		state,
+		stopReason,
 		e.id)
 	if err != nil {
 		return err
@@ -362,34 +965,59 @@ func (e Experiment) Close() error {
 			"Expected to update one experiment row, actually updated %d", updated)
 	}
 
+	if e.parentID != 0 {
+		if err := e.aggregateShards(); err != nil {
+			return err
+		}
+	}
+
 	return e.db.Close()
 }
 
-// Start will run the given Experiment by initializing and running a metrics
-// server and then spawning goroutines to process queries according to the
-// Experiment parameters. The spawned goroutines will read names to query from
-// the provided names channel. When a query work item for a name is completed
-// the spawned worker goroutines will call the provided WaitGroup's Done
-// function. An error is returned from Start if the given Experiment is not
-// valid.
-func Start(e *Experiment, names <-chan string, wg *sync.WaitGroup, dsn string, maxConns int) error {
-	if err := e.Valid(); err != nil {
-		return err
+// finish stops the Experiment's background goroutines, closes its connection
+// pools and printed results output and logs the run summary and capacity search results. It
+// returns the run summary.
+func (e Experiment) finish() (string, error) {
+	if e.done != nil {
+		close(e.done)
+	}
+	for _, pool := range e.pools {
+		pool.close()
+	}
+	if e.output != nil {
+		if err := e.output.Close(); err != nil {
+			return "", err
+		}
 	}
 
-	// Create & start a metrics server
-	metricsServer := initMetrics(e.MetricsAddr)
-	go func() {
-		err := metricsServer.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			log.Fatalf("metrics server failed: %v", err)
+	var summary string
+	if e.summary != nil {
+		summary = e.summary.String()
+		log.Printf("Run summary:\n%s", summary)
+	}
+	if e.search != nil {
+		log.Printf("Capacity search results:\n%s", e.search.Report())
+	}
+	return summary, nil
+}
+
+// setup validates the Experiment and prepares everything needed to run it:
+// the database connection and experiment record and everything prepare
+// creates. It returns the dns.Client to perform queries with.
+func (e *Experiment) setup(dsn string, maxConns int) (*dns.Client, error) {
+	if err := e.Valid(); err != nil {
+		return nil, err
+	}
+	if e.HealthCheck {
+		if err := e.checkHealth(); err != nil {
+			return nil, err
 		}
-	}()
+	}
 
 	// Connect to the database
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	db.SetMaxOpenConns(maxConns)
 	e.db = db
@@ -400,14 +1028,106 @@ func Start(e *Experiment, names <-chan string, wg *sync.WaitGroup, dsn string, m
 	if err != nil {
 		log.Fatalf("error saving experiment to db: %v\n", err)
 	}
+	return e.prepare(maxConns)
+}
+
+// prepare creates the runtime state of a valid Experiment whose servers have
+// been set: the latency metrics, the rate limiters, query scheduler and
+// connection pools, printed results output, run summary and control state.
+// The given number of database connections is included in the reported file
+// descriptor budget. It returns the dns.Client to perform queries with.
+func (e *Experiment) prepare(dbConns int) (*dns.Client, error) {
+	// Create the latency metrics with the Experiment's buckets
+	buckets := e.LatencyBuckets
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	initLatencyMetrics(buckets, e.NativeHistogramFactor)
+
+	// done is created first since the state created below keeps copies of the
+	// Experiment.
+	e.done = make(chan struct{})
+
+	// Create the rate limiters. They start at a rate of zero (unlimited) and
+	// are set according to the ramp schedule.
+	e.limiter = newRateLimiter(0)
+	for i := range e.servers {
+		e.servers[i].limiter = newRateLimiter(0)
+	}
+	e.scheduler = newScheduler(*e)
+	// Valid has checked the RetryOn classes.
+	e.retryOn, _ = retrySet(e.RetryOn)
+	stats.fdBudget.Set(float64(e.FDBudget(dbConns)))
+	dnsClient := &dns.Client{Net: e.Proto}
+	if e.PoolConns > 0 {
+		e.pools = newConnPools(*e, dnsClient)
+	}
+	if e.BreakerFailures > 0 {
+		e.breakers = newBreakers(*e)
+	}
+
+	if e.PrintResults {
+		var err error
+		e.output, err = newResultOutput(*e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.tlds = tldSet(e.TLDs, e.TLDLabels)
+	e.summary = newRunSummary(e.servers)
+	if e.ResolverSet != "" {
+		e.rotation = new(uint64)
+		e.summary.servers[resolverSetAddress] = newServerSummary()
+	}
+	if e.CapacitySearch {
+		e.search = newCapacitySearch(*e)
+	}
+	if e.hasStopConditions() {
+		e.stopConditions = newStopConditions(*e)
+	}
+
+	e.control = newRunControl(*e)
+	e.events = newEventHub()
+	if e.ProgressInterval > 0 {
+		go e.reportProgress(e.ProgressInterval, e.done)
+	}
+	if e.MaxDuration > 0 {
+		go e.stopAfter(e.MaxDuration, e.done)
+	}
 
-	dnsClient := &dns.Client{
-		Net:         e.Proto,
-		ReadTimeout: e.Timeout,
+	return dnsClient, nil
+}
+
+// startMetrics creates & starts a metrics server with the status and control
+// API. It must be called after the Experiment is fully initialized since the
+// API handlers use a copy of the Experiment.
+func (e Experiment) startMetrics() {
+	metricsServer := initMetrics(e.MetricsAddr, e)
+	go func() {
+		err := metricsServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("metrics server failed: %v", err)
+		}
+	}()
+}
+
+// Start will run the given Experiment by spawning goroutines to process
+// queries according to the Experiment parameters and then initializing and
+// running a metrics server with the status and control API. The spawned
+// goroutines will read targets to query from the provided names channel. When
+// a query work item for a target is completed the spawned worker goroutines
+// will call the provided WaitGroup's Done function. An error is returned from Start
+// if the given Experiment is not valid.
+func Start(e *Experiment, names <-chan Target, wg *sync.WaitGroup, dsn string, maxConns int) error {
+	dnsClient, err := e.setup(dsn, maxConns)
+	if err != nil {
+		return err
 	}
 
 	// Spawn worker goroutines for the experiment
-	go spawn(*e, dnsClient, names, wg)
+	spawn(*e, dnsClient, names, wg)
 
+	e.startMetrics()
 	return nil
 }
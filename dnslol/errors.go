@@ -0,0 +1,158 @@
+package dnslol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+// Outcome classes for query results. Every query result is classified as
+// exactly one of these or as the name of the response's rcode (e.g.
+// "SERVFAIL"), which keeps the "result" metric label to a small, fixed set of
+// values. The full error text is only kept in the database.
+const (
+	// The query received a NOERROR response.
+	outcomeOK = "ok"
+	// The query timed out.
+	outcomeTimeout = "timeout"
+	// The server actively refused the connection, or for UDP an ICMP port
+	// unreachable message was received.
+	outcomeConnRefused = "connection_refused"
+	// An ICMP host or network unreachable message was received.
+	outcomeUnreachable = "unreachable"
+	// The server closed or reset the connection before responding.
+	outcomeConnClosed = "connection_closed"
+	// Some other network error occurred.
+	outcomeNetwork = "network_error"
+	// The response ID did not match the query ID.
+	outcomeIDMismatch = "id_mismatch"
+	// The response could not be parsed.
+	outcomeMalformed = "malformed"
+	// The response had the TC (truncated) bit set.
+	outcomeTruncated = "truncated"
+	// The TLS handshake with the server failed.
+	outcomeTLSHandshake = "tls_handshake"
+	// The response had an rcode without a name.
+	outcomeUnknownRcode = "unknown_rcode"
+	// The error did not match any other class.
+	outcomeOther = "other"
+	// The query wasn't sent because the server's circuit breaker was open or
+	// the Experiment's query budget was used up.
+	outcomeSkipped = "skipped"
+)
+
+// outcomeClasses are the outcome classes that aren't rcode names.
+var outcomeClasses = []string{
+	outcomeOK, outcomeTimeout, outcomeConnRefused, outcomeUnreachable,
+	outcomeConnClosed, outcomeNetwork, outcomeIDMismatch, outcomeMalformed,
+	outcomeTruncated, outcomeTLSHandshake, outcomeUnknownRcode, outcomeOther,
+	outcomeSkipped,
+}
+
+// knownOutcome returns true if class is one of the outcome classes or an rcode
+// name.
+func knownOutcome(class string) bool {
+	for _, c := range outcomeClasses {
+		if c == class {
+			return true
+		}
+	}
+	for _, rcode := range dns.RcodeToString {
+		if rcode == class {
+			return true
+		}
+	}
+	return false
+}
+
+// queryError is an error from a query along with its outcome class.
+type queryError struct {
+	// class is the outcome class of the error, used for metric labels.
+	class string
+	// err is the underlying error.
+	err error
+}
+
+// Error returns the full text of the underlying error.
+func (qe *queryError) Error() string {
+	return qe.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (qe *queryError) Unwrap() error {
+	return qe.err
+}
+
+// outcome returns the outcome class for the given query error. A nil error has
+// the outcomeOK class.
+func outcome(err error) string {
+	if err == nil {
+		return outcomeOK
+	}
+	var qe *queryError
+	if errors.As(err, &qe) {
+		return qe.class
+	}
+	return classifyError(err)
+}
+
+// rcodeError returns a queryError for a response with the given non-success
+// rcode.
+func rcodeError(rcode int) *queryError {
+	class, ok := dns.RcodeToString[rcode]
+	if !ok {
+		class = outcomeUnknownRcode
+	}
+	return &queryError{class: class, err: errors.New(class)}
+}
+
+// classifyError returns the outcome class of an error returned by a DNS
+// exchange.
+func classifyError(err error) string {
+	var (
+		netErr  net.Error
+		dnsErr  *dns.Error
+		opErr   *net.OpError
+		recErr  tls.RecordHeaderError
+		authErr x509.UnknownAuthorityError
+		hostErr x509.HostnameError
+		certErr x509.CertificateInvalidError
+	)
+	switch {
+	case errors.Is(err, dns.ErrId):
+		return outcomeIDMismatch
+	case errors.Is(err, dns.ErrTruncated):
+		return outcomeTruncated
+	case errors.As(err, &dnsErr):
+		// The remaining errors from the dns package come from reading or
+		// unpacking the response.
+		return outcomeMalformed
+	case errors.As(err, &recErr), errors.As(err, &authErr),
+		errors.As(err, &hostErr), errors.As(err, &certErr):
+		return outcomeTLSHandshake
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return outcomeTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return outcomeConnRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return outcomeUnreachable
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return outcomeConnClosed
+	case errors.As(err, &opErr):
+		// TLS alerts sent by the server surface as a "remote error" OpError.
+		if opErr.Op == "remote error" || strings.HasPrefix(opErr.Err.Error(), "tls:") {
+			return outcomeTLSHandshake
+		}
+		return outcomeNetwork
+	case strings.HasPrefix(err.Error(), "tls:"):
+		return outcomeTLSHandshake
+	}
+	return outcomeOther
+}
@@ -0,0 +1,89 @@
+package dnslol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// opError wraps err in a *net.OpError like the net package does.
+func opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Err: err}
+}
+
+func TestOutcome(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "no error", err: nil, expected: outcomeOK},
+		{name: "rcode", err: rcodeError(dns.RcodeServerFailure), expected: "SERVFAIL"},
+		{name: "unknown rcode", err: rcodeError(4000), expected: outcomeUnknownRcode},
+		{name: "skipped", err: &queryError{class: outcomeSkipped, err: errBreakerOpen}, expected: outcomeSkipped},
+		{name: "id mismatch", err: dns.ErrId, expected: outcomeIDMismatch},
+		{name: "truncated", err: dns.ErrTruncated, expected: outcomeTruncated},
+		{name: "malformed", err: dns.ErrShortRead, expected: outcomeMalformed},
+		{name: "timeout", err: opError("read", timeoutError{}), expected: outcomeTimeout},
+		{name: "phase timeout", err: &phaseError{phase: phaseRead, err: opError("read", timeoutError{})}, expected: outcomeTimeout},
+		{name: "deadline exceeded", err: opError("read", os.ErrDeadlineExceeded), expected: outcomeTimeout},
+		{name: "connection refused", err: opError("read", os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)), expected: outcomeConnRefused},
+		{name: "host unreachable", err: opError("dial", syscall.EHOSTUNREACH), expected: outcomeUnreachable},
+		{name: "network unreachable", err: opError("dial", syscall.ENETUNREACH), expected: outcomeUnreachable},
+		{name: "EOF", err: io.EOF, expected: outcomeConnClosed},
+		{name: "connection reset", err: opError("read", syscall.ECONNRESET), expected: outcomeConnClosed},
+		{name: "broken pipe", err: opError("write", syscall.EPIPE), expected: outcomeConnClosed},
+		{name: "other network error", err: opError("dial", errors.New("no route")), expected: outcomeNetwork},
+		{name: "tls alert", err: opError("remote error", errors.New("tls: handshake failure")), expected: outcomeTLSHandshake},
+		{name: "tls record header", err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, expected: outcomeTLSHandshake},
+		{name: "unknown authority", err: fmt.Errorf("handshake: %w", x509.UnknownAuthorityError{}), expected: outcomeTLSHandshake},
+		{name: "tls error text", err: errors.New("tls: bad certificate"), expected: outcomeTLSHandshake},
+		{name: "other", err: errors.New("something else"), expected: outcomeOther},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if class := outcome(tc.err); class != tc.expected {
+				t.Errorf("expected outcome %q, got %q", tc.expected, class)
+			}
+		})
+	}
+}
+
+func TestKnownOutcome(t *testing.T) {
+	testCases := []struct {
+		class    string
+		expected bool
+	}{
+		{class: outcomeOK, expected: true},
+		{class: outcomeTimeout, expected: true},
+		{class: outcomeSkipped, expected: true},
+		{class: "SERVFAIL", expected: true},
+		{class: "NXDOMAIN", expected: true},
+		{class: "servfail", expected: false},
+		{class: "", expected: false},
+		{class: "anything else", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.class, func(t *testing.T) {
+			if got := knownOutcome(tc.class); got != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package dnslol
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// eventBuffer is the number of events buffered for each subscriber. Events
+	// for subscribers that fall further behind than this are dropped.
+	eventBuffer = 1024
+	// eventKeepalive is how often a comment is sent to idle event streams so
+	// that proxies don't close them.
+	eventKeepalive = 15 * time.Second
+	// outcomeFailure is a pseudo outcome class accepted by event filters that
+	// matches every outcome other than outcomeOK.
+	outcomeFailure = "failure"
+)
+
+// eventFilter selects which results are sent to an event subscriber. Empty
+// fields match everything.
+type eventFilter struct {
+	servers  map[string]bool
+	outcomes map[string]bool
+	types    map[uint16]bool
+	name     *regexp.Regexp
+}
+
+// csvSet returns the set of comma separated values in raw, or nil if raw is
+// empty.
+func csvSet(raw string) map[string]bool {
+	if raw == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, v := range strings.Split(raw, ",") {
+		set[strings.TrimSpace(v)] = true
+	}
+	return set
+}
+
+// parseEventFilter builds an eventFilter from the "server", "outcome", "type"
+// and "name" query parameters of an events request. The first three are comma
+// separated lists and "name" is a regular expression.
+func (e Experiment) parseEventFilter(r *http.Request) (eventFilter, error) {
+	var f eventFilter
+	for addr := range csvSet(r.FormValue("server")) {
+		srv, ok := e.serverByAddress(addr)
+		if !ok {
+			return f, fmt.Errorf("server %q is not one of the experiment's servers", addr)
+		}
+		if f.servers == nil {
+			f.servers = make(map[string]bool)
+		}
+		f.servers[srv.address] = true
+	}
+	f.outcomes = csvSet(r.FormValue("outcome"))
+	for t := range csvSet(r.FormValue("type")) {
+		typ, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return f, fmt.Errorf("unknown query type %q", t)
+		}
+		if f.types == nil {
+			f.types = make(map[uint16]bool)
+		}
+		f.types[typ] = true
+	}
+	if expr := r.FormValue("name"); expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return f, fmt.Errorf("invalid name regexp: %v", err)
+		}
+		f.name = re
+	}
+	return f, nil
+}
+
+// matches returns true if the given result passes the filter.
+func (f eventFilter) matches(r queryResult) bool {
+	if f.servers != nil && !f.servers[r.Server.address] {
+		return false
+	}
+	if f.outcomes != nil {
+		class := outcome(r.Err)
+		if !f.outcomes[class] && !(class != outcomeOK && f.outcomes[outcomeFailure]) {
+			return false
+		}
+	}
+	if f.types != nil && !f.types[r.Type] {
+		return false
+	}
+	if f.name != nil && !f.name.MatchString(r.Name) {
+		return false
+	}
+	return true
+}
+
+// eventSubscriber is one client of the result event stream.
+type eventSubscriber struct {
+	filter eventFilter
+	events chan resultRecord
+	// dropped is the number of events dropped because the subscriber fell
+	// behind. It is protected by the eventHub's lock.
+	dropped uint64
+}
+
+// eventHub fans out query results to the subscribers of the result event
+// stream. Publishing never blocks: events for subscribers that aren't keeping
+// up are dropped and counted.
+type eventHub struct {
+	sync.Mutex
+	subscribers map[*eventSubscriber]bool
+}
+
+// newEventHub creates an eventHub without any subscribers.
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[*eventSubscriber]bool)}
+}
+
+// subscribe adds a subscriber for results matching the given filter.
+func (h *eventHub) subscribe(f eventFilter) *eventSubscriber {
+	h.Lock()
+	defer h.Unlock()
+	sub := &eventSubscriber{filter: f, events: make(chan resultRecord, eventBuffer)}
+	h.subscribers[sub] = true
+	stats.eventSubscribers.Inc()
+	return sub
+}
+
+// unsubscribe removes a subscriber.
+func (h *eventHub) unsubscribe(sub *eventSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.subscribers, sub)
+	stats.eventSubscribers.Dec()
+}
+
+// takeDropped returns and resets the number of events dropped for a
+// subscriber.
+func (h *eventHub) takeDropped(sub *eventSubscriber) uint64 {
+	h.Lock()
+	defer h.Unlock()
+	n := sub.dropped
+	sub.dropped = 0
+	return n
+}
+
+// publish sends a result to every subscriber whose filter it matches.
+func (h *eventHub) publish(r queryResult) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.subscribers) == 0 {
+		return
+	}
+	var rec *resultRecord
+	for sub := range h.subscribers {
+		if !sub.filter.matches(r) {
+			continue
+		}
+		if rec == nil {
+			record := r.record()
+			rec = &record
+		}
+		select {
+		case sub.events <- *rec:
+		default:
+			sub.dropped++
+			stats.eventsDropped.Inc()
+		}
+	}
+}
+
+// handleEvents streams query results matching the request's filter as
+// Server-Sent Events. Each result is sent as a "result" event with a
+// resultRecord JSON object as the data. If events had to be dropped because
+// the client fell behind a "dropped" event with the number of dropped events
+// is sent before the next result.
+func (e Experiment) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, err := e.parseEventFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sub := e.events.subscribe(filter)
+	defer e.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case rec := <-sub.events:
+			if n := e.events.takeDropped(sub); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", n)
+			}
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: result\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,205 @@
+package dnslol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// eventResults are the results event filters are tested against.
+var eventResults = []queryResult{
+	{query: query{Server: server{address: "192.0.2.1:53"}, Name: "a.example", Type: dns.TypeA}},
+	{
+		query: query{Server: server{address: "192.0.2.2:53"}, Name: "b.example", Type: dns.TypeAAAA},
+		Err:   rcodeError(dns.RcodeServerFailure),
+	},
+	{
+		query: query{Server: server{address: "192.0.2.1:53"}, Name: "c.example", Type: dns.TypeTXT},
+		Err:   &queryError{class: outcomeTimeout, err: errors.New("i/o timeout")},
+	},
+}
+
+func TestParseEventFilter(t *testing.T) {
+	e := Experiment{servers: []server{{address: "192.0.2.1:53"}, {address: "192.0.2.2:53"}}}
+	testCases := []struct {
+		name          string
+		query         url.Values
+		expectedError string
+		// expected are the indexes of the eventResults the filter matches.
+		expected []int
+	}{
+		{
+			name:     "no filter",
+			expected: []int{0, 1, 2},
+		},
+		{
+			name:     "server without a port",
+			query:    url.Values{"server": {"192.0.2.2"}},
+			expected: []int{1},
+		},
+		{
+			name:     "servers",
+			query:    url.Values{"server": {"192.0.2.1:53, 192.0.2.2:53"}},
+			expected: []int{0, 1, 2},
+		},
+		{
+			name:          "unknown server",
+			query:         url.Values{"server": {"192.0.2.3"}},
+			expectedError: `server "192.0.2.3" is not one of the experiment's servers`,
+		},
+		{
+			name:     "outcome",
+			query:    url.Values{"outcome": {"SERVFAIL"}},
+			expected: []int{1},
+		},
+		{
+			name:     "failure",
+			query:    url.Values{"outcome": {"failure"}},
+			expected: []int{1, 2},
+		},
+		{
+			name:     "ok or timeout",
+			query:    url.Values{"outcome": {"ok,timeout"}},
+			expected: []int{0, 2},
+		},
+		{
+			name:     "types",
+			query:    url.Values{"type": {"a,txt"}},
+			expected: []int{0, 2},
+		},
+		{
+			name:          "unknown type",
+			query:         url.Values{"type": {"BOGUS"}},
+			expectedError: `unknown query type "BOGUS"`,
+		},
+		{
+			name:     "name",
+			query:    url.Values{"name": {`^[bc]\.`}},
+			expected: []int{1, 2},
+		},
+		{
+			name:          "invalid name",
+			query:         url.Values{"name": {"("}},
+			expectedError: "invalid name regexp: error parsing regexp: missing closing ): `(`",
+		},
+		{
+			name:     "all filters",
+			query:    url.Values{"server": {"192.0.2.1"}, "outcome": {"failure"}, "type": {"TXT"}, "name": {"example"}},
+			expected: []int{2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/events?"+tc.query.Encode(), nil)
+			f, err := e.parseEventFilter(r)
+			if tc.expectedError != "" {
+				if err == nil || err.Error() != tc.expectedError {
+					t.Errorf("expected error %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			var matched []int
+			for i, result := range eventResults {
+				if f.matches(result) {
+					matched = append(matched, i)
+				}
+			}
+			if len(matched) != len(tc.expected) {
+				t.Fatalf("expected results %v to match, got %v", tc.expected, matched)
+			}
+			for i := range matched {
+				if matched[i] != tc.expected[i] {
+					t.Fatalf("expected results %v to match, got %v", tc.expected, matched)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	e, srv := controlExperiment(t, Experiment{})
+
+	if code, _ := controlRequest(t, srv, http.MethodGet, "/events?type=BOGUS", ""); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid filter, got %d", http.StatusBadRequest, code)
+	}
+
+	resp, err := http.Get(srv.URL + "/events?outcome=failure&name=" + url.QueryEscape(`^c\.`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got %q", ct)
+	}
+
+	// The subscriber is added before the response headers are sent.
+	e.events.Lock()
+	subscribers := len(e.events.subscribers)
+	e.events.Unlock()
+	if subscribers != 1 {
+		t.Fatalf("expected 1 subscriber, got %d", subscribers)
+	}
+
+	// Only the last result matches, so it must be the first event received.
+	for _, result := range eventResults {
+		e.events.publish(result)
+	}
+	events := make(chan []string)
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() == "" {
+				events <- lines
+				lines = nil
+				continue
+			}
+			lines = append(lines, scanner.Text())
+		}
+		close(events)
+	}()
+	var lines []string
+	select {
+	case lines = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a result event")
+	}
+	if len(lines) != 2 || lines[0] != "event: result" || !strings.HasPrefix(lines[1], "data: ") {
+		t.Fatalf("expected a result event, got %q", lines)
+	}
+	var rec resultRecord
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Name != "c.example" || rec.Outcome != outcomeTimeout || rec.Type != "TXT" {
+		t.Errorf("expected the timeout of c.example TXT, got %+v", rec)
+	}
+
+	resp.Body.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		e.events.Lock()
+		subscribers = len(e.events.subscribers)
+		e.events.Unlock()
+		if subscribers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the subscriber to be removed once the client is gone, got %d", subscribers)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package dnslol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hedgeExperiment returns an Experiment hedging queries to two servers.
+func hedgeExperiment(t *testing.T) Experiment {
+	t.Helper()
+	e := retryExperiment(t, 0, false)
+	e.ResolverSet = SetHedged
+	e.HedgeDelay = 50 * time.Millisecond
+	return e
+}
+
+func TestSettleHedged(t *testing.T) {
+	servfail := rcodeError(dns.RcodeServerFailure)
+	nxdomain := rcodeError(dns.RcodeNameError)
+	type attempt struct {
+		// hedge is whether the completing attempt is the hedge.
+		hedge bool
+		err   error
+		// Whether the attempt is marked retried or superseded, and whether
+		// settling it sends the hedge at once.
+		retried, superseded, sendsHedge bool
+	}
+	testCases := []struct {
+		name string
+		// hedged is whether the hedge was sent after the HedgeDelay before
+		// any attempt completed.
+		hedged   bool
+		attempts []attempt
+	}{
+		{
+			name:     "answered before the hedge delay",
+			attempts: []attempt{{err: nil}},
+		},
+		{
+			name:     "answer that isn't retried",
+			attempts: []attempt{{err: nxdomain}},
+		},
+		{
+			name: "failed before the hedge delay",
+			attempts: []attempt{
+				{err: servfail, retried: true, sendsHedge: true},
+				{hedge: true, err: nil},
+			},
+		},
+		{
+			name:   "first answer wins",
+			hedged: true,
+			attempts: []attempt{
+				{err: nil},
+				{hedge: true, err: nil, superseded: true},
+			},
+		},
+		{
+			name:   "hedge wins",
+			hedged: true,
+			attempts: []attempt{
+				{hedge: true, err: nil},
+				{err: nil, superseded: true},
+			},
+		},
+		{
+			name:   "failure waits for the hedge",
+			hedged: true,
+			attempts: []attempt{
+				{err: servfail, retried: true},
+				{hedge: true, err: servfail},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := hedgeExperiment(t)
+			cq := &clientQuery{pending: 1}
+			first := query{Server: e.servers[0], Order: e.servers, Attempt: 1, Started: time.Now(), client: cq}
+			if tc.hedged {
+				cq.hedged = true
+				cq.pending++
+			}
+			for i, a := range tc.attempts {
+				q := first
+				if a.hedge {
+					q = e.hedge(first, first.Started)
+				}
+				r := queryResult{query: q, Err: a.err}
+				next, _, sent := e.settle(&r)
+				if r.Retried != a.retried || r.Superseded != a.superseded {
+					t.Errorf("expected attempt %d retried %v and superseded %v, got %v and %v",
+						i+1, a.retried, a.superseded, r.Retried, r.Superseded)
+				}
+				if sent != a.sendsHedge {
+					t.Fatalf("expected attempt %d to send the hedge %v, got %v", i+1, a.sendsHedge, sent)
+				}
+				if sent && (!next.Hedge || next.Server.address != e.servers[1].address) {
+					t.Errorf("expected the hedge sent to %s, got %+v", e.servers[1].address, next)
+				}
+			}
+			if !cq.decided || cq.pending != 0 {
+				t.Errorf("expected a decided query without pending attempts, got decided %v with %d pending", cq.decided, cq.pending)
+			}
+		})
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	testCases := []struct {
+		name       string
+		percentile float64
+		samples    int
+		expected   time.Duration
+	}{
+		{name: "fixed delay", samples: 1000, expected: 50 * time.Millisecond},
+		{name: "too few samples", percentile: 0.9, samples: hedgeMinSamples - 1, expected: 50 * time.Millisecond},
+		{name: "percentile", percentile: 0.9, samples: 1000, expected: 10 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := hedgeExperiment(t)
+			e.HedgePercentile = tc.percentile
+			e.summary = newRunSummary(e.servers)
+			for i := 0; i < tc.samples; i++ {
+				e.summary.queryStarted("a")
+				e.summary.queryFinished("a", 10*time.Millisecond, 0, nil)
+			}
+			if delay := e.hedgeDelay(e.servers[0]); !withinPrecision(delay, tc.expected) {
+				t.Errorf("expected a hedge delay of %s, got %s", tc.expected, delay)
+			}
+		})
+	}
+}
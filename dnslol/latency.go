@@ -0,0 +1,124 @@
+package dnslol
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// latencyHistMin is the smallest latency tracked with full precision by
+	// a latencyHist. Smaller latencies are counted in the first bucket.
+	latencyHistMin = 10 * time.Microsecond
+	// latencyHistPrecision is the relative width of each latencyHist bucket.
+	latencyHistPrecision = 0.01
+	// latencyHistBuckets is the number of buckets in a latencyHist. With the
+	// above settings this covers latencies up to roughly an hour.
+	latencyHistBuckets = 2000
+)
+
+// latencyHistBase is the natural log of the ratio between the upper bounds of
+// adjacent latencyHist buckets.
+var latencyHistBase = math.Log1p(latencyHistPrecision)
+
+// latencyHist is a logarithmically bucketed histogram of latencies used to compute
+// percentiles within the process. Every bucket is latencyHistPrecision wider
+// than the previous one, so quantiles are accurate to within that relative
+// error regardless of the latency range. It is not safe for concurrent use.
+type latencyHist struct {
+	counts [latencyHistBuckets]uint64
+	total  uint64
+}
+
+// bucketFor returns the index of the bucket that the given latency is counted
+// in.
+func bucketFor(d time.Duration) int {
+	if d <= latencyHistMin {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/float64(latencyHistMin)) / latencyHistBase))
+	if i >= latencyHistBuckets {
+		return latencyHistBuckets - 1
+	}
+	return i
+}
+
+// bucketValue returns the upper bound of the bucket with the given index.
+func bucketValue(i int) time.Duration {
+	return time.Duration(float64(latencyHistMin) * math.Exp(float64(i)*latencyHistBase))
+}
+
+// Observe records one latency.
+func (h *latencyHist) Observe(d time.Duration) {
+	h.counts[bucketFor(d)]++
+	h.total++
+}
+
+// Count returns the number of latencies recorded.
+func (h *latencyHist) Count() uint64 {
+	return h.total
+}
+
+// Quantile returns the latency below which the given fraction (0, 1] of
+// recorded latencies fall. Zero is returned if no latencies were recorded.
+func (h *latencyHist) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			return bucketValue(i)
+		}
+	}
+	return bucketValue(latencyHistBuckets - 1)
+}
+
+// Merge adds all of the latencies recorded by other to h.
+func (h *latencyHist) Merge(other *latencyHist) {
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.total += other.total
+}
+
+// Reset discards all recorded latencies.
+func (h *latencyHist) Reset() {
+	*h = latencyHist{}
+}
+
+// MarshalJSON encodes the histogram as an object mapping the index of each
+// non-empty bucket to its count.
+func (h *latencyHist) MarshalJSON() ([]byte, error) {
+	buckets := make(map[int]uint64)
+	for i, c := range h.counts {
+		if c > 0 {
+			buckets[i] = c
+		}
+	}
+	return json.Marshal(buckets)
+}
+
+// UnmarshalJSON decodes a histogram encoded by MarshalJSON, replacing any
+// recorded latencies.
+func (h *latencyHist) UnmarshalJSON(data []byte) error {
+	var buckets map[int]uint64
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return err
+	}
+	h.Reset()
+	for i, c := range buckets {
+		if i < 0 || i >= latencyHistBuckets {
+			return fmt.Errorf("latency histogram bucket %d out of range", i)
+		}
+		h.counts[i] += c
+		h.total += c
+	}
+	return nil
+}
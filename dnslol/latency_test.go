@@ -0,0 +1,109 @@
+package dnslol
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// withinPrecision returns whether got is within the relative precision of a
+// latencyHist of expected.
+func withinPrecision(got, expected time.Duration) bool {
+	diff := float64(got - expected)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= float64(expected)*latencyHistPrecision
+}
+
+func TestLatencyHistQuantile(t *testing.T) {
+	// One latency for each millisecond from 1ms to 100ms.
+	var uniform []time.Duration
+	for i := 1; i <= 100; i++ {
+		uniform = append(uniform, time.Duration(i)*time.Millisecond)
+	}
+	testCases := []struct {
+		name      string
+		latencies []time.Duration
+		quantile  float64
+		expected  time.Duration
+	}{
+		{name: "empty", quantile: 0.5, expected: 0},
+		{name: "single", latencies: []time.Duration{42 * time.Millisecond}, quantile: 0.99, expected: 42 * time.Millisecond},
+		{name: "median", latencies: uniform, quantile: 0.5, expected: 50 * time.Millisecond},
+		{name: "p99", latencies: uniform, quantile: 0.99, expected: 99 * time.Millisecond},
+		{name: "max", latencies: uniform, quantile: 1, expected: 100 * time.Millisecond},
+		{name: "min", latencies: uniform, quantile: 0, expected: time.Millisecond},
+		{name: "below minimum", latencies: []time.Duration{time.Microsecond}, quantile: 1, expected: latencyHistMin},
+		{name: "long latency", latencies: []time.Duration{30 * time.Second}, quantile: 1, expected: 30 * time.Second},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var h latencyHist
+			for _, d := range tc.latencies {
+				h.Observe(d)
+			}
+			if got := h.Quantile(tc.quantile); !withinPrecision(got, tc.expected) {
+				t.Errorf("expected quantile %v to be %s, got %s", tc.quantile, tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLatencyHistMergeAndJSON(t *testing.T) {
+	var a, b latencyHist
+	for i := 0; i < 90; i++ {
+		a.Observe(10 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		b.Observe(time.Second)
+	}
+	a.Merge(&b)
+
+	data, err := json.Marshal(&a)
+	if err != nil {
+		t.Fatalf("expected no error marshalling, got %v", err)
+	}
+	var decoded latencyHist
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("expected no error unmarshalling, got %v", err)
+	}
+	if decoded.Count() != 100 {
+		t.Fatalf("expected 100 latencies, got %d", decoded.Count())
+	}
+
+	testCases := []struct {
+		quantile float64
+		expected time.Duration
+	}{
+		{quantile: 0.5, expected: 10 * time.Millisecond},
+		{quantile: 0.9, expected: 10 * time.Millisecond},
+		{quantile: 0.91, expected: time.Second},
+	}
+	for _, tc := range testCases {
+		if got := decoded.Quantile(tc.quantile); !withinPrecision(got, tc.expected) {
+			t.Errorf("expected quantile %v to be %s, got %s", tc.quantile, tc.expected, got)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`{"2000":1}`), &decoded); err == nil {
+		t.Errorf("expected an error for an out of range bucket, got nil")
+	}
+}
+
+func TestQuantileName(t *testing.T) {
+	testCases := []struct {
+		quantile float64
+		expected string
+	}{
+		{quantile: 0.5, expected: "p50"},
+		{quantile: 0.99, expected: "p99"},
+		{quantile: 0.999, expected: "p99.9"},
+		{quantile: 1, expected: "max"},
+	}
+	for _, tc := range testCases {
+		if name := quantileName(tc.quantile); name != tc.expected {
+			t.Errorf("expected %q for quantile %v, got %q", tc.expected, tc.quantile, name)
+		}
+	}
+}
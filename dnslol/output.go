@@ -0,0 +1,352 @@
+package dnslol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// OutputText is a human readable "Key=value" output format.
+	OutputText = "text"
+	// OutputLogfmt is the logfmt output format, with quoted values where
+	// needed.
+	OutputLogfmt = "logfmt"
+	// OutputJSON is the newline delimited JSON output format.
+	OutputJSON = "json"
+
+	// FilterAll outputs every result.
+	FilterAll = "all"
+	// FilterFailures outputs only unsuccessful results.
+	FilterFailures = "failures"
+	// FilterDisagreements outputs all of the results for a name and type when
+	// the servers didn't all have the same effective outcome.
+	FilterDisagreements = "disagreements"
+)
+
+// validOutput checks the output settings of the Experiment.
+func (e Experiment) validOutput() error {
+	switch e.OutputFormat {
+	case OutputText, OutputLogfmt, OutputJSON:
+	default:
+		return errors.New(
+			`Experiment must have an OutputFormat of "text", "logfmt" or "json"`)
+	}
+	switch e.OutputFilter {
+	case FilterAll, FilterFailures, FilterDisagreements:
+	default:
+		return errors.New(
+			`Experiment must have an OutputFilter of "all", "failures" or "disagreements"`)
+	}
+	if e.OutputMaxSize < 0 || e.OutputMaxFiles < 0 {
+		return errors.New(
+			"Experiment must not have a negative OutputMaxSize or OutputMaxFiles")
+	}
+	return nil
+}
+
+// resultOutput writes query results to standard out or a file in the
+// Experiment's output format.
+type resultOutput struct {
+	sync.Mutex
+	w      io.Writer
+	encode func(*bytes.Buffer, resultRecord)
+	filter string
+}
+
+// newResultOutput creates a resultOutput for the Experiment's output settings.
+func newResultOutput(e Experiment) (*resultOutput, error) {
+	out := &resultOutput{w: os.Stdout, filter: e.OutputFilter}
+	switch e.OutputFormat {
+	case OutputText:
+		out.encode = encodeText
+	case OutputLogfmt:
+		out.encode = encodeLogfmt
+	case OutputJSON:
+		out.encode = encodeJSON
+	}
+	if e.OutputFile != "" {
+		f, err := openRotatingFile(e.OutputFile, e.OutputMaxSize, e.OutputMaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		out.w = f
+	}
+	return out, nil
+}
+
+// write outputs the results of a set of queries that passes the output
+// filter. The results must all be for the same name.
+func (out *resultOutput) write(results []queryResult) error {
+	var buf bytes.Buffer
+	for _, r := range out.filtered(results) {
+		out.encode(&buf, r.record())
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	out.Lock()
+	defer out.Unlock()
+	_, err := out.w.Write(buf.Bytes())
+	return err
+}
+
+// filtered returns the results that pass the output filter.
+func (out *resultOutput) filtered(results []queryResult) []queryResult {
+	switch out.filter {
+	case FilterFailures:
+		var failures []queryResult
+		for _, r := range results {
+			if r.Err != nil {
+				failures = append(failures, r)
+			}
+		}
+		return failures
+	case FilterDisagreements:
+		// Collect the effective outcomes of each query type by server and
+		// keep every result for a type where the servers didn't all see the
+		// same outcomes. Repeated queries to one server that disagree with
+		// each other (e.g. with a Count above one) aren't a disagreement
+		// between servers. Retried attempts don't count, a client didn't see
+		// their outcomes.
+		outcomes := make(map[uint16]map[string]map[string]bool)
+		for _, r := range results {
+			if !r.effective() {
+				continue
+			}
+			if outcomes[r.Type] == nil {
+				outcomes[r.Type] = make(map[string]map[string]bool)
+			}
+			byServer := outcomes[r.Type]
+			if byServer[r.Server.address] == nil {
+				byServer[r.Server.address] = make(map[string]bool)
+			}
+			byServer[r.Server.address][outcome(r.Err)] = true
+		}
+		disagree := make(map[uint16]bool, len(outcomes))
+		for typ, byServer := range outcomes {
+			disagree[typ] = serversDisagree(byServer)
+		}
+		var disagreements []queryResult
+		for _, r := range results {
+			if disagree[r.Type] {
+				disagreements = append(disagreements, r)
+			}
+		}
+		return disagreements
+	}
+	return results
+}
+
+// serversDisagree returns whether the servers of the given sets of outcomes,
+// by server address, didn't all see the same set of outcomes.
+func serversDisagree(byServer map[string]map[string]bool) bool {
+	var first map[string]bool
+	for _, seen := range byServer {
+		if first == nil {
+			first = seen
+			continue
+		}
+		if len(seen) != len(first) {
+			return true
+		}
+		for o := range seen {
+			if !first[o] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Close closes the output file, if any.
+func (out *resultOutput) Close() error {
+	out.Lock()
+	defer out.Unlock()
+	if c, ok := out.w.(io.Closer); ok && out.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// encodeText writes a record in the human readable "text" format. Values are
+// quoted like logfmt values when they are empty or contain spaces, quotes or
+// control characters, so that e.g. a name or error can't forge another field.
+func encodeText(buf *bytes.Buffer, rec resultRecord) {
+	fmt.Fprintf(buf, "%s Server=%s Name=%s QueryType=%s Outcome=%s",
+		rec.Time.Format(time.RFC3339Nano), logfmtValue(rec.Server),
+		logfmtValue(rec.Name), rec.Type, rec.Outcome)
+	if rec.TimeoutPhase != "" {
+		fmt.Fprintf(buf, " TimeoutPhase=%s", rec.TimeoutPhase)
+	}
+	if rec.Source != "" {
+		fmt.Fprintf(buf, " Source=%s", logfmtValue(rec.Source))
+	}
+	if rec.Rcode != "" {
+		fmt.Fprintf(buf, " Rcode=%s", logfmtValue(rec.Rcode))
+	}
+	fmt.Fprintf(buf, " RTT=%s", roundLatency(time.Duration(rec.RTT*float64(time.Second))))
+	if rec.Attempt > 1 || rec.Retried {
+		fmt.Fprintf(buf, " Attempt=%d Retried=%t", rec.Attempt, rec.Retried)
+	}
+	if rec.Hedge {
+		buf.WriteString(" Hedge=true")
+	}
+	if rec.Superseded {
+		buf.WriteString(" Superseded=true")
+	}
+	if rec.Error != "" {
+		fmt.Fprintf(buf, " Error=%s", logfmtValue(rec.Error))
+	}
+	if len(rec.Answers) > 0 {
+		answers := make([]string, len(rec.Answers))
+		for i, a := range rec.Answers {
+			answers[i] = strings.Replace(a, "\t", " ", -1)
+		}
+		fmt.Fprintf(buf, " Answers=%s", logfmtValue(strings.Join(answers, "; ")))
+	}
+	buf.WriteByte('\n')
+}
+
+// logfmtValue returns v quoted if it is empty or contains characters that
+// would make a logfmt line ambiguous.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\") ||
+		strings.IndexFunc(v, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// encodeLogfmt writes a record in the logfmt format using the field names of
+// the JSON schema. Answers are joined with "; ".
+func encodeLogfmt(buf *bytes.Buffer, rec resultRecord) {
+	// Optional fields are left out when they are empty.
+	pairs := []struct {
+		key, value string
+		optional   bool
+	}{
+		{"time", rec.Time.Format(time.RFC3339Nano), false},
+		{"server", rec.Server, false},
+		{"name", rec.Name, false},
+		{"type", rec.Type, false},
+		{"source", rec.Source, true},
+		{"outcome", rec.Outcome, false},
+		{"rcode", rec.Rcode, true},
+		{"rtt", strconv.FormatFloat(rec.RTT, 'f', -1, 64), false},
+		{"error", rec.Error, true},
+		{"timeoutPhase", rec.TimeoutPhase, true},
+		{"answers", strings.Join(rec.Answers, "; "), true},
+		{"attempt", strconv.Itoa(rec.Attempt), false},
+		{"retried", trueOrEmpty(rec.Retried), true},
+		{"hedge", trueOrEmpty(rec.Hedge), true},
+		{"superseded", trueOrEmpty(rec.Superseded), true},
+	}
+	for i, p := range pairs {
+		if p.optional && p.value == "" {
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(buf, "%s=%s", p.key, logfmtValue(p.value))
+	}
+	buf.WriteByte('\n')
+}
+
+// trueOrEmpty returns "true" for a true flag and "" for a false one, so that
+// false flags are omitted from logfmt lines like they are from JSON.
+func trueOrEmpty(flag bool) string {
+	if flag {
+		return "true"
+	}
+	return ""
+}
+
+// encodeJSON writes a record as a line of JSON.
+func encodeJSON(buf *bytes.Buffer, rec resultRecord) {
+	// Encoding a resultRecord can't fail.
+	_ = json.NewEncoder(buf).Encode(rec)
+}
+
+// rotatingFile is an io.WriteCloser for a file that is rotated when it grows
+// past a maximum size. The current file is renamed with a ".1" suffix, any
+// existing ".1" file becomes ".2" and so on, keeping at most maxFiles rotated
+// files. It is not safe for concurrent use.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// openRotatingFile opens (appending to) the file at path. A maxSize of zero
+// disables rotation.
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open opens the file at rf.path for appending.
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts the rotated files and opens a new
+// file.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if rf.maxFiles > 0 {
+		for i := rf.maxFiles - 1; i > 0; i-- {
+			// Missing files are expected until maxFiles rotations have happened.
+			_ = os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// Write writes p to the file, rotating it first if p would make it larger than
+// the maximum size.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
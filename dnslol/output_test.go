@@ -0,0 +1,129 @@
+package dnslol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestEncodeText(t *testing.T) {
+	base := resultRecord{
+		Time:    time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+		Server:  "127.0.0.1:53",
+		Name:    "example.com",
+		Type:    "A",
+		Outcome: "ok",
+		RTT:     0.25,
+		Attempt: 1,
+	}
+	testCases := []struct {
+		name     string
+		modify   func(*resultRecord)
+		expected string
+	}{
+		{
+			name:     "plain values",
+			modify:   func(rec *resultRecord) {},
+			expected: "2026-10-18T12:00:00Z Server=127.0.0.1:53 Name=example.com QueryType=A Outcome=ok RTT=250ms\n",
+		},
+		{
+			name: "error with spaces",
+			modify: func(rec *resultRecord) {
+				rec.Outcome = "timeout"
+				rec.Error = "i/o timeout Outcome=ok"
+			},
+			expected: "2026-10-18T12:00:00Z Server=127.0.0.1:53 Name=example.com QueryType=A Outcome=timeout RTT=250ms Error=\"i/o timeout Outcome=ok\"\n",
+		},
+		{
+			name:     "name with a newline",
+			modify:   func(rec *resultRecord) { rec.Name = "a\nb" },
+			expected: "2026-10-18T12:00:00Z Server=127.0.0.1:53 Name=\"a\\nb\" QueryType=A Outcome=ok RTT=250ms\n",
+		},
+		{
+			name: "answers",
+			modify: func(rec *resultRecord) {
+				rec.Answers = []string{"example.com.\t300\tIN\tA\t192.0.2.1", "example.com.\t300\tIN\tA\t192.0.2.2"}
+			},
+			expected: "2026-10-18T12:00:00Z Server=127.0.0.1:53 Name=example.com QueryType=A Outcome=ok RTT=250ms Answers=\"example.com. 300 IN A 192.0.2.1; example.com. 300 IN A 192.0.2.2\"\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := base
+			tc.modify(&rec)
+			var buf bytes.Buffer
+			encodeText(&buf, rec)
+			if buf.String() != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestFilterDisagreements(t *testing.T) {
+	servfail := rcodeError(dns.RcodeServerFailure)
+	result := func(address string, typ uint16, err error) queryResult {
+		return queryResult{query: query{Server: server{address: address}, Name: "example.com", Type: typ}, Err: err}
+	}
+	testCases := []struct {
+		name     string
+		results  []queryResult
+		expected int
+	}{
+		{
+			name: "servers agree",
+			results: []queryResult{
+				result("a", dns.TypeA, nil),
+				result("b", dns.TypeA, nil),
+			},
+		},
+		{
+			name: "servers disagree",
+			results: []queryResult{
+				result("a", dns.TypeA, nil),
+				result("b", dns.TypeA, servfail),
+				result("a", dns.TypeTXT, nil),
+				result("b", dns.TypeTXT, nil),
+			},
+			expected: 2,
+		},
+		{
+			name: "repeated queries to one server disagree",
+			results: []queryResult{
+				result("a", dns.TypeA, nil),
+				result("a", dns.TypeA, servfail),
+				result("b", dns.TypeA, nil),
+				result("b", dns.TypeA, servfail),
+			},
+		},
+		{
+			name: "one server",
+			results: []queryResult{
+				result("a", dns.TypeA, nil),
+				result("a", dns.TypeA, servfail),
+			},
+		},
+		{
+			name: "retried attempt",
+			results: []queryResult{
+				func() queryResult {
+					r := result("a", dns.TypeA, servfail)
+					r.Retried = true
+					return r
+				}(),
+				result("a", dns.TypeA, nil),
+				result("b", dns.TypeA, nil),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &resultOutput{filter: FilterDisagreements}
+			if got := out.filtered(tc.results); len(got) != tc.expected {
+				t.Errorf("expected %d results, got %d", tc.expected, len(got))
+			}
+		})
+	}
+}
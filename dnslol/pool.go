@@ -0,0 +1,390 @@
+package dnslol
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// errPoolClosed is the error of queries still waiting for a response when
+// their connection pool is closed, and of queries sent after it was closed.
+var errPoolClosed = errors.New("connection pool closed")
+
+// maxQueryIDs is the number of distinct query IDs.
+const maxQueryIDs = 1 << 16
+
+// errNoQueryID is returned when every query ID of a pooled connection is in
+// use.
+var errNoQueryID = errors.New("no free query ID on pooled connection")
+
+// poolTimeoutError is the error of a pooled query that didn't get a response
+// within its timeout. It is a net.Error so that it is classified
+// like the timeouts of unpooled queries.
+type poolTimeoutError struct{}
+
+func (poolTimeoutError) Error() string   { return "timed out waiting for response on pooled connection" }
+func (poolTimeoutError) Timeout() bool   { return true }
+func (poolTimeoutError) Temporary() bool { return true }
+
+// validPool checks the Experiment's PoolConns setting.
+func (e Experiment) validPool() error {
+	if e.PoolConns < 0 {
+		return errors.New("Experiment must not have a negative PoolConns")
+	}
+	return nil
+}
+
+// newConnPools creates a connPool for each of the Experiment's servers. The
+// connections are dialed with the protocol of the given dnsClient when they
+// are first used.
+func newConnPools(e Experiment, dnsClient *dns.Client) map[string]*connPool {
+	pools := make(map[string]*connPool, len(e.servers))
+	for _, srv := range e.servers {
+		labels := prom.Labels{"server": srv.address}
+		address := srv.address
+		pools[srv.address] = &connPool{
+			address: srv.address,
+			dial: func(deadline time.Time) (*dns.Conn, error) {
+				return e.dial(dnsClient, address, deadline)
+			},
+			udp:   e.Proto == "udp",
+			slots: make([]poolSlot, e.PoolConns),
+
+			writeTimeout: e.WriteTimeout,
+			readTimeout:  e.ReadTimeout,
+
+			open:       stats.poolConns.With(labels),
+			newQueries: stats.poolQueries.With(prom.Labels{"server": srv.address, "conn": "new"}),
+			reused:     stats.poolQueries.With(prom.Labels{"server": srv.address, "conn": "reused"}),
+			outOfOrder: stats.outOfOrder.With(labels),
+			unmatched:  stats.unmatchedResponses.With(labels),
+		}
+	}
+	return pools
+}
+
+// A connPool holds a fixed number of long-lived connections to one server that
+// are shared by all of the queries to the server. Queries are spread across
+// the connections round robin and several queries can wait for a response on
+// one connection at once: responses are matched to queries by their ID, so TCP
+// and DNS over TLS queries are pipelined (RFC 7766) and may be answered out of
+// order. Connections are dialed when first used and dialed again if they are
+// closed, e.g. by the server, until the pool is closed.
+type connPool struct {
+	address string
+	// dial connects to the server within the given deadline.
+	dial  func(deadline time.Time) (*dns.Conn, error)
+	udp   bool
+	slots []poolSlot
+	// writeTimeout and readTimeout limit sending each query and waiting for
+	// its response, like the Experiment's WriteTimeout and ReadTimeout.
+	writeTimeout time.Duration
+	readTimeout  time.Duration
+	// next is the index of the slot used by the next query.
+	next uint32
+	// mu guards closed, which is true once the pool has been closed. No
+	// connections are dialed after that.
+	mu     sync.Mutex
+	closed bool
+
+	open       prom.Gauge
+	newQueries prom.Counter
+	reused     prom.Counter
+	outOfOrder prom.Counter
+	unmatched  prom.Counter
+}
+
+// A poolSlot holds one of a connPool's connections, or nil if it hasn't been
+// dialed yet.
+type poolSlot struct {
+	sync.Mutex
+	conn *pooledConn
+}
+
+// conn returns the connection to send the next query on, dialing it within the
+// given deadline if the slot's connection isn't open, and whether it was open
+// already. It returns errPoolClosed once the pool has been closed.
+func (p *connPool) conn(deadline time.Time) (*pooledConn, bool, error) {
+	slot := &p.slots[int(atomic.AddUint32(&p.next, 1)-1)%len(p.slots)]
+	slot.Lock()
+	defer slot.Unlock()
+	// close marks the pool closed before it locks the slots, so a connection
+	// dialed here is closed by it.
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil, false, errPoolClosed
+	}
+	if slot.conn != nil && !slot.conn.closed() {
+		return slot.conn, true, nil
+	}
+	co, err := p.dial(deadline)
+	if err != nil {
+		return nil, false, err
+	}
+	slot.conn = newPooledConn(p, co)
+	return slot.conn, false, nil
+}
+
+// exchange sends the query m on one of the pool's connections and waits up to
+// timeout for its response, like dns.Client.Exchange, dialing the connection
+// first if needed. The ID of m is replaced with one that isn't in use on the
+// connection. A query on a connection that was already open that fails because
+// the connection was closed is sent once more on a new connection, since the
+// server may have closed the old one while it was idle.
+func (p *connPool) exchange(m *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; ; attempt++ {
+		c, reused, err := p.conn(deadline)
+		if err != nil {
+			return nil, 0, err
+		}
+		if reused {
+			p.reused.Inc()
+		} else {
+			p.newQueries.Inc()
+		}
+		in, rtt, closed, err := c.exchange(m, deadline)
+		if closed && reused && attempt == 0 {
+			continue
+		}
+		return in, rtt, err
+	}
+}
+
+// close closes all of the pool's connections. Queries waiting for a response,
+// and queries sent afterwards, fail with errPoolClosed.
+func (p *connPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	for i := range p.slots {
+		slot := &p.slots[i]
+		slot.Lock()
+		if slot.conn != nil {
+			slot.conn.fail(errPoolClosed)
+		}
+		slot.Unlock()
+	}
+}
+
+// A pooledConn is one connection of a connPool. A goroutine reads the
+// responses from the connection and hands each to the query waiting for it.
+type pooledConn struct {
+	pool *connPool
+	co   *dns.Conn
+	// writeMu serializes writes so that pipelined TCP messages aren't
+	// interleaved.
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// err is the reason the connection was closed, or nil while it is open.
+	err error
+	// pending holds the queries waiting for a response by ID.
+	pending map[uint16]*pendingQuery
+	// outstanding holds the sequence numbers of the queries waiting for a
+	// response. nextSeq is the sequence number of the next query sent and
+	// oldest the lowest outstanding one, or nextSeq if there are none. A
+	// response to any query other than the oldest is out of order.
+	outstanding map[uint64]bool
+	nextSeq     uint64
+	oldest      uint64
+}
+
+// A pendingQuery is a query waiting for its response on a pooledConn.
+type pendingQuery struct {
+	seq      uint64
+	question dns.Question
+	// done receives the response or error. It is buffered so that the reader
+	// never blocks on a query that has given up waiting.
+	done chan pooledResponse
+}
+
+// A pooledResponse is the outcome of a pendingQuery.
+type pooledResponse struct {
+	msg *dns.Msg
+	err error
+	// closed is whether the connection was closed before a response arrived.
+	closed bool
+}
+
+// newPooledConn starts reading the responses from the given connection of the
+// pool.
+func newPooledConn(p *connPool, co *dns.Conn) *pooledConn {
+	c := &pooledConn{
+		pool:        p,
+		co:          co,
+		pending:     make(map[uint16]*pendingQuery),
+		outstanding: make(map[uint64]bool),
+	}
+	p.open.Inc()
+	go c.read()
+	return c
+}
+
+// closed returns whether the connection has been closed.
+func (c *pooledConn) closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// exchange sends the query m on the connection with a free ID and waits for
+// its response until the given deadline, or the pool's write and read
+// timeouts. It also returns whether the query failed because the connection
+// failed or was closed by the server.
+func (c *pooledConn) exchange(m *dns.Msg, deadline time.Time) (*dns.Msg, time.Duration, bool, error) {
+	pq, err := c.register(m)
+	if err == errNoQueryID {
+		return nil, 0, false, err
+	} else if err != nil {
+		return nil, 0, err != errPoolClosed, err
+	}
+
+	start := time.Now()
+	writeDeadline, phase := phaseDeadline(phaseWrite, c.pool.writeTimeout, deadline)
+	c.writeMu.Lock()
+	_ = c.co.SetWriteDeadline(writeDeadline)
+	err = c.co.WriteMsg(m)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, time.Since(start), true, &phaseError{phase: phase, err: err}
+	}
+
+	readDeadline, phase := phaseDeadline(phaseRead, c.pool.readTimeout, deadline)
+	timer := time.NewTimer(time.Until(readDeadline))
+	defer timer.Stop()
+	select {
+	case r := <-pq.done:
+		return r.msg, time.Since(start), r.closed && r.err != errPoolClosed, r.err
+	case <-timer.C:
+		c.mu.Lock()
+		if c.pending[m.Id] == pq {
+			c.forget(m.Id, pq)
+		}
+		c.mu.Unlock()
+		return nil, time.Since(start), false, &phaseError{phase: phase, err: poolTimeoutError{}}
+	}
+}
+
+// register gives m an ID that isn't in use on the connection and adds it to the
+// pending queries.
+func (c *pooledConn) register(m *dns.Msg) (*pendingQuery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if len(c.pending) >= maxQueryIDs {
+		return nil, errNoQueryID
+	}
+	id := uint16(rand.Intn(maxQueryIDs))
+	for c.pending[id] != nil {
+		id++
+	}
+	m.Id = id
+	pq := &pendingQuery{
+		seq:  c.nextSeq,
+		done: make(chan pooledResponse, 1),
+	}
+	if len(m.Question) > 0 {
+		pq.question = m.Question[0]
+	}
+	c.pending[id] = pq
+	c.outstanding[pq.seq] = true
+	c.nextSeq++
+	return pq, nil
+}
+
+// forget removes the pending query with the given ID. The caller must hold
+// c.mu.
+func (c *pooledConn) forget(id uint16, pq *pendingQuery) {
+	delete(c.pending, id)
+	delete(c.outstanding, pq.seq)
+	for c.oldest < c.nextSeq && !c.outstanding[c.oldest] {
+		c.oldest++
+	}
+}
+
+// read reads responses from the connection until it fails or is closed,
+// handing each to the pending query with its ID.
+func (c *pooledConn) read() {
+	for {
+		p, err := c.co.ReadMsgHeader(nil)
+		if err != nil {
+			// A short UDP datagram doesn't affect the other queries on the
+			// socket, but a TCP stream can't be read past a bad message.
+			var dnsErr *dns.Error
+			if c.pool.udp && errors.As(err, &dnsErr) {
+				c.pool.unmatched.Inc()
+				continue
+			}
+			c.fail(err)
+			return
+		}
+		in := new(dns.Msg)
+		err = in.Unpack(p)
+		c.deliver(binary.BigEndian.Uint16(p), in, err)
+	}
+}
+
+// deliver hands a response to the pending query with the given ID. A response
+// that doesn't match a pending query's ID and question, e.g. one that arrived
+// after its query timed out, is counted and dropped.
+func (c *pooledConn) deliver(id uint16, in *dns.Msg, err error) {
+	c.mu.Lock()
+	pq := c.pending[id]
+	if pq == nil || (err == nil && !sameQuestion(in, pq.question)) {
+		c.mu.Unlock()
+		c.pool.unmatched.Inc()
+		return
+	}
+	if pq.seq != c.oldest {
+		c.pool.outOfOrder.Inc()
+	}
+	c.forget(id, pq)
+	c.mu.Unlock()
+	pq.done <- pooledResponse{msg: in, err: err}
+}
+
+// sameQuestion returns whether the response is for the given question.
+// Responses without a question section, e.g. some FORMERR responses, match any
+// question.
+func sameQuestion(in *dns.Msg, q dns.Question) bool {
+	if len(in.Question) == 0 {
+		return true
+	}
+	r := in.Question[0]
+	return r.Qtype == q.Qtype && r.Qclass == q.Qclass && strings.EqualFold(r.Name, q.Name)
+}
+
+// fail closes the connection because of the given error, which is returned to
+// every pending query. Calls after the first have no effect.
+func (c *pooledConn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	pending := c.pending
+	c.pending = make(map[uint16]*pendingQuery)
+	c.outstanding = make(map[uint64]bool)
+	c.oldest = c.nextSeq
+	c.mu.Unlock()
+
+	_ = c.co.Close()
+	c.pool.open.Dec()
+	for _, pq := range pending {
+		pq.done <- pooledResponse{err: err, closed: true}
+	}
+}
@@ -0,0 +1,459 @@
+package dnslol
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// testCounter is a prom.Counter that can be read by tests.
+type testCounter struct {
+	prom.Counter
+	n int64
+}
+
+func (c *testCounter) Inc()          { atomic.AddInt64(&c.n, 1) }
+func (c *testCounter) Add(v float64) { atomic.AddInt64(&c.n, int64(v)) }
+func (c *testCounter) value() int64  { return atomic.LoadInt64(&c.n) }
+
+// testGauge is a prom.Gauge that can be read by tests.
+type testGauge struct {
+	prom.Gauge
+	n int64
+}
+
+func (g *testGauge) Inc()         { atomic.AddInt64(&g.n, 1) }
+func (g *testGauge) Dec()         { atomic.AddInt64(&g.n, -1) }
+func (g *testGauge) value() int64 { return atomic.LoadInt64(&g.n) }
+
+// testPoolMetrics are the metrics of a connPool under test.
+type testPoolMetrics struct {
+	open                                      *testGauge
+	newQueries, reused, outOfOrder, unmatched *testCounter
+	dials                                     int64
+}
+
+// testConnPool returns a connPool with conns connections to the server at
+// address over network, and its metrics.
+func testConnPool(network, address string, conns int) (*connPool, *testPoolMetrics) {
+	m := &testPoolMetrics{
+		open:       new(testGauge),
+		newQueries: new(testCounter),
+		reused:     new(testCounter),
+		outOfOrder: new(testCounter),
+		unmatched:  new(testCounter),
+	}
+	client := &dns.Client{Net: network}
+	p := &connPool{
+		address: address,
+		dial: func(deadline time.Time) (*dns.Conn, error) {
+			atomic.AddInt64(&m.dials, 1)
+			return Experiment{}.dial(client, address, deadline)
+		},
+		udp:        network == "udp",
+		slots:      make([]poolSlot, conns),
+		open:       m.open,
+		newQueries: m.newQueries,
+		reused:     m.reused,
+		outOfOrder: m.outOfOrder,
+		unmatched:  m.unmatched,
+	}
+	return p, m
+}
+
+// answer returns a response to r with an A record.
+func answer(t *testing.T, r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	rr, err := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+	if err != nil {
+		t.Error(err)
+		return m
+	}
+	m.Answer = append(m.Answer, rr)
+	return m
+}
+
+// poolTCPServer starts a TCP server that calls serve with the number of each
+// connection it accepts, starting at 1, and closes the connection when serve
+// returns.
+func poolTCPServer(t *testing.T, serve func(n int, co *dns.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for n := 1; ; n++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(n int, c net.Conn) {
+				defer c.Close()
+				serve(n, &dns.Conn{Conn: c})
+			}(n, c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// poolUDPServer starts a UDP server that calls serve with its socket.
+func poolUDPServer(t *testing.T, serve func(pc net.PacketConn)) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go serve(pc)
+	return pc.LocalAddr().String()
+}
+
+// readUDP reads a query from pc.
+func readUDP(pc net.PacketConn) (*dns.Msg, net.Addr, error) {
+	buf := make([]byte, dns.MaxMsgSize)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := new(dns.Msg)
+	return r, addr, r.Unpack(buf[:n])
+}
+
+// writeUDP writes the message m to addr on pc.
+func writeUDP(t *testing.T, pc net.PacketConn, addr net.Addr, m *dns.Msg) {
+	buf, err := m.Pack()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, _ = pc.WriteTo(buf, addr)
+}
+
+// exchangeAll sends a query for each of names on the pool at once and returns
+// the responses and errors in the same order.
+func exchangeAll(p *connPool, names ...string) ([]*dns.Msg, []error) {
+	responses := make([]*dns.Msg, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			responses[i], _, errs[i] = p.exchange(m, 2*time.Second)
+		}(i, name)
+	}
+	wg.Wait()
+	return responses, errs
+}
+
+// checkAnswers checks that each response is the answer to its name.
+func checkAnswers(t *testing.T, names []string, responses []*dns.Msg, errs []error) {
+	t.Helper()
+	for i, name := range names {
+		if errs[i] != nil {
+			t.Errorf("expected an answer for %q, got error %v", name, errs[i])
+			continue
+		}
+		in := responses[i]
+		if len(in.Question) != 1 || in.Question[0].Name != name ||
+			len(in.Answer) != 1 || in.Answer[0].Header().Name != name {
+			t.Errorf("expected the answer for %q, got %v", name, in)
+		}
+	}
+}
+
+func TestConnPoolOutOfOrder(t *testing.T) {
+	names := []string{"a.example.", "b.example.", "c.example."}
+	// Both servers read all of the queries before answering them in reverse.
+	// They signal each query they read so that the next one is only sent
+	// after it.
+	received := make(chan struct{}, len(names))
+	tcp := poolTCPServer(t, func(_ int, co *dns.Conn) {
+		var queries []*dns.Msg
+		for len(queries) < len(names) {
+			r, err := co.ReadMsg()
+			if err != nil {
+				return
+			}
+			queries = append(queries, r)
+			received <- struct{}{}
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			_ = co.WriteMsg(answer(t, queries[i]))
+		}
+		_, _ = co.ReadMsg()
+	})
+	udp := poolUDPServer(t, func(pc net.PacketConn) {
+		type query struct {
+			r    *dns.Msg
+			addr net.Addr
+		}
+		var queries []query
+		for len(queries) < len(names) {
+			r, addr, err := readUDP(pc)
+			if err != nil {
+				return
+			}
+			queries = append(queries, query{r, addr})
+			received <- struct{}{}
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			writeUDP(t, pc, queries[i].addr, answer(t, queries[i].r))
+		}
+	})
+
+	for network, address := range map[string]string{"tcp": tcp, "udp": udp} {
+		t.Run(network, func(t *testing.T) {
+			p, m := testConnPool(network, address, 1)
+			defer p.close()
+			responses := make([]*dns.Msg, len(names))
+			errs := make([]error, len(names))
+			var wg sync.WaitGroup
+			for i, name := range names {
+				wg.Add(1)
+				go func(i int, name string) {
+					defer wg.Done()
+					m := new(dns.Msg)
+					m.SetQuestion(name, dns.TypeA)
+					responses[i], _, errs[i] = p.exchange(m, 2*time.Second)
+				}(i, name)
+				<-received
+			}
+			wg.Wait()
+			checkAnswers(t, names, responses, errs)
+
+			// The queries shared one connection with distinct IDs.
+			if m.dials != 1 {
+				t.Errorf("expected 1 connection, got %d", m.dials)
+			}
+			if n := m.newQueries.value() + m.reused.value(); n != int64(len(names)) {
+				t.Errorf("expected %d queries, got %d", len(names), n)
+			}
+			// The first of the three answers is for the newest query and the
+			// second for the middle one, while the oldest is outstanding.
+			if n := m.outOfOrder.value(); n != 2 {
+				t.Errorf("expected 2 out of order responses, got %d", n)
+			}
+		})
+	}
+}
+
+func TestConnPoolUnmatched(t *testing.T) {
+	// Before each answer the servers send a response with another ID and one
+	// with the query's ID for another question.
+	responses := func(r *dns.Msg) []*dns.Msg {
+		otherID := answer(t, r)
+		otherID.Id = r.Id + 1
+		otherQuestion := new(dns.Msg)
+		otherQuestion.SetQuestion("other.example.", dns.TypeA)
+		otherQuestion.Id = r.Id
+		otherQuestion = answer(t, otherQuestion)
+		return []*dns.Msg{otherID, otherQuestion, answer(t, r)}
+	}
+	tcp := poolTCPServer(t, func(_ int, co *dns.Conn) {
+		for {
+			r, err := co.ReadMsg()
+			if err != nil {
+				return
+			}
+			for _, m := range responses(r) {
+				_ = co.WriteMsg(m)
+			}
+		}
+	})
+	udp := poolUDPServer(t, func(pc net.PacketConn) {
+		for {
+			r, addr, err := readUDP(pc)
+			if err != nil {
+				return
+			}
+			for _, m := range responses(r) {
+				writeUDP(t, pc, addr, m)
+			}
+		}
+	})
+
+	for network, address := range map[string]string{"tcp": tcp, "udp": udp} {
+		t.Run(network, func(t *testing.T) {
+			p, m := testConnPool(network, address, 1)
+			defer p.close()
+			names := []string{"a.example."}
+			responses, errs := exchangeAll(p, names...)
+			checkAnswers(t, names, responses, errs)
+			if n := m.unmatched.value(); n != 2 {
+				t.Errorf("expected 2 unmatched responses, got %d", n)
+			}
+		})
+	}
+}
+
+func TestConnPoolTimeout(t *testing.T) {
+	// The server never answers.
+	udp := poolUDPServer(t, func(pc net.PacketConn) {
+		for {
+			if _, _, err := readUDP(pc); err != nil {
+				return
+			}
+		}
+	})
+	testCases := []struct {
+		name          string
+		readTimeout   time.Duration
+		timeout       time.Duration
+		expectedPhase string
+	}{
+		{
+			name:          "query timeout",
+			timeout:       50 * time.Millisecond,
+			expectedPhase: phaseTotal,
+		},
+		{
+			name:          "read timeout",
+			readTimeout:   50 * time.Millisecond,
+			timeout:       time.Second,
+			expectedPhase: phaseRead,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, _ := testConnPool("udp", udp, 1)
+			defer p.close()
+			p.readTimeout = tc.readTimeout
+			m := new(dns.Msg)
+			m.SetQuestion("a.example.", dns.TypeA)
+			start := time.Now()
+			_, _, err := p.exchange(m, tc.timeout)
+			if class := outcome(err); class != outcomeTimeout {
+				t.Errorf("expected outcome %q, got %q (%v)", outcomeTimeout, class, err)
+			}
+			if phase := timeoutPhase(&queryError{class: outcomeTimeout, err: err}); phase != tc.expectedPhase {
+				t.Errorf("expected timeout phase %q, got %q", tc.expectedPhase, phase)
+			}
+			if elapsed := time.Since(start); tc.readTimeout > 0 && elapsed >= tc.timeout {
+				t.Errorf("expected to wait less than %s, waited %s", tc.timeout, elapsed)
+			}
+		})
+	}
+}
+
+func TestConnPoolResend(t *testing.T) {
+	// The first connection answers the first query and is closed by the
+	// server when it reads the second. Later connections answer every query.
+	tcp := poolTCPServer(t, func(n int, co *dns.Conn) {
+		for i := 1; ; i++ {
+			r, err := co.ReadMsg()
+			if err != nil || (n == 1 && i == 2) {
+				return
+			}
+			_ = co.WriteMsg(answer(t, r))
+		}
+	})
+	p, m := testConnPool("tcp", tcp, 1)
+	defer p.close()
+
+	names := []string{"a.example."}
+	responses, errs := exchangeAll(p, names...)
+	checkAnswers(t, names, responses, errs)
+	// The second query is sent on the open connection, which the server
+	// closes, and sent once more on a new connection.
+	names = []string{"b.example."}
+	responses, errs = exchangeAll(p, names...)
+	checkAnswers(t, names, responses, errs)
+
+	if m.dials != 2 {
+		t.Errorf("expected 2 connections, got %d", m.dials)
+	}
+	if n := m.newQueries.value(); n != 2 {
+		t.Errorf("expected 2 queries on new connections, got %d", n)
+	}
+	if n := m.reused.value(); n != 1 {
+		t.Errorf("expected 1 query on a reused connection, got %d", n)
+	}
+}
+
+func TestConnPoolNoQueryID(t *testing.T) {
+	// Every ID but one is in use on the connection.
+	const free = 12345
+	c := &pooledConn{
+		pending:     make(map[uint16]*pendingQuery),
+		outstanding: make(map[uint64]bool),
+	}
+	for id := 0; id < maxQueryIDs; id++ {
+		if id != free {
+			c.pending[uint16(id)] = &pendingQuery{}
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.", dns.TypeA)
+	if _, err := c.register(m); err != nil {
+		t.Fatalf("expected the query to be registered, got %v", err)
+	}
+	if m.Id != free {
+		t.Errorf("expected the free ID %d, got %d", free, m.Id)
+	}
+
+	m = new(dns.Msg)
+	m.SetQuestion("b.example.", dns.TypeA)
+	_, _, closed, err := c.exchange(m, time.Now().Add(time.Second))
+	if err != errNoQueryID || closed {
+		t.Errorf("expected %v without the connection closing, got %v (closed %t)",
+			errNoQueryID, err, closed)
+	}
+}
+
+func TestConnPoolClose(t *testing.T) {
+	// The server answers nothing, so queries wait until the pool is closed.
+	tcp := poolTCPServer(t, func(_ int, co *dns.Conn) {
+		for {
+			if _, err := co.ReadMsg(); err != nil {
+				return
+			}
+		}
+	})
+	p, m := testConnPool("tcp", tcp, 2)
+
+	waiting := make(chan error)
+	go func() {
+		_, errs := exchangeAll(p, "a.example.")
+		waiting <- errs[0]
+	}()
+	for deadline := time.Now().Add(5 * time.Second); m.open.value() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a connection to be opened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	p.close()
+	if err := <-waiting; !errors.Is(err, errPoolClosed) {
+		t.Errorf("expected the waiting query to fail with %v, got %v", errPoolClosed, err)
+	}
+	if n := m.open.value(); n != 0 {
+		t.Errorf("expected no open connections, got %d", n)
+	}
+
+	// Queries after the pool is closed, e.g. retries, don't dial new
+	// connections.
+	dials := atomic.LoadInt64(&m.dials)
+	for i := 0; i < 4; i++ {
+		if _, errs := exchangeAll(p, "b.example."); !errors.Is(errs[0], errPoolClosed) {
+			t.Errorf("expected %v after the pool is closed, got %v", errPoolClosed, errs[0])
+		}
+	}
+	if n := atomic.LoadInt64(&m.dials); n != dials {
+		t.Errorf("expected no connections to be dialed after close, got %d", n-dials)
+	}
+}
@@ -0,0 +1,83 @@
+package dnslol
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// progressSnapshot holds the counters needed to compute rates between two
+// progress reports.
+type progressSnapshot struct {
+	at       time.Time
+	names    uint64
+	attempts uint64
+}
+
+// snapshot returns the current progress counters.
+func (rs *runSummary) snapshot() progressSnapshot {
+	rs.Lock()
+	defer rs.Unlock()
+	snap := progressSnapshot{at: time.Now(), names: rs.names}
+	for _, s := range rs.servers {
+		snap.attempts += s.attempts
+	}
+	return snap
+}
+
+// progress returns a one line progress report covering the time since the
+// prev snapshot, along with a new snapshot to pass to the next call. If
+// expected is greater than zero the report includes the completion percentage
+// and an estimate of the time remaining.
+func (rs *runSummary) progress(prev progressSnapshot, expected int64) (string, progressSnapshot) {
+	cur := rs.snapshot()
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "Progress: names=%d", cur.names)
+	if expected > 0 {
+		fmt.Fprintf(&line, "/%d (%.1f%%)",
+			expected, percent(cur.names, uint64(expected)))
+	}
+	if elapsed := cur.at.Sub(prev.at).Seconds(); elapsed > 0 {
+		fmt.Fprintf(&line, " qps=%.1f", float64(cur.attempts-prev.attempts)/elapsed)
+	}
+	if expected > 0 && cur.names > 0 && cur.names < uint64(expected) {
+		// Estimate the remaining time from the average rate over the whole run,
+		// which is steadier than the rate since the last report.
+		perName := cur.at.Sub(rs.start) / time.Duration(cur.names)
+		eta := perName * time.Duration(uint64(expected)-cur.names)
+		fmt.Fprintf(&line, " eta=%s", eta.Round(time.Second))
+	}
+
+	rs.Lock()
+	defer rs.Unlock()
+	for _, addr := range rs.addresses() {
+		s := rs.servers[addr]
+		if addr == resolverSetAddress {
+			fmt.Fprintf(&line, " [%s ok=%.1f%%]",
+				addr, percent(s.effectiveSuccesses, s.queries))
+			continue
+		}
+		fmt.Fprintf(&line, " [%s ok=%.1f%% inflight=%d]",
+			addr, percent(s.successes, s.attempts), s.inflight)
+	}
+	return line.String(), cur
+}
+
+// reportProgress logs a progress line every interval until done is closed.
+func (e Experiment) reportProgress(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	prev := e.summary.snapshot()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			var line string
+			line, prev = e.summary.progress(prev, e.ExpectedNames)
+			log.Print(line)
+		}
+	}
+}
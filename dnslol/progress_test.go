@@ -0,0 +1,124 @@
+package dnslol
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	testCases := []struct {
+		name string
+		// names is the number of names finished, elapsed the time since the
+		// run started and attempts the queries sent in the 10 seconds since
+		// the last report.
+		names    int
+		elapsed  time.Duration
+		attempts int
+		expected int64
+		// report is the expected report without its ETA and servers, and eta
+		// the expected ETA, if there is one.
+		report string
+		eta    time.Duration
+	}{
+		{
+			name:     "no expected names",
+			names:    5,
+			elapsed:  time.Minute,
+			attempts: 100,
+			report:   "Progress: names=5 qps=10.0",
+		},
+		{
+			name:     "half way",
+			names:    50,
+			elapsed:  100 * time.Second,
+			attempts: 25,
+			expected: 100,
+			report:   "Progress: names=50/100 (50.0%) qps=2.5",
+			eta:      100 * time.Second,
+		},
+		{
+			name:     "a quarter of the way",
+			names:    1000,
+			elapsed:  time.Minute,
+			expected: 4000,
+			report:   "Progress: names=1000/4000 (25.0%) qps=0.0",
+			eta:      3 * time.Minute,
+		},
+		{
+			name:     "no names finished",
+			elapsed:  time.Minute,
+			expected: 100,
+			report:   "Progress: names=0/100 (0.0%) qps=0.0",
+		},
+		{
+			name:     "finished",
+			names:    100,
+			elapsed:  time.Minute,
+			expected: 100,
+			report:   "Progress: names=100/100 (100.0%) qps=0.0",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := newRunSummary([]server{{address: "192.0.2.1:53"}})
+			rs.start = time.Now().Add(-tc.elapsed)
+			rs.names = uint64(tc.names)
+			prev := rs.snapshot()
+			prev.at = prev.at.Add(-10 * time.Second)
+			for i := 0; i < tc.attempts; i++ {
+				rs.queryStarted("192.0.2.1:53")
+				rs.queryFinished("192.0.2.1:53", time.Millisecond, 0, nil)
+			}
+
+			line, cur := rs.progress(prev, tc.expected)
+			if cur.attempts != uint64(tc.attempts) || cur.names != uint64(tc.names) {
+				t.Errorf("expected a snapshot of %d attempts and %d names, got %+v",
+					tc.attempts, tc.names, cur)
+			}
+			report := strings.TrimSpace(line[:strings.Index(line, "[")])
+			var eta time.Duration
+			if i := strings.Index(report, " eta="); i >= 0 {
+				var err error
+				if eta, err = time.ParseDuration(report[i+len(" eta="):]); err != nil {
+					t.Fatalf("expected an ETA, got %q: %v", report, err)
+				}
+				report = report[:i]
+			}
+			if report != tc.report {
+				t.Errorf("expected report %q, got %q", tc.report, report)
+			}
+			// The ETA is rounded to the second and the run's duration grows
+			// while the test runs.
+			if diff := eta - tc.eta; diff < -time.Second || diff > time.Second {
+				t.Errorf("expected an ETA of %s, got %s", tc.eta, eta)
+			} else if tc.eta == 0 && eta != 0 {
+				t.Errorf("expected no ETA, got %s", eta)
+			}
+		})
+	}
+}
+
+func TestProgressServers(t *testing.T) {
+	rs := newRunSummary([]server{{address: "192.0.2.1:53"}, {address: resolverSetAddress}})
+	for i := 0; i < 4; i++ {
+		rs.queryStarted("192.0.2.1:53")
+	}
+	for i := 0; i < 3; i++ {
+		var err error
+		if i == 2 {
+			err = summaryTimeout
+		}
+		rs.queryFinished("192.0.2.1:53", time.Millisecond, 0, err)
+	}
+	rs.queryCompleted(resolverSetAddress, time.Millisecond, nil)
+	rs.queryCompleted(resolverSetAddress, time.Millisecond, nil)
+	rs.queryCompleted(resolverSetAddress, time.Millisecond, summaryTimeout)
+
+	line, _ := rs.progress(rs.snapshot(), 0)
+	expected := "[192.0.2.1:53 ok=50.0% inflight=1] [resolver-set ok=66.7%]"
+	if !strings.HasSuffix(line, expected) {
+		t.Errorf("expected report to end with %q, got %q", expected, line)
+	}
+}
@@ -0,0 +1,262 @@
+package dnslol
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// RampNone starts the Experiment at its full load immediately.
+	RampNone = "none"
+	// RampLinear increases the Experiment load linearly over the RampDuration.
+	RampLinear = "linear"
+	// RampStep increases the Experiment load in RampSteps equal steps spread
+	// over the RampDuration.
+	RampStep = "step"
+
+	// rampTick is how often the load level is re-evaluated while ramping.
+	rampTick = 100 * time.Millisecond
+)
+
+// rateLimiter is a token bucket rate limiter. Callers reserve a token and are
+// told the time at which they are allowed to proceed. Reservations may be
+// made ahead of time so that a steady stream of callers is paced evenly
+// regardless of how long each caller takes to do its work, which is what
+// makes the Experiment's QPS mode open-loop.
+//
+// The limiter also keeps an ideal schedule with one slot every 1/rate seconds.
+// Unlike the bucket, the schedule never forgets time that passed without
+// callers, so when callers fall behind (e.g. because every worker is busy
+// waiting on a slow server) the difference between the scheduled and actual
+// send times grows. That difference is used to correct latency measurements
+// for coordinated omission.
+//
+// Callers waiting for a reservation are woken when the rate changes so that a
+// reservation made at a low rate early in a ramp is due as soon as the new rate
+// allows, not after the long wait computed at the old rate.
+type rateLimiter struct {
+	sync.Mutex
+	// rate is the number of tokens added to the bucket per second.
+	rate float64
+	// burst is the maximum number of tokens the bucket can hold.
+	burst float64
+	// tokens is the number of tokens in the bucket as of last. It is negative
+	// when there are outstanding reservations for future tokens.
+	tokens float64
+	// last is the time tokens was last updated.
+	last time.Time
+	// credited is the total number of tokens added to the bucket as of last,
+	// ignoring the burst limit. A reservation is due once credited reaches its
+	// credit.
+	credited float64
+	// changed is closed, and replaced, when the rate changes to wake callers
+	// waiting for their reservations.
+	changed chan struct{}
+	// schedule is the time of the next slot in the ideal schedule. It is zero
+	// until the first reservation so that the schedule starts with the first
+	// query rather than when the limiter was created.
+	schedule time.Time
+}
+
+// newRateLimiter creates a rateLimiter that allows rate tokens per second. A
+// rate of zero or less doesn't limit callers at all. The bucket starts empty so
+// that a new experiment doesn't begin with a burst.
+func newRateLimiter(rate float64) *rateLimiter {
+	l := &rateLimiter{last: time.Now(), changed: make(chan struct{})}
+	l.setRateLocked(rate)
+	return l
+}
+
+// setRateLocked updates the rate and burst of the limiter. The caller must hold
+// the lock.
+func (l *rateLimiter) setRateLocked(rate float64) {
+	l.rate = rate
+	// Allow a burst of up to 10ms worth of tokens (but always at least one) so
+	// that high rates aren't limited by timer granularity.
+	l.burst = math.Max(1, rate/100)
+}
+
+// SetRate changes the rate of the limiter. Tokens accumulated at the old rate
+// are kept and the outstanding reservations are due at the new rate.
+func (l *rateLimiter) SetRate(rate float64) {
+	l.Lock()
+	defer l.Unlock()
+	if rate == l.rate {
+		return
+	}
+	l.advance(time.Now())
+	l.setRateLocked(rate)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// resetSchedule restarts the ideal schedule from the next reservation, e.g.
+// after dispatch was deliberately paused.
+func (l *rateLimiter) resetSchedule() {
+	l.Lock()
+	defer l.Unlock()
+	l.schedule = time.Time{}
+}
+
+// Rate returns the current rate of the limiter in tokens per second.
+func (l *rateLimiter) Rate() float64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.rate
+}
+
+// advance adds the tokens accumulated between l.last and now to the bucket.
+// The caller must hold the lock.
+func (l *rateLimiter) advance(now time.Time) {
+	if now.After(l.last) {
+		added := now.Sub(l.last).Seconds() * l.rate
+		l.tokens = math.Min(l.burst, l.tokens+added)
+		l.credited += added
+		l.last = now
+	}
+}
+
+// dueLocked returns the time at which a reservation with the given credit is
+// due at the current rate. The caller must hold the lock.
+func (l *rateLimiter) dueLocked(credit float64) time.Time {
+	if l.rate <= 0 || credit <= l.credited {
+		return l.last
+	}
+	return l.last.Add(time.Duration((credit - l.credited) / l.rate * float64(time.Second)))
+}
+
+// A reservation is a token taken from a rateLimiter that may only be used once
+// the limiter has credited enough tokens.
+type reservation struct {
+	l *rateLimiter
+	// credit is the limiter's credited tokens at which the reservation is due.
+	credit float64
+}
+
+// wait sleeps until the reservation is due, recomputing when that is whenever
+// the limiter's rate changes, and returns the time it was due.
+func (r reservation) wait() time.Time {
+	for {
+		r.l.Lock()
+		due, changed := r.l.dueLocked(r.credit), r.l.changed
+		r.l.Unlock()
+		d := time.Until(due)
+		if d <= 0 {
+			return due
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+			return due
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+// reserve takes one token from the bucket and returns the reservation the
+// caller must wait for along with the caller's slot in the ideal schedule.
+func (l *rateLimiter) reserve() (reservation, time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.advance(now)
+	res := reservation{l: l, credit: l.credited}
+	if l.rate <= 0 {
+		// Unlimited. Restart the schedule from the next reservation if a rate
+		// is set later.
+		l.schedule = time.Time{}
+		return res, now
+	}
+	l.tokens--
+	if l.tokens < 0 {
+		res.credit -= l.tokens
+	}
+	allowed := l.dueLocked(res.credit)
+
+	if l.schedule.IsZero() {
+		l.schedule = now
+	}
+	scheduled := l.schedule
+	l.schedule = l.schedule.Add(time.Duration(float64(time.Second) / l.rate))
+	// The bucket allows small bursts ahead of the schedule. Never report a
+	// scheduled time after the caller was allowed to proceed.
+	if scheduled.After(allowed) {
+		scheduled = allowed
+	}
+	return res, scheduled
+}
+
+// waitFor reserves a token from each of the given limiters, skipping nil
+// limiters, and sleeps until all of the reservations are due. The time the
+// caller was scheduled to proceed (the latest of the ideal schedule slots) is
+// returned. Without any limiters that is the current time.
+func waitFor(limiters ...*rateLimiter) time.Time {
+	allowed, scheduled := time.Now(), time.Time{}
+	reservations := make([]reservation, 0, len(limiters))
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		res, s := l.reserve()
+		reservations = append(reservations, res)
+		if s.After(scheduled) {
+			scheduled = s
+		}
+	}
+	// Waiting for each reservation in turn waits until the last one is due,
+	// even when the rates change while waiting.
+	for _, res := range reservations {
+		if due := res.wait(); due.After(allowed) {
+			allowed = due
+		}
+	}
+	if scheduled.IsZero() {
+		return allowed
+	}
+	if scheduled.After(allowed) {
+		scheduled = allowed
+	}
+	return scheduled
+}
+
+// validRamp checks the given ramp settings, returning an error if they are not
+// usable.
+func validRamp(mode string, duration time.Duration, steps int) error {
+	switch mode {
+	case RampNone:
+		return nil
+	case RampLinear:
+	case RampStep:
+		if steps < 1 {
+			return errors.New("Experiment must have a RampSteps value greater than 0")
+		}
+	default:
+		return errors.New(
+			`Experiment must have a RampMode value of "none", "linear" or "step"`)
+	}
+	if duration <= 0 {
+		return errors.New("Experiment must have a positive RampDuration")
+	}
+	return nil
+}
+
+// rampLevel returns the fraction (0, 1] of the Experiment's full load that
+// should be applied after running for the given elapsed time.
+func (e Experiment) rampLevel(elapsed time.Duration) float64 {
+	if elapsed >= e.RampDuration {
+		return 1
+	}
+	switch e.RampMode {
+	case RampLinear:
+		// Start one tick into the ramp so the initial level is never zero.
+		return math.Min(1, float64(elapsed+rampTick)/float64(e.RampDuration))
+	case RampStep:
+		stepLen := e.RampDuration / time.Duration(e.RampSteps)
+		step := int(elapsed/stepLen) + 1
+		return math.Min(1, float64(step)/float64(e.RampSteps))
+	}
+	return 1
+}
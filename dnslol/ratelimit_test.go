@@ -0,0 +1,135 @@
+package dnslol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRampLevel(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mode     string
+		steps    int
+		elapsed  time.Duration
+		expected float64
+	}{
+		{name: "no ramp", mode: RampNone, elapsed: 0, expected: 1},
+		{name: "linear start", mode: RampLinear, elapsed: 0, expected: 0.01},
+		{name: "linear halfway", mode: RampLinear, elapsed: 5*time.Second - rampTick, expected: 0.5},
+		{name: "linear end", mode: RampLinear, elapsed: 10 * time.Second, expected: 1},
+		{name: "first step", mode: RampStep, steps: 4, elapsed: 0, expected: 0.25},
+		{name: "third step", mode: RampStep, steps: 4, elapsed: 5 * time.Second, expected: 0.75},
+		{name: "after ramp", mode: RampStep, steps: 4, elapsed: time.Minute, expected: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := Experiment{RampMode: tc.mode, RampDuration: 10 * time.Second, RampSteps: tc.steps}
+			if level := e.rampLevel(tc.elapsed); level != tc.expected {
+				t.Errorf("expected level %v, got %v", tc.expected, level)
+			}
+		})
+	}
+}
+
+func TestValidRamp(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mode     string
+		duration time.Duration
+		steps    int
+		wantErr  bool
+	}{
+		{name: "none", mode: RampNone},
+		{name: "linear", mode: RampLinear, duration: time.Minute},
+		{name: "step", mode: RampStep, duration: time.Minute, steps: 3},
+		{name: "unknown mode", mode: "exponential", duration: time.Minute, wantErr: true},
+		{name: "no duration", mode: RampLinear, wantErr: true},
+		{name: "no steps", mode: RampStep, duration: time.Minute, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validRamp(tc.mode, tc.duration, tc.steps); (err != nil) != tc.wantErr {
+				t.Errorf("expected an error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	testCases := []struct {
+		name         string
+		rate         float64
+		reservations int
+		// expected is roughly how long after the first reservation the last
+		// one is due.
+		expected time.Duration
+	}{
+		{name: "unlimited", rate: 0, reservations: 100, expected: 0},
+		{name: "paced", rate: 100, reservations: 11, expected: 110 * time.Millisecond},
+		{name: "burst", rate: 10000, reservations: 100, expected: 10 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newRateLimiter(tc.rate)
+			start := time.Now()
+			var due time.Time
+			for i := 0; i < tc.reservations; i++ {
+				res, _ := l.reserve()
+				l.Lock()
+				due = l.dueLocked(res.credit)
+				l.Unlock()
+			}
+			if got := due.Sub(start); got < tc.expected-5*time.Millisecond || got > tc.expected+5*time.Millisecond {
+				t.Errorf("expected the last reservation due after %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		newRate float64
+		// expected is the longest the pending reservation may still take
+		// after the rate changes.
+		expected time.Duration
+	}{
+		{name: "raised", newRate: 1000, expected: 100 * time.Millisecond},
+		{name: "unlimited", newRate: 0, expected: 100 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// At one query a minute the second reservation is due in a
+			// minute unless the new rate applies to it.
+			l := newRateLimiter(1.0 / 60)
+			l.reserve()
+			res, _ := l.reserve()
+			done := make(chan struct{})
+			go func() {
+				res.wait()
+				close(done)
+			}()
+			time.Sleep(10 * time.Millisecond)
+			l.SetRate(tc.newRate)
+			select {
+			case <-done:
+			case <-time.After(tc.expected):
+				t.Errorf("expected the reservation due within %s of the rate change", tc.expected)
+			}
+		})
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	slow, fast := newRateLimiter(100), newRateLimiter(10000)
+	// Use up the slow limiter's first token so the next one is 10ms away.
+	slow.reserve()
+	start := time.Now()
+	scheduled := waitFor(slow, nil, fast)
+	if waited := time.Since(start); waited < 5*time.Millisecond {
+		t.Errorf("expected to wait for the slowest limiter, waited %s", waited)
+	}
+	if scheduled.After(time.Now()) {
+		t.Errorf("expected a scheduled time before now, got %s", scheduled)
+	}
+}
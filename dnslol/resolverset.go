@@ -0,0 +1,82 @@
+package dnslol
+
+import (
+	"errors"
+	"math/rand"
+	"sync/atomic"
+)
+
+const (
+	// SetOrdered sends the first attempt of every query to the first of the
+	// Servers and fails over to the others in order.
+	SetOrdered = "ordered"
+	// SetRandom tries the Servers in a random order for each query.
+	SetRandom = "random"
+	// SetRoundRobin sends the first attempt of each query to the next of the
+	// Servers in turn and fails over to the ones after it.
+	SetRoundRobin = "roundrobin"
+	// SetHedged sends each query to the first of the Servers and, if it hasn't
+	// been answered after the HedgeDelay, to the second server as well. The
+	// first answer wins.
+	SetHedged = "hedged"
+
+	// resolverSetAddress is the server address used for the effective results
+	// of an Experiment with a ResolverSet, which are those of the whole set
+	// rather than of one server.
+	resolverSetAddress = "resolver-set"
+)
+
+// validResolverSet checks the Experiment's ResolverSet, HedgeDelay and
+// HedgePercentile settings.
+func (e Experiment) validResolverSet() error {
+	switch e.ResolverSet {
+	case "", SetOrdered, SetRandom, SetRoundRobin:
+	case SetHedged:
+		if len(e.Servers) < 2 {
+			return errors.New("Experiment must have at least two Servers to hedge queries")
+		}
+		if e.HedgeDelay <= 0 {
+			return errors.New("Experiment must have a HedgeDelay greater than 0 to hedge queries")
+		}
+		if e.HedgePercentile < 0 || e.HedgePercentile > 1 {
+			return errors.New("Experiment must have a HedgePercentile between 0 and 1")
+		}
+	default:
+		return errors.New(`Experiment must have a ResolverSet of "", "ordered", "random", "roundrobin" or "hedged"`)
+	}
+	if e.HedgeDelay < 0 {
+		return errors.New("Experiment must not have a negative HedgeDelay")
+	}
+	return nil
+}
+
+// hedging returns whether the Experiment hedges queries.
+func (e Experiment) hedging() bool {
+	return e.ResolverSet == SetHedged
+}
+
+// resolverSet returns the pseudo server that the effective results of an
+// Experiment with a ResolverSet are recorded for.
+func resolverSet() server {
+	return server{address: resolverSetAddress}
+}
+
+// setOrder returns the order in which the attempts of the next query to the
+// given resolver set are sent to its servers, according to the Experiment's
+// ResolverSet strategy.
+func (e Experiment) setOrder(servers []server) []server {
+	order := make([]server, len(servers))
+	switch e.ResolverSet {
+	case SetRandom:
+		for i, j := range rand.Perm(len(servers)) {
+			order[i] = servers[j]
+		}
+	case SetRoundRobin:
+		first := int((atomic.AddUint64(e.rotation, 1) - 1) % uint64(len(servers)))
+		copy(order, servers[first:])
+		copy(order[len(servers)-first:], servers[:first])
+	default:
+		copy(order, servers)
+	}
+	return order
+}
@@ -0,0 +1,105 @@
+package dnslol
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// addresses returns the addresses of the given servers joined with commas.
+func addresses(servers []server) string {
+	var addrs []string
+	for _, s := range servers {
+		addrs = append(addrs, s.address)
+	}
+	return strings.Join(addrs, ",")
+}
+
+func TestValidResolverSet(t *testing.T) {
+	testCases := []struct {
+		name    string
+		exp     Experiment
+		wantErr bool
+	}{
+		{name: "no resolver set", exp: Experiment{}},
+		{name: "round robin", exp: Experiment{ResolverSet: SetRoundRobin, Servers: []string{"a"}}},
+		{name: "hedged", exp: Experiment{ResolverSet: SetHedged, Servers: []string{"a", "b"}, HedgeDelay: time.Millisecond, HedgePercentile: 0.95}},
+		{name: "unknown strategy", exp: Experiment{ResolverSet: "fastest"}, wantErr: true},
+		{name: "hedged with one server", exp: Experiment{ResolverSet: SetHedged, Servers: []string{"a"}, HedgeDelay: time.Millisecond}, wantErr: true},
+		{name: "hedged without a delay", exp: Experiment{ResolverSet: SetHedged, Servers: []string{"a", "b"}}, wantErr: true},
+		{name: "hedge percentile above 1", exp: Experiment{ResolverSet: SetHedged, Servers: []string{"a", "b"}, HedgeDelay: time.Millisecond, HedgePercentile: 95}, wantErr: true},
+		{name: "negative hedge delay", exp: Experiment{HedgeDelay: -time.Millisecond}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.exp.validResolverSet(); (err != nil) != tc.wantErr {
+				t.Errorf("expected an error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSetOrder(t *testing.T) {
+	servers := []server{{address: "a"}, {address: "b"}, {address: "c"}}
+	testCases := []struct {
+		strategy string
+		// expected is the order of each of four queries in turn.
+		expected []string
+	}{
+		{strategy: SetOrdered, expected: []string{"a,b,c", "a,b,c", "a,b,c", "a,b,c"}},
+		{strategy: SetHedged, expected: []string{"a,b,c", "a,b,c", "a,b,c", "a,b,c"}},
+		{strategy: SetRoundRobin, expected: []string{"a,b,c", "b,c,a", "c,a,b", "a,b,c"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.strategy, func(t *testing.T) {
+			e := Experiment{ResolverSet: tc.strategy, rotation: new(uint64)}
+			for i, expected := range tc.expected {
+				if order := addresses(e.setOrder(servers)); order != expected {
+					t.Errorf("expected query %d in order %s, got %s", i+1, expected, order)
+				}
+			}
+		})
+	}
+}
+
+func TestSetOrderRandom(t *testing.T) {
+	servers := []server{{address: "a"}, {address: "b"}, {address: "c"}}
+	e := Experiment{ResolverSet: SetRandom}
+	firsts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		order := e.setOrder(servers)
+		seen := make(map[string]bool)
+		for _, s := range order {
+			seen[s.address] = true
+		}
+		if len(seen) != len(servers) {
+			t.Fatalf("expected an order of every server, got %s", addresses(order))
+		}
+		firsts[order[0].address]++
+	}
+	for _, s := range servers {
+		if firsts[s.address] < 50 {
+			t.Errorf("expected %s first about a third of the time, got %d of 300", s.address, firsts[s.address])
+		}
+	}
+}
+
+func TestRetryResolverSet(t *testing.T) {
+	e := retryExperiment(t, 4, false)
+	e.ResolverSet = SetRoundRobin
+	order := []server{{address: "b"}, {address: "c"}, {address: "a"}}
+	q := query{Server: order[0], Order: order, Attempt: 1, Started: time.Now()}
+	// Retries go to the next server of the query's order, wrapping around.
+	for _, expected := range []string{"c", "a", "b"} {
+		next, _, retry := e.retry(queryResult{query: q, Err: rcodeError(dns.RcodeServerFailure)})
+		if !retry {
+			t.Fatalf("expected attempt %d to be retried", q.Attempt)
+		}
+		if next.Server.address != expected {
+			t.Errorf("expected attempt %d sent to %s, got %s", next.Attempt, expected, next.Server.address)
+		}
+		q = next
+	}
+}
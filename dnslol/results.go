@@ -0,0 +1,77 @@
+package dnslol
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A resultRecord is the structured representation of a query result shared by
+// the lookup service, the result event stream and structured output. Its JSON
+// encoding is a stable, documented schema: fields may be added but existing
+// fields are not renamed or removed.
+type resultRecord struct {
+	// When the query was sent.
+	Time time.Time `json:"time"`
+	// The address of the server queried.
+	Server string `json:"server"`
+	// The name queried.
+	Name string `json:"name"`
+	// The query type, e.g. "A".
+	Type string `json:"type"`
+	// Where the name came from, e.g. a certificate serial, if known.
+	Source string `json:"source,omitempty"`
+	// The outcome class of the result, e.g. "ok", "timeout" or "SERVFAIL".
+	Outcome string `json:"outcome"`
+	// The full error text for unsuccessful results.
+	Error string `json:"error,omitempty"`
+	// The phase of the attempt that timed out for "timeout" results: "dial",
+	// "tls", "write", "read" or "total" if the attempt's timeout passed first.
+	TimeoutPhase string `json:"timeoutPhase,omitempty"`
+	// The rcode of the response, if a response was received.
+	Rcode string `json:"rcode,omitempty"`
+	// The round trip time of the query in seconds.
+	RTT float64 `json:"rtt"`
+	// The answer section of the response in presentation format.
+	Answers []string `json:"answers,omitempty"`
+	// The attempt number of the query, starting at 1. Queries are only sent
+	// more than once when the Experiment retries them.
+	Attempt int `json:"attempt"`
+	// Whether the query was retried, or hedged, after this attempt failed.
+	Retried bool `json:"retried,omitempty"`
+	// Whether the query is the hedge of a hedged query.
+	Hedge bool `json:"hedge,omitempty"`
+	// Whether another attempt of the query had already decided its outcome
+	// when this attempt completed. The outcome of the attempt that was neither
+	// retried nor superseded is the effective outcome a client sees.
+	Superseded bool `json:"superseded,omitempty"`
+}
+
+// record returns the resultRecord for a queryResult.
+func (r queryResult) record() resultRecord {
+	rec := resultRecord{
+		Time:    r.Sent.UTC(),
+		Server:  r.Server.address,
+		Name:    r.Name,
+		Type:    dns.TypeToString[r.Type],
+		Source:  r.Source,
+		Outcome: outcome(r.Err),
+		RTT:     r.RTT.Seconds(),
+		Attempt: r.Attempt,
+		Retried: r.Retried,
+		Hedge:   r.Hedge,
+
+		Superseded: r.Superseded,
+	}
+	if r.Err != nil {
+		rec.Error = r.Err.Error()
+		rec.TimeoutPhase = timeoutPhase(r.Err)
+	}
+	if r.Response != nil {
+		rec.Rcode = dns.RcodeToString[r.Response.Rcode]
+		for _, rr := range r.Response.Answer {
+			rec.Answers = append(rec.Answers, rr.String())
+		}
+	}
+	return rec
+}
@@ -0,0 +1,318 @@
+package dnslol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryNetwork is a RetryOn value that stands for every network error outcome
+// class: "connection_refused", "unreachable", "connection_closed" and
+// "network_error".
+const RetryNetwork = "network"
+
+// DefaultRetryOn are the outcome classes retried when an Experiment with
+// Attempts doesn't specify any RetryOn classes.
+var DefaultRetryOn = []string{outcomeTimeout, dns.RcodeToString[dns.RcodeServerFailure], RetryNetwork}
+
+// networkOutcomes are the outcome classes RetryNetwork stands for.
+var networkOutcomes = []string{
+	outcomeConnRefused, outcomeUnreachable, outcomeConnClosed, outcomeNetwork,
+}
+
+// retrySet returns the set of lowercased outcome classes for the given RetryOn
+// values, using DefaultRetryOn if there are none. An error is returned if a
+// value isn't an outcome class, an rcode name or RetryNetwork.
+func retrySet(retryOn []string) (map[string]bool, error) {
+	var classes []string
+	for _, class := range retryOn {
+		if class = strings.ToLower(strings.TrimSpace(class)); class != "" {
+			classes = append(classes, class)
+		}
+	}
+	if len(classes) == 0 {
+		for _, class := range DefaultRetryOn {
+			classes = append(classes, strings.ToLower(class))
+		}
+	}
+	known := make(map[string]bool)
+	for _, class := range outcomeClasses {
+		known[class] = true
+	}
+	for _, rcode := range dns.RcodeToString {
+		known[strings.ToLower(rcode)] = true
+	}
+	set := make(map[string]bool)
+	for _, class := range classes {
+		switch {
+		case class == RetryNetwork:
+			for _, c := range networkOutcomes {
+				set[c] = true
+			}
+		case known[class]:
+			set[class] = true
+		default:
+			return nil, fmt.Errorf(
+				"unknown RetryOn outcome %q, must be an outcome class, an rcode or %q",
+				class, RetryNetwork)
+		}
+	}
+	return set, nil
+}
+
+// validRetry checks the Experiment's retry policy settings.
+func (e Experiment) validRetry() error {
+	if e.Attempts < 0 {
+		return errors.New("Experiment must not have a negative Attempts")
+	}
+	if e.AttemptTimeout < 0 || e.RetryBackoff < 0 {
+		return errors.New(
+			"Experiment must not have a negative AttemptTimeout or RetryBackoff")
+	}
+	_, err := retrySet(e.RetryOn)
+	return err
+}
+
+// maxAttempts returns the most times a query is sent.
+func (e Experiment) maxAttempts() int {
+	if e.Attempts < 1 {
+		return 1
+	}
+	return e.Attempts
+}
+
+// attemptTimeout returns the timeout of an attempt of a query whose first
+// attempt was sent at the given time, or is about to be sent if it is zero.
+// Every attempt is limited to the AttemptTimeout and to what is left of the
+// query's overall Timeout.
+func (e Experiment) attemptTimeout(started time.Time) time.Duration {
+	timeout := e.Timeout
+	if e.AttemptTimeout > 0 && e.AttemptTimeout < timeout {
+		timeout = e.AttemptTimeout
+	}
+	if started.IsZero() {
+		return timeout
+	}
+	if remaining := e.Timeout - time.Since(started); remaining < timeout {
+		timeout = remaining
+	}
+	return timeout
+}
+
+// errAttemptExpired is the error of an attempt of a query that wasn't sent
+// because the query's Timeout passed while the attempt waited to be sent.
+var errAttemptExpired = errors.New("query timed out before the attempt could be sent")
+
+// expireAttempt returns the error of an attempt that isn't sent because its
+// query's Timeout has passed. The attempt's query budget reservation is
+// refunded and, if it was the probe of the given half-open circuit breaker,
+// the breaker may send another probe.
+func (e Experiment) expireAttempt(b *breaker, probe bool) error {
+	if e.stopConditions != nil {
+		e.stopConditions.refund()
+	}
+	if b != nil && probe {
+		b.abandonProbe()
+	}
+	return &queryError{
+		class: outcomeTimeout,
+		err:   &phaseError{phase: phaseTotal, err: errAttemptExpired},
+	}
+}
+
+// backoff returns how long to wait before the given attempt of a query. The
+// RetryBackoff is doubled for each attempt after the second.
+func (e Experiment) backoff(attempt int) time.Duration {
+	shift := uint(attempt - 2)
+	if shift > 16 {
+		shift = 16
+	}
+	return e.RetryBackoff << shift
+}
+
+// retryable returns whether a query with the given error is retried. Queries
+// skipped by a circuit breaker are retried when the retry goes to another
+// server, with Failover or a ResolverSet. Queries skipped because the query
+// budget is used up are never retried.
+func (e Experiment) retryable(err error) bool {
+	if errors.Is(err, errQueryBudget) {
+		return false
+	}
+	if outcome(err) == outcomeSkipped && (e.Failover || e.ResolverSet != "") {
+		return true
+	}
+	return err != nil && e.retryOn[strings.ToLower(outcome(err))]
+}
+
+// retry returns the next attempt of the query of the given result and how long
+// to wait before sending it, or false if the query isn't retried: its outcome
+// isn't one of the RetryOn classes, it was the last attempt or the query's
+// Timeout would pass before the next attempt is sent. The next attempt of a
+// query to a resolver set is sent to the next server in the query's order.
+// Otherwise with Failover it is sent to the server after the one that failed.
+func (e Experiment) retry(r queryResult) (query, time.Duration, bool) {
+	if !e.retryable(r.Err) || r.Attempt >= e.maxAttempts() {
+		return query{}, 0, false
+	}
+	delay := e.backoff(r.Attempt + 1)
+	if time.Since(r.Started)+delay >= e.Timeout {
+		return query{}, 0, false
+	}
+	q := r.query
+	q.Attempt++
+	if len(q.Order) > 0 {
+		q.Server = q.Order[(q.Attempt-1)%len(q.Order)]
+	} else if e.Failover {
+		q.Server = e.nextServer(q.Server)
+	}
+	return q, delay, true
+}
+
+// A clientQuery is the state shared by the attempts of one query. It decides
+// which attempt's outcome is the effective outcome a client sees.
+type clientQuery struct {
+	sync.Mutex
+	// pending is the number of attempts that have been sent, or will be, and
+	// haven't completed.
+	pending int
+	// decided is whether an attempt's outcome has become the effective
+	// outcome.
+	decided bool
+	// hedged is whether the hedge of a hedged query has been sent.
+	hedged bool
+}
+
+// settle records that the attempt of the given result has completed and
+// decides what follows it. The result's Retried flag is set if another attempt
+// follows it and its Superseded flag if the effective outcome had already been
+// decided. It returns the next attempt to send and how long to wait before
+// sending it, if there is one.
+//
+// A hedged query's effective outcome is that of the first attempt that
+// succeeds or fails with an outcome that isn't retried, or otherwise of the
+// last attempt. If the first server fails before the HedgeDelay the query is
+// hedged at once. Other queries follow the retry policy.
+func (e Experiment) settle(r *queryResult) (query, time.Duration, bool) {
+	cq := r.client
+	cq.Lock()
+	defer cq.Unlock()
+	cq.pending--
+	if cq.decided {
+		r.Superseded = true
+		return query{}, 0, false
+	}
+	if !e.hedging() {
+		next, delay, retry := e.retry(*r)
+		if retry {
+			cq.pending++
+			r.Retried = true
+			return next, delay, true
+		}
+		cq.decided = true
+		return query{}, 0, false
+	}
+
+	switch {
+	case !e.retryable(r.Err):
+		cq.decided = true
+	case !cq.hedged:
+		cq.hedged = true
+		cq.pending++
+		r.Retried = true
+		return e.hedge(r.query, r.Started), 0, true
+	case cq.pending > 0:
+		// The hedge may still succeed.
+		r.Retried = true
+	default:
+		cq.decided = true
+	}
+	return query{}, 0, false
+}
+
+// hedge returns the hedge of the given query whose first attempt was sent at
+// started: the same query sent to the second server of its order.
+func (e Experiment) hedge(q query, started time.Time) query {
+	q.Attempt = 2
+	q.Server = q.Order[1]
+	q.Hedge = true
+	q.Started = started
+	return q
+}
+
+// hedgeMinSamples is the number of results from a server needed before a
+// HedgePercentile of its latency is used as the hedge delay.
+const hedgeMinSamples = 100
+
+// hedgeDelay returns how long a hedged query first sent to the given server
+// waits before it is hedged: the HedgePercentile of the server's latency so
+// far, or the HedgeDelay without a HedgePercentile or until the server has
+// hedgeMinSamples results.
+func (e Experiment) hedgeDelay(s server) time.Duration {
+	if e.HedgePercentile <= 0 {
+		return e.HedgeDelay
+	}
+	delay, samples := e.summary.latencyQuantile(s.address, e.HedgePercentile)
+	if samples < hedgeMinSamples {
+		return e.HedgeDelay
+	}
+	return delay
+}
+
+// hedgeAfter sends the hedge of the query of the given result, the first
+// attempt of a hedged query, if the query is still waiting for an answer once
+// the hedge delay has passed. The hedge is added to the WaitGroup and sent
+// with run.
+func (e Experiment) hedgeAfter(r queryResult, wg *sync.WaitGroup, run func(query)) {
+	time.AfterFunc(e.hedgeDelay(r.Server), func() {
+		cq := r.client
+		cq.Lock()
+		// An attempt is pending until its result is settled, so the first
+		// attempt still holds the WaitGroup when the hedge is added.
+		send := !cq.decided && !cq.hedged && cq.pending > 0
+		if send {
+			cq.hedged = true
+			cq.pending++
+			wg.Add(1)
+		}
+		cq.Unlock()
+		if send {
+			run(e.hedge(r.query, r.Started))
+		}
+	})
+}
+
+// recordHedge updates the hedging statistics for the result of an attempt of a
+// hedged query. The first attempt's result is what a client that doesn't
+// hedge would have seen, so its latency is recorded as the unhedged latency of
+// the resolver set. A hedge is counted as an extra query, and as won if its
+// result was the query's effective result.
+func (e Experiment) recordHedge(r queryResult) {
+	switch {
+	case r.Attempt == 1:
+		e.summary.unhedgedCompleted(r.effectiveRTT())
+	case r.Hedge:
+		won := r.effective()
+		stats.hedges.With(prom.Labels{
+			"server": r.Server.address,
+			"won":    strconv.FormatBool(won),
+		}).Inc()
+		e.summary.hedgeCompleted(won)
+	}
+}
+
+// nextServer returns the server after the given one in the Experiment's
+// servers, wrapping around at the end.
+func (e Experiment) nextServer(s server) server {
+	for i, srv := range e.servers {
+		if srv.address == s.address {
+			return e.servers[(i+1)%len(e.servers)]
+		}
+	}
+	return s
+}
@@ -0,0 +1,216 @@
+package dnslol
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestAttemptTimeout(t *testing.T) {
+	testCases := []struct {
+		name           string
+		attemptTimeout time.Duration
+		elapsed        time.Duration
+		expected       time.Duration
+	}{
+		{name: "first attempt", expected: time.Second},
+		{name: "first attempt with an attempt timeout", attemptTimeout: 200 * time.Millisecond, expected: 200 * time.Millisecond},
+		{name: "retry within the attempt timeout", attemptTimeout: 200 * time.Millisecond, elapsed: 500 * time.Millisecond, expected: 200 * time.Millisecond},
+		{name: "retry limited by the timeout", attemptTimeout: 200 * time.Millisecond, elapsed: 900 * time.Millisecond, expected: 100 * time.Millisecond},
+		{name: "retry after the timeout", elapsed: 1500 * time.Millisecond, expected: -500 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := Experiment{Timeout: time.Second, AttemptTimeout: tc.attemptTimeout}
+			var started time.Time
+			if tc.elapsed > 0 {
+				started = time.Now().Add(-tc.elapsed)
+			}
+			timeout := e.attemptTimeout(started)
+			if diff := timeout - tc.expected; diff < -10*time.Millisecond || diff > 10*time.Millisecond {
+				t.Errorf("expected an attempt timeout of about %s, got %s", tc.expected, timeout)
+			}
+		})
+	}
+}
+
+func TestExpireAttempt(t *testing.T) {
+	e := Experiment{MaxQueries: 1}
+	e.stopConditions = newStopConditions(e)
+	b := testBreaker("127.0.0.1:53", 1, 0)
+	b.record(false, rcodeError(dns.RcodeServerFailure))
+	// The breaker's cooldown has passed, so the attempt is its probe.
+	if ok, reason := e.stopConditions.reserve(); !ok || reason == "" {
+		t.Fatalf("expected to reserve the last query of the budget, got %v", ok)
+	}
+	allowed, probe := b.allow()
+	if !allowed || !probe {
+		t.Fatalf("expected the half-open breaker to allow a probe, got %v, %v", allowed, probe)
+	}
+
+	err := e.expireAttempt(b, probe)
+	if class := outcome(err); class != outcomeTimeout {
+		t.Errorf("expected outcome %q, got %q", outcomeTimeout, class)
+	}
+	if phase := timeoutPhase(err); phase != phaseTotal {
+		t.Errorf("expected timeout phase %q, got %q", phaseTotal, phase)
+	}
+	if !errors.Is(err, errAttemptExpired) {
+		t.Errorf("expected errAttemptExpired, got %v", err)
+	}
+	if ok, _ := e.stopConditions.reserve(); !ok {
+		t.Errorf("expected the expired attempt's query to be refunded to the budget")
+	}
+	if allowed, probe := b.allow(); !allowed || !probe {
+		t.Errorf("expected the breaker to allow another probe, got %v, %v", allowed, probe)
+	}
+}
+
+func TestRetrySet(t *testing.T) {
+	testCases := []struct {
+		name     string
+		retryOn  []string
+		expected []string
+		wantErr  bool
+	}{
+		{name: "default", expected: []string{outcomeTimeout, "servfail", outcomeConnRefused, outcomeUnreachable, outcomeConnClosed, outcomeNetwork}},
+		{name: "rcodes and classes", retryOn: []string{" REFUSED", "truncated", ""}, expected: []string{"refused", outcomeTruncated}},
+		{name: "unknown outcome", retryOn: []string{"flaky"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			set, err := retrySet(tc.retryOn)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected an error %v, got %v", tc.wantErr, err)
+			}
+			if len(set) != len(tc.expected) {
+				t.Errorf("expected %d retried outcomes, got %v", len(tc.expected), set)
+			}
+			for _, class := range tc.expected {
+				if !set[class] {
+					t.Errorf("expected %q to be retried, got %v", class, set)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	e := Experiment{RetryBackoff: 100 * time.Millisecond}
+	testCases := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 2, expected: 100 * time.Millisecond},
+		{attempt: 3, expected: 200 * time.Millisecond},
+		{attempt: 5, expected: 800 * time.Millisecond},
+		{attempt: 100, expected: 100 * time.Millisecond << 16},
+	}
+	for _, tc := range testCases {
+		if backoff := e.backoff(tc.attempt); backoff != tc.expected {
+			t.Errorf("expected a backoff of %s before attempt %d, got %s", tc.expected, tc.attempt, backoff)
+		}
+	}
+}
+
+// retryExperiment returns an Experiment retrying the default outcomes over
+// two servers.
+func retryExperiment(t *testing.T, attempts int, failover bool) Experiment {
+	t.Helper()
+	e := Experiment{
+		Timeout:  time.Second,
+		Attempts: attempts,
+		Failover: failover,
+		servers:  []server{{address: "a"}, {address: "b"}},
+	}
+	var err error
+	if e.retryOn, err = retrySet(nil); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestRetry(t *testing.T) {
+	servfail := rcodeError(dns.RcodeServerFailure)
+	testCases := []struct {
+		name       string
+		attempts   int
+		failover   bool
+		attempt    int
+		elapsed    time.Duration
+		err        error
+		wantRetry  bool
+		wantServer string
+	}{
+		{name: "success", attempts: 3, attempt: 1, err: nil},
+		{name: "NXDOMAIN isn't retried", attempts: 3, attempt: 1, err: rcodeError(dns.RcodeNameError)},
+		{name: "SERVFAIL", attempts: 3, attempt: 1, err: servfail, wantRetry: true, wantServer: "a"},
+		{name: "SERVFAIL with failover", attempts: 3, failover: true, attempt: 1, err: servfail, wantRetry: true, wantServer: "b"},
+		{name: "last attempt", attempts: 3, attempt: 3, err: servfail},
+		{name: "no retries", attempts: 0, attempt: 1, err: servfail},
+		{name: "timeout passed", attempts: 3, attempt: 1, elapsed: time.Second, err: servfail},
+		{name: "skipped by a breaker", attempts: 3, attempt: 1, err: &queryError{class: outcomeSkipped, err: errBreakerOpen}},
+		{name: "skipped by a breaker with failover", attempts: 3, failover: true, attempt: 1, err: &queryError{class: outcomeSkipped, err: errBreakerOpen}, wantRetry: true, wantServer: "b"},
+		{name: "query budget used up", attempts: 3, failover: true, attempt: 1, err: &queryError{class: outcomeSkipped, err: errQueryBudget}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := retryExperiment(t, tc.attempts, tc.failover)
+			r := queryResult{
+				query: query{Server: e.servers[0], Attempt: tc.attempt, Started: time.Now().Add(-tc.elapsed)},
+				Err:   tc.err,
+			}
+			next, _, retry := e.retry(r)
+			if retry != tc.wantRetry {
+				t.Fatalf("expected retry %v, got %v", tc.wantRetry, retry)
+			}
+			if !retry {
+				return
+			}
+			if next.Attempt != tc.attempt+1 {
+				t.Errorf("expected attempt %d, got %d", tc.attempt+1, next.Attempt)
+			}
+			if next.Server.address != tc.wantServer {
+				t.Errorf("expected the retry to go to %q, got %q", tc.wantServer, next.Server.address)
+			}
+		})
+	}
+}
+
+func TestSettleRetries(t *testing.T) {
+	servfail := rcodeError(dns.RcodeServerFailure)
+	testCases := []struct {
+		name string
+		// errs are the outcomes of the query's attempts in order.
+		errs []error
+		// retried is which of the attempts are marked retried.
+		retried []bool
+	}{
+		{name: "first attempt succeeds", errs: []error{nil}, retried: []bool{false}},
+		{name: "retry succeeds", errs: []error{servfail, nil}, retried: []bool{true, false}},
+		{name: "every attempt fails", errs: []error{servfail, servfail, servfail}, retried: []bool{true, true, false}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := retryExperiment(t, 3, false)
+			cq := &clientQuery{pending: 1}
+			q := query{Server: e.servers[0], Attempt: 1, Started: time.Now(), client: cq}
+			for i, err := range tc.errs {
+				r := queryResult{query: q, Err: err}
+				next, _, more := e.settle(&r)
+				if r.Retried != tc.retried[i] || more != tc.retried[i] {
+					t.Fatalf("expected attempt %d retried %v, got %v (next attempt %v)", i+1, tc.retried[i], r.Retried, more)
+				}
+				if r.Superseded {
+					t.Errorf("expected attempt %d not to be superseded", i+1)
+				}
+				q = next
+			}
+			if !cq.decided || cq.pending != 0 {
+				t.Errorf("expected a decided query without pending attempts, got decided %v with %d pending", cq.decided, cq.pending)
+			}
+		})
+	}
+}
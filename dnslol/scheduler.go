@@ -0,0 +1,160 @@
+package dnslol
+
+import (
+	"errors"
+	"sync"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// fdReserve is the number of file descriptors budgeted for everything
+	// other than query sockets and database connections: the standard streams,
+	// the metrics, lookup service and coordinator listeners and their
+	// connections, and input and output files.
+	fdReserve = 64
+)
+
+// validInflight checks the Experiment's MaxInflight and ServerMaxInflight
+// settings.
+func (e Experiment) validInflight() error {
+	if e.MaxInflight < 0 || e.ServerMaxInflight < 0 {
+		return errors.New(
+			"Experiment must not have a negative MaxInflight or ServerMaxInflight")
+	}
+	return nil
+}
+
+// inflightLimits returns the most queries the Experiment has in flight at once
+// across all servers and to each server. Without a MaxInflight the global
+// limit is the number of queries for Parallel names, and without a
+// ServerMaxInflight each server gets an equal share of the global limit.
+func (e Experiment) inflightLimits() (global, perServer int) {
+	global = e.MaxInflight
+	if global == 0 {
+		types := len(e.queryTypes())
+		if types == 0 {
+			types = 1
+		}
+		global = e.Parallel * len(e.Servers) * types * e.Count
+	}
+	perServer = e.ServerMaxInflight
+	if perServer == 0 && len(e.Servers) > 0 {
+		perServer = (global + len(e.Servers) - 1) / len(e.Servers)
+	}
+	if perServer > global || perServer == 0 {
+		perServer = global
+	}
+	return global, perServer
+}
+
+// FDBudget returns the most file descriptors the Experiment can have open at
+// once when it uses the given number of database connections. Without
+// PoolConns every query in flight uses its own socket, so this is the in-flight
+// query limit plus the database connections and a reserve for everything else.
+// With PoolConns the pooled connections are counted instead of the queries.
+func (e Experiment) FDBudget(dbConns int) int {
+	global, perServer := e.inflightLimits()
+	queries := global
+	if n := perServer * len(e.Servers); n < queries {
+		queries = n
+	}
+	if e.PoolConns > 0 {
+		queries = e.PoolConns * len(e.Servers)
+	}
+	return queries + dbConns + fdReserve
+}
+
+// A scheduler runs the Experiment's queries with a bounded pool of goroutines
+// for each server, so that at most the per-server limit of queries are in
+// flight to each server, and a semaphore limiting the queries in flight across
+// all servers. Queries wait in their server's queue for a goroutine, so a slow
+// server only holds up the queries queued for it.
+type scheduler struct {
+	// global holds a token for each query in flight.
+	global chan struct{}
+	pools  map[string]*serverPool
+}
+
+// newScheduler creates a scheduler for the Experiment's servers and in-flight
+// limits.
+func newScheduler(e Experiment) *scheduler {
+	global, perServer := e.inflightLimits()
+	s := &scheduler{
+		global: make(chan struct{}, global),
+		pools:  make(map[string]*serverPool, len(e.servers)),
+	}
+	for _, srv := range e.servers {
+		s.pools[srv.address] = &serverPool{
+			limit:  perServer,
+			queued: stats.queued.With(prom.Labels{"server": srv.address}),
+		}
+	}
+	stats.inflightLimit.Set(float64(global))
+	stats.serverInflightLimit.Set(float64(perServer))
+	return s
+}
+
+// submit queues the given job, which performs one query, on the pool of the
+// server with the given address.
+func (s *scheduler) submit(address string, job func()) {
+	s.pools[address].submit(job)
+}
+
+// acquire blocks until fewer than the global limit of queries are in flight.
+// The caller must call release once its query is complete.
+func (s *scheduler) acquire() {
+	s.global <- struct{}{}
+}
+
+// release ends a query started after acquire.
+func (s *scheduler) release() {
+	<-s.global
+}
+
+// serverPool runs the queued jobs for one server on at most limit goroutines.
+// Goroutines are started as jobs are queued and exit when the queue is empty,
+// so an idle pool has no goroutines.
+type serverPool struct {
+	limit int
+	// queued is the metric for the number of jobs waiting in the queue.
+	queued prom.Gauge
+
+	mu      sync.Mutex
+	running int
+	jobs    []func()
+}
+
+// submit adds a job to the queue, starting a goroutine to run it if the pool
+// has fewer than limit.
+func (p *serverPool) submit(job func()) {
+	p.mu.Lock()
+	p.jobs = append(p.jobs, job)
+	p.queued.Set(float64(len(p.jobs)))
+	start := p.running < p.limit
+	if start {
+		p.running++
+	}
+	p.mu.Unlock()
+	if start {
+		go p.work()
+	}
+}
+
+// work runs queued jobs until the queue is empty.
+func (p *serverPool) work() {
+	for {
+		p.mu.Lock()
+		if len(p.jobs) == 0 {
+			p.running--
+			p.mu.Unlock()
+			return
+		}
+		job := p.jobs[0]
+		p.jobs[0] = nil
+		p.jobs = p.jobs[1:]
+		p.queued.Set(float64(len(p.jobs)))
+		p.mu.Unlock()
+		job()
+	}
+}
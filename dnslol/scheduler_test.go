@@ -0,0 +1,286 @@
+package dnslol
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+func TestInflightLimits(t *testing.T) {
+	testCases := []struct {
+		name              string
+		exp               Experiment
+		expectedGlobal    int
+		expectedPerServer int
+	}{
+		{
+			name: "queries for parallel names",
+			exp: Experiment{
+				Parallel: 1000, Servers: []string{"a", "b"}, CheckA: true, CheckTXT: true, Count: 1,
+			},
+			expectedGlobal:    4000,
+			expectedPerServer: 2000,
+		},
+		{
+			name: "count",
+			exp: Experiment{
+				Parallel: 10, Servers: []string{"a"}, CheckA: true, Count: 3,
+			},
+			expectedGlobal:    30,
+			expectedPerServer: 30,
+		},
+		{
+			name: "max inflight shared by servers",
+			exp: Experiment{
+				Parallel: 10, Servers: []string{"a", "b", "c"}, CheckA: true, Count: 1, MaxInflight: 100,
+			},
+			expectedGlobal:    100,
+			expectedPerServer: 34,
+		},
+		{
+			name: "server max inflight",
+			exp: Experiment{
+				Parallel: 10, Servers: []string{"a", "b"}, CheckA: true, Count: 1,
+				MaxInflight: 100, ServerMaxInflight: 20,
+			},
+			expectedGlobal:    100,
+			expectedPerServer: 20,
+		},
+		{
+			name: "server max inflight above max inflight",
+			exp: Experiment{
+				Parallel: 10, Servers: []string{"a", "b"}, CheckA: true, Count: 1,
+				MaxInflight: 100, ServerMaxInflight: 500,
+			},
+			expectedGlobal:    100,
+			expectedPerServer: 100,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			global, perServer := tc.exp.inflightLimits()
+			if global != tc.expectedGlobal || perServer != tc.expectedPerServer {
+				t.Errorf("expected limits %d/%d, got %d/%d",
+					tc.expectedGlobal, tc.expectedPerServer, global, perServer)
+			}
+		})
+	}
+}
+
+func TestFDBudget(t *testing.T) {
+	testCases := []struct {
+		name     string
+		exp      Experiment
+		dbConns  int
+		expected int
+	}{
+		{
+			name: "queries in flight",
+			exp: Experiment{
+				Parallel: 100, Servers: []string{"a", "b"}, CheckA: true, Count: 1,
+			},
+			dbConns:  10,
+			expected: 200 + 10 + fdReserve,
+		},
+		{
+			name: "per-server limit",
+			exp: Experiment{
+				Parallel: 100, Servers: []string{"a", "b"}, CheckA: true, Count: 1,
+				ServerMaxInflight: 30,
+			},
+			expected: 60 + fdReserve,
+		},
+		{
+			name: "pooled connections",
+			exp: Experiment{
+				Parallel: 100, Servers: []string{"a", "b"}, CheckA: true, Count: 1,
+				PoolConns: 4,
+			},
+			dbConns:  10,
+			expected: 8 + 10 + fdReserve,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.exp.FDBudget(tc.dbConns); got != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, got)
+			}
+		})
+	}
+}
+
+// testPool returns an empty serverPool with the given limit.
+func testPool(limit int) *serverPool {
+	return &serverPool{
+		limit:  limit,
+		queued: prom.NewGauge(prom.GaugeOpts{Name: "queued"}),
+	}
+}
+
+// concurrency tracks how many jobs are running at once.
+type concurrency struct {
+	running, max int64
+}
+
+// start records that a job started.
+func (c *concurrency) start() {
+	n := atomic.AddInt64(&c.running, 1)
+	for {
+		max := atomic.LoadInt64(&c.max)
+		if n <= max || atomic.CompareAndSwapInt64(&c.max, max, n) {
+			return
+		}
+	}
+}
+
+// stop records that a job stopped.
+func (c *concurrency) stop() {
+	atomic.AddInt64(&c.running, -1)
+}
+
+func TestServerPool(t *testing.T) {
+	const limit, jobs = 3, 20
+	p := testPool(limit)
+	var c concurrency
+	var wg sync.WaitGroup
+	unblock := make(chan struct{})
+	var ran int64
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		p.submit(func() {
+			defer wg.Done()
+			c.start()
+			defer c.stop()
+			<-unblock
+			atomic.AddInt64(&ran, 1)
+		})
+	}
+
+	p.mu.Lock()
+	running, queued := p.running, len(p.jobs)
+	p.mu.Unlock()
+	if running != limit {
+		t.Errorf("expected %d goroutines, got %d", limit, running)
+	}
+	if queued < jobs-limit {
+		t.Errorf("expected at least %d queued jobs, got %d", jobs-limit, queued)
+	}
+
+	close(unblock)
+	wg.Wait()
+	if ran != jobs {
+		t.Errorf("expected %d jobs to run, got %d", jobs, ran)
+	}
+	if c.max > limit {
+		t.Errorf("expected at most %d jobs at once, got %d", limit, c.max)
+	}
+
+	// The goroutines exit once the queue is empty.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		running = p.running
+		p.mu.Unlock()
+		if running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected idle pool to have no goroutines, got %d", running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerAcquire(t *testing.T) {
+	s := newScheduler(Experiment{
+		Servers:     []string{"a"},
+		MaxInflight: 2,
+		servers:     []server{{address: "a"}},
+	})
+	s.acquire()
+	s.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		s.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected acquire to block at the global limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected acquire to return after a release")
+	}
+}
+
+func TestSchedulerSlowServer(t *testing.T) {
+	s := newScheduler(Experiment{
+		Servers:           []string{"slow", "fast"},
+		MaxInflight:       4,
+		ServerMaxInflight: 2,
+		servers:           []server{{address: "slow"}, {address: "fast"}},
+	})
+
+	// The slow server's queries don't complete until the end of the test.
+	var slow concurrency
+	unblock := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		s.submit("slow", func() {
+			defer wg.Done()
+			s.acquire()
+			defer s.release()
+			slow.start()
+			defer slow.stop()
+			<-unblock
+		})
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&slow.running) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected 2 of the slow server's queries to be in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The fast server's queries complete while the slow server's are stuck.
+	var fast sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		fast.Add(1)
+		s.submit("fast", func() {
+			defer fast.Done()
+			s.acquire()
+			s.release()
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		fast.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the fast server's queries not to wait for the slow server's")
+	}
+	if n := atomic.LoadInt64(&slow.running); n != 2 {
+		t.Errorf("expected 2 of the slow server's queries in flight, got %d", n)
+	}
+
+	close(unblock)
+	wg.Wait()
+	if slow.max > 2 {
+		t.Errorf("expected at most 2 of the slow server's queries at once, got %d", slow.max)
+	}
+}
@@ -0,0 +1,253 @@
+package dnslol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/letsencrypt/dns-lots-of-lookups/dnsname"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxLookupBody is the largest lookup request body accepted, in bytes.
+	maxLookupBody = 16 << 20
+)
+
+// lookupRequest is the JSON body of a request to the lookup service.
+type lookupRequest struct {
+	// The names to look up. Required.
+	Names []string `json:"names"`
+	// The query types to perform, e.g. "A" or "TXT". Optional, defaults to the
+	// types selected by the Experiment's CheckA, CheckAAAA and CheckTXT
+	// settings.
+	Types []string `json:"types"`
+	// The addresses of the servers to query. Optional, defaults to all of the
+	// Experiment's servers. Every address must be one of the Experiment's
+	// servers.
+	Servers []string `json:"servers"`
+}
+
+// lookupService serves lookups for batches of names over HTTP using an
+// Experiment's servers, metrics and result storage.
+type lookupService struct {
+	exp       Experiment
+	dnsClient *dns.Client
+	// requests limits the number of requests served at once.
+	requests chan struct{}
+}
+
+// validServe checks the lookup service settings of the Experiment.
+func (e Experiment) validServe() error {
+	if e.ServeAddr == "" {
+		return errors.New("Experiment must have a non-empty ServeAddr to serve lookups")
+	}
+	if e.ServeMaxRequests < 1 {
+		return errors.New("Experiment must have a ServeMaxRequests greater than 0")
+	}
+	if e.ServeConcurrency < 1 {
+		return errors.New("Experiment must have a ServeConcurrency greater than 0")
+	}
+	if e.ServeMaxNames < 1 {
+		return errors.New("Experiment must have a ServeMaxNames greater than 0")
+	}
+	return nil
+}
+
+// parse validates a lookupRequest and returns its names, normalized like the
+// names of the Experiment's input, and the query types and servers it
+// selects.
+func (ls *lookupService) parse(req lookupRequest) ([]string, []uint16, []server, error) {
+	if len(req.Names) == 0 {
+		return nil, nil, nil, errors.New("request must have at least one name")
+	}
+	if len(req.Names) > ls.exp.ServeMaxNames {
+		return nil, nil, nil, fmt.Errorf(
+			"request has %d names, the maximum is %d",
+			len(req.Names), ls.exp.ServeMaxNames)
+	}
+	names := make([]string, len(req.Names))
+	for i, name := range req.Names {
+		normalized, err := dnsname.Normalize(name, ls.exp.IDNA)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid name %q: %v", name, err)
+		}
+		names[i] = normalized
+	}
+
+	types := ls.exp.queryTypes()
+	if len(req.Types) > 0 {
+		types = nil
+		for _, t := range req.Types {
+			typ, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("unknown query type %q", t)
+			}
+			types = append(types, typ)
+		}
+	}
+
+	servers := ls.exp.servers
+	if len(req.Servers) > 0 {
+		servers = nil
+		for _, addr := range req.Servers {
+			srv, ok := ls.exp.serverByAddress(addr)
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("server %q is not one of the experiment's servers", addr)
+			}
+			servers = append(servers, srv)
+		}
+	}
+	return names, types, servers, nil
+}
+
+// serverByAddress returns the Experiment server with the given address. If the
+// address has no port the default DNS port is assumed.
+func (e Experiment) serverByAddress(addr string) (server, bool) {
+	if !strings.Contains(addr, ":") {
+		addr += ":53"
+	}
+	for _, srv := range e.servers {
+		if srv.address == addr {
+			return srv, true
+		}
+	}
+	return server{}, false
+}
+
+// ServeHTTP handles a POST of a JSON lookupRequest. The results are streamed
+// back as newline delimited JSON resultRecords, one per query, as the queries
+// complete. At most ServeConcurrency names from one request are looked up at
+// once and at most ServeMaxRequests requests are served at once.
+func (ls *lookupService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case ls.requests <- struct{}{}:
+		defer func() { <-ls.requests }()
+	default:
+		http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req lookupRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLookupBody)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	names, types, servers, err := ls.parse(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	handle := func(res queryResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(res.record()); err != nil {
+			// The client went away. The remaining results are still stored.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	ls.lookup(r.Context(), names, types, servers, handle)
+}
+
+// lookup performs the queries for each of the given names, with at most
+// ServeConcurrency names in progress at once. It stops starting new names if
+// ctx is cancelled.
+func (ls *lookupService) lookup(
+	ctx context.Context, names []string, types []uint16, servers []server,
+	handle func(queryResult)) {
+	sem := make(chan struct{}, ls.exp.ServeConcurrency)
+	var wg sync.WaitGroup
+	for _, name := range names {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			target := Target{Name: name, Types: types}
+			queries := ls.exp.buildQueries(target, servers)
+			ls.exp.runQuerySet(ls.dnsClient, queries, handle)
+			ls.exp.summary.nameFinished()
+		}(name)
+	}
+	wg.Wait()
+}
+
+// Serve runs the given Experiment as a long-running lookup service. Like Start
+// it initializes the Experiment and runs a metrics server with the status and
+// control API, but instead of reading names from a channel it accepts lookup
+// requests over HTTP on the Experiment's ServeAddr. Clients POST a JSON body
+// with the names (and optionally the types and servers) to look up to
+// /lookup and receive the results as a stream of newline delimited JSON
+// objects. Serve blocks until the Experiment is stopped through the control
+// API and all in-progress requests are complete. The Experiment's ramp
+// schedule and capacity search are not used by the lookup service.
+func Serve(e *Experiment, dsn string, maxConns int) error {
+	if err := e.validServe(); err != nil {
+		return err
+	}
+	if e.CapacitySearch {
+		return errors.New("Experiment can't use CapacitySearch to serve lookups")
+	}
+	dnsClient, err := e.setup(dsn, maxConns)
+	if err != nil {
+		return err
+	}
+	e.setRateLevel(1)
+	e.startMetrics()
+
+	mux := http.NewServeMux()
+	mux.Handle("/lookup", &lookupService{
+		exp:       *e,
+		dnsClient: dnsClient,
+		requests:  make(chan struct{}, e.ServeMaxRequests),
+	})
+	srv := &http.Server{
+		Addr:    e.ServeAddr,
+		Handler: mux,
+	}
+	// Shutdown waits for in-progress requests, but ListenAndServe returns as
+	// soon as it is called, so wait for Shutdown to finish before returning.
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-e.Stopped()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Printf("Error shutting down lookup service: %v\n", err)
+		}
+	}()
+
+	log.Printf("Serving lookups on %s\n", e.ServeAddr)
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-shutdown
+	return nil
+}
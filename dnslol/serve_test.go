@@ -0,0 +1,74 @@
+package dnslol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLookupServiceParse(t *testing.T) {
+	ls := &lookupService{exp: Experiment{
+		CheckA:        true,
+		ServeMaxNames: 2,
+		servers:       []server{{address: "127.0.0.1:53"}},
+	}}
+	testCases := []struct {
+		name      string
+		req       lookupRequest
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "valid names",
+			req:       lookupRequest{Names: []string{"Example.com.", "*.example.org"}},
+			wantNames: []string{"example.com", "example.org"},
+		},
+		{
+			name:    "no names",
+			req:     lookupRequest{},
+			wantErr: "at least one name",
+		},
+		{
+			name:    "too many names",
+			req:     lookupRequest{Names: []string{"a.com", "b.com", "c.com"}},
+			wantErr: "the maximum is 2",
+		},
+		{
+			name:    "empty name",
+			req:     lookupRequest{Names: []string{"a.com", ""}},
+			wantErr: `invalid name "": name is empty`,
+		},
+		{
+			name:    "unicode name without IDNA",
+			req:     lookupRequest{Names: []string{"bücher.example"}},
+			wantErr: "isn't ASCII encoded",
+		},
+		{
+			name:    "leading dots",
+			req:     lookupRequest{Names: []string{"..example.com"}},
+			wantErr: "empty label",
+		},
+		{
+			name:    "unknown server",
+			req:     lookupRequest{Names: []string{"a.com"}, Servers: []string{"10.0.0.1"}},
+			wantErr: "not one of the experiment's servers",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			names, _, _, err := ls.parse(tc.req)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(names, tc.wantNames) {
+				t.Errorf("expected names %q, got %q", tc.wantNames, names)
+			}
+		})
+	}
+}
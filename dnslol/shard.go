@@ -0,0 +1,137 @@
+package dnslol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// validShard checks the Experiment's Parent, Shard and Shards settings.
+func (e Experiment) validShard() error {
+	if e.Shards < 0 {
+		return errors.New("Experiment must not have a negative Shards")
+	}
+	if (e.Parent == "") != (e.Shards == 0) {
+		return errors.New("Experiment must have both a Parent and Shards or neither")
+	}
+	if e.Shards > 0 && (e.Shard < 0 || e.Shard >= e.Shards) {
+		return fmt.Errorf("Experiment must have a Shard between 0 and %d", e.Shards-1)
+	}
+	if len(e.Parent) > 255 {
+		return errors.New("Experiment must have a Parent of at most 255 characters")
+	}
+	return nil
+}
+
+// saveParent finds the parent experiment row with the Experiment's Parent
+// name, creating it if this is the first shard to start, and sets the
+// Experiment's parentID. An error is returned if the parent was created with a
+// different number of shards.
+func (e *Experiment) saveParent() error {
+	// The unique name makes the insert atomic when several shards start at
+	// once. LAST_INSERT_ID(id) returns the existing row's ID if there is one.
+	result, err := e.db.Exec(
+		"INSERT INTO experiments (`name`, `start`, `commandline`, `shards`) VALUES (?, ?, ?, ?) "+
+			"ON DUPLICATE KEY UPDATE `id`=LAST_INSERT_ID(`id`);",
+		e.Parent,
+		time.Now(),
+		e.CommandLine,
+		e.Shards)
+	if err != nil {
+		return err
+	}
+	if e.parentID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	var shards int
+	err = e.db.QueryRow(
+		`SELECT shards FROM experiments WHERE id=?;`, e.parentID).Scan(&shards)
+	if err != nil {
+		return err
+	}
+	if shards != e.Shards {
+		return fmt.Errorf(
+			"parent experiment %q has %d shards, not %d", e.Parent, shards, e.Shards)
+	}
+	return nil
+}
+
+// aggregateShards merges the summaries of the finished shards of the
+// Experiment's parent and stores the result as the parent's summary, logging
+// it. The parent's end date is set once every shard has finished. If a shard
+// was run more than once only its latest run is included.
+func (e Experiment) aggregateShards() error {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback does nothing once the transaction is committed.
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Lock the parent row so that shards finishing at the same time aggregate
+	// one after the other and the last sees all of the others.
+	var shards int
+	err = tx.QueryRow(
+		`SELECT shards FROM experiments WHERE id=? FOR UPDATE;`, e.parentID).Scan(&shards)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(
+		`SELECT shard, summaryState FROM experiments WHERE parentID=? AND end IS NOT NULL AND summaryState IS NOT NULL ORDER BY id;`,
+		e.parentID)
+	if err != nil {
+		return err
+	}
+	states := make(map[int][]byte)
+	for rows.Next() {
+		var shard int
+		var state []byte
+		if err := rows.Scan(&shard, &state); err != nil {
+			rows.Close()
+			return err
+		}
+		states[shard] = state
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	total := &runSummary{servers: make(map[string]*serverSummary)}
+	for shard, state := range states {
+		var rs runSummary
+		if err := json.Unmarshal(state, &rs); err != nil {
+			return fmt.Errorf("decoding summary of shard %d: %v", shard, err)
+		}
+		total.merge(&rs)
+	}
+	summary := fmt.Sprintf("Shards: %d of %d finished\n", len(states), shards) + total.String()
+
+	var end *time.Time
+	if len(states) >= shards {
+		now := time.Now()
+		end = &now
+	}
+	_, err = tx.Exec(
+		`UPDATE experiments SET end=?, summary=? WHERE id=?;`,
+		end,
+		summary,
+		e.parentID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Summary of experiment %q:\n%s", e.Parent, summary)
+	return nil
+}
@@ -0,0 +1,29 @@
+package dnslol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidShard(t *testing.T) {
+	testCases := []struct {
+		name    string
+		exp     Experiment
+		wantErr bool
+	}{
+		{name: "unsharded", exp: Experiment{}},
+		{name: "sharded", exp: Experiment{Parent: "sweep", Shard: 2, Shards: 3}},
+		{name: "parent without shards", exp: Experiment{Parent: "sweep"}, wantErr: true},
+		{name: "shards without parent", exp: Experiment{Shards: 3}, wantErr: true},
+		{name: "shard out of range", exp: Experiment{Parent: "sweep", Shard: 3, Shards: 3}, wantErr: true},
+		{name: "negative shards", exp: Experiment{Parent: "sweep", Shards: -1}, wantErr: true},
+		{name: "long parent", exp: Experiment{Parent: strings.Repeat("p", 256), Shards: 1}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.exp.validShard(); (err != nil) != tc.wantErr {
+				t.Errorf("expected an error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
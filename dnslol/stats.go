@@ -2,6 +2,7 @@ package dnslol
 
 import (
 	"net/http"
+	"time"
 
 	prom "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -13,42 +14,213 @@ import (
 type dnsStats struct {
 	attempts    *prom.CounterVec
 	successes   *prom.CounterVec
-	queryTimes  *prom.SummaryVec
+	queryTimes  *prom.HistogramVec
+	sendDelays  *prom.HistogramVec
 	results     *prom.CounterVec
+	effective   *prom.CounterVec
+	hedges      *prom.CounterVec
+	inflight    *prom.GaugeVec
+	timeouts    *prom.CounterVec
 	commandLine *prom.GaugeVec
+
+	queued              *prom.GaugeVec
+	inflightLimit       prom.Gauge
+	serverInflightLimit prom.Gauge
+	fdBudget            prom.Gauge
+
+	poolConns          *prom.GaugeVec
+	poolQueries        *prom.CounterVec
+	outOfOrder         *prom.CounterVec
+	unmatchedResponses *prom.CounterVec
+
+	breakerState *prom.GaugeVec
+
+	searchRate        *prom.GaugeVec
+	searchSustainable *prom.GaugeVec
+
+	eventSubscribers prom.Gauge
+	eventsDropped    prom.Counter
+
+	leases      *prom.CounterVec
+	leasedNames prom.Gauge
+	workers     prom.Gauge
 }
 
+// queryLabels are the label names used by the per-query metrics.
+var queryLabels = []string{"server", "type", "transport", "tld"}
+
 var (
 	stats = &dnsStats{
 		attempts: promauto.NewCounterVec(prom.CounterOpts{
 			Name: "attempts",
 			Help: "number of lookup attempts",
-		}, []string{"server"}),
+		}, queryLabels),
 		successes: promauto.NewCounterVec(prom.CounterOpts{
 			Name: "successes",
 			Help: "number of lookup successes",
-		}, []string{"server"}),
-		queryTimes: promauto.NewSummaryVec(prom.SummaryOpts{
-			Name: "queryTime",
-			Help: "amount of time queries take (seconds)",
-		}, []string{"server", "type"}),
+		}, queryLabels),
 		results: promauto.NewCounterVec(prom.CounterOpts{
 			Name: "results",
 			Help: "lookup results",
-		}, []string{"server", "result"}),
+		}, append([]string{"result"}, queryLabels...)),
+		effective: promauto.NewCounterVec(prom.CounterOpts{
+			Name: "effectiveResults",
+			Help: "lookup results seen by clients after retries, by the server first queried",
+		}, append([]string{"result"}, queryLabels...)),
+		hedges: promauto.NewCounterVec(prom.CounterOpts{
+			Name: "hedges",
+			Help: "number of hedged lookups sent to the second server, by whether they were answered first",
+		}, []string{"server", "won"}),
+		inflight: promauto.NewGaugeVec(prom.GaugeOpts{
+			Name: "inflight",
+			Help: "number of lookups waiting for a response",
+		}, []string{"server"}),
+		timeouts: promauto.NewCounterVec(prom.CounterOpts{
+			Name: "timeouts",
+			Help: "number of lookups that timed out, by the phase that timed out",
+		}, []string{"server", "phase"}),
 		commandLine: promauto.NewGaugeVec(prom.GaugeOpts{
 			Name: "commandLine",
 			Help: "command line",
 		}, []string{"line"}),
+		queued: promauto.NewGaugeVec(prom.GaugeOpts{
+			Name: "queued",
+			Help: "number of lookups waiting for one of the server's in-flight slots",
+		}, []string{"server"}),
+		inflightLimit: promauto.NewGauge(prom.GaugeOpts{
+			Name: "inflightLimit",
+			Help: "most lookups in flight at once across all servers",
+		}),
+		serverInflightLimit: promauto.NewGauge(prom.GaugeOpts{
+			Name: "serverInflightLimit",
+			Help: "most lookups in flight at once to each server",
+		}),
+		fdBudget: promauto.NewGauge(prom.GaugeOpts{
+			Name: "fdBudget",
+			Help: "most file descriptors the experiment can have open at once",
+		}),
+		poolConns: promauto.NewGaugeVec(prom.GaugeOpts{
+			Name: "poolConns",
+			Help: "number of open pooled connections",
+		}, []string{"server"}),
+		poolQueries: promauto.NewCounterVec(prom.CounterOpts{
+			Name: "poolQueries",
+			Help: "number of pooled lookups sent on a new or a reused connection",
+		}, []string{"server", "conn"}),
+		outOfOrder: promauto.NewCounterVec(prom.CounterOpts{
+			Name: "outOfOrder",
+			Help: "number of pooled responses received before the response to an earlier query on the connection",
+		}, []string{"server"}),
+		unmatchedResponses: promauto.NewCounterVec(prom.CounterOpts{
+			Name: "unmatchedResponses",
+			Help: "number of pooled responses that didn't match a waiting query, e.g. late responses",
+		}, []string{"server"}),
+		breakerState: promauto.NewGaugeVec(prom.GaugeOpts{
+			Name: "breakerState",
+			Help: "state of the server's circuit breaker: 0 closed, 1 open, 2 half-open",
+		}, []string{"server"}),
+		searchRate: promauto.NewGaugeVec(prom.GaugeOpts{
+			Name: "searchRate",
+			Help: "QPS currently offered by the capacity search",
+		}, []string{"server"}),
+		searchSustainable: promauto.NewGaugeVec(prom.GaugeOpts{
+			Name: "searchSustainable",
+			Help: "highest QPS found by the capacity search that met the SLO",
+		}, []string{"server"}),
+		eventSubscribers: promauto.NewGauge(prom.GaugeOpts{
+			Name: "eventSubscribers",
+			Help: "number of clients subscribed to the result event stream",
+		}),
+		eventsDropped: promauto.NewCounter(prom.CounterOpts{
+			Name: "eventsDropped",
+			Help: "number of result events dropped because a subscriber fell behind",
+		}),
+		leases: promauto.NewCounterVec(prom.CounterOpts{
+			Name: "leases",
+			Help: "number of coordinator leases granted, extended, completed, expired or rejected",
+		}, []string{"event"}),
+		leasedNames: promauto.NewGauge(prom.GaugeOpts{
+			Name: "leasedNames",
+			Help: "number of names leased to workers by the coordinator and not yet completed",
+		}),
+		workers: promauto.NewGauge(prom.GaugeOpts{
+			Name: "workers",
+			Help: "number of workers that contacted the coordinator within the lease timeout",
+		}),
 	}
 )
 
+const (
+	// nativeMaxBuckets is the most buckets a native latency histogram has
+	// before its resolution is reduced.
+	nativeMaxBuckets = 160
+	// nativeResetInterval is the shortest interval between resets of a native
+	// latency histogram that has too many buckets.
+	nativeResetInterval = time.Hour
+)
+
+// DefaultLatencyBuckets are the histogram buckets used for the latency metrics
+// when an Experiment doesn't specify any LatencyBuckets. They range from 1ms to
+// roughly 33s.
+var DefaultLatencyBuckets = durations(prom.ExponentialBuckets(0.001, 2, 16))
+
+// durations converts a slice of seconds to a slice of time.Durations.
+func durations(seconds []float64) []time.Duration {
+	result := make([]time.Duration, len(seconds))
+	for i, s := range seconds {
+		result[i] = time.Duration(s * float64(time.Second))
+	}
+	return result
+}
+
+// initLatencyMetrics creates and registers the latency histograms using the
+// given buckets. If nativeFactor is greater than 1 the histograms are also
+// native histograms whose buckets grow by at most that factor. It must be
+// called before any queries are performed. Metrics can only be registered
+// once per process, so later calls have no effect.
+func initLatencyMetrics(buckets []time.Duration, nativeFactor float64) {
+	if stats.queryTimes != nil {
+		return
+	}
+	seconds := make([]float64, len(buckets))
+	for i, b := range buckets {
+		seconds[i] = b.Seconds()
+	}
+	stats.queryTimes = promauto.NewHistogramVec(latencyHistogramOpts(prom.HistogramOpts{
+		Name:    "queryTime",
+		Help:    "amount of time queries take (seconds)",
+		Buckets: seconds,
+	}, nativeFactor), queryLabels)
+	stats.sendDelays = promauto.NewHistogramVec(latencyHistogramOpts(prom.HistogramOpts{
+		Name:    "sendDelay",
+		Help:    "amount of time between when queries were scheduled and sent (seconds)",
+		Buckets: seconds,
+	}, nativeFactor), []string{"server"})
+}
+
+// latencyHistogramOpts returns the given options of a latency histogram with
+// native buckets growing by at most nativeFactor if it is greater than 1. To
+// bound their memory the native buckets of each histogram are limited to
+// nativeMaxBuckets and reset at most every nativeResetInterval.
+func latencyHistogramOpts(opts prom.HistogramOpts, nativeFactor float64) prom.HistogramOpts {
+	if nativeFactor > 1 {
+		opts.NativeHistogramBucketFactor = nativeFactor
+		opts.NativeHistogramMaxBucketNumber = nativeMaxBuckets
+		opts.NativeHistogramMinResetDuration = nativeResetInterval
+	}
+	return opts
+}
+
 // initMetrics creates an HTTP server listening on the provided addr with
-// a Prometheus handler registered for the /metrics URL path. The return server
-// is not started for the caller.
-func initMetrics(addr string) *http.Server {
+// a Prometheus handler registered for the /metrics URL path and the
+// Experiment's status and control handlers. The return server is not started
+// for the caller.
+func initMetrics(addr string, e Experiment) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	e.registerControlHandlers(mux)
 	return &http.Server{
 		Addr:    addr,
-		Handler: promhttp.Handler(),
+		Handler: mux,
 	}
 }
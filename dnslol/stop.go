@@ -0,0 +1,224 @@
+package dnslol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// abortWindowSlots is the number of slots the AbortWindow of a server's error
+// rate is divided into. The window slides by one slot at a time.
+const abortWindowSlots = 10
+
+// stopRequested is the stop reason of an Experiment stopped with Stop, e.g.
+// through the control API.
+const stopRequested = "stop requested"
+
+// errQueryBudget is the error of a query that was skipped because the
+// Experiment's MaxQueries had already been sent.
+var errQueryBudget = errors.New("query skipped, query budget is used up")
+
+// validStop checks the Experiment's stop conditions.
+func (e Experiment) validStop() error {
+	if e.MaxDuration < 0 || e.MaxQueries < 0 {
+		return errors.New("Experiment must not have a negative MaxDuration or MaxQueries")
+	}
+	if e.AbortErrorRate < 0 || e.AbortErrorRate > 1 {
+		return errors.New("Experiment must have an AbortErrorRate between 0 and 1")
+	}
+	if e.AbortErrorRate > 0 && e.AbortWindow < time.Millisecond {
+		return errors.New("Experiment must have an AbortWindow of at least 1 millisecond to use an AbortErrorRate")
+	}
+	if e.AbortMinQueries < 0 {
+		return errors.New("Experiment must not have a negative AbortMinQueries")
+	}
+	return nil
+}
+
+// hasStopConditions returns whether the Experiment has a query budget, which
+// is checked before each query is sent, or an error rate abort, which is
+// checked for each completed query.
+func (e Experiment) hasStopConditions() bool {
+	return e.MaxQueries > 0 || e.AbortErrorRate > 0
+}
+
+// stopConditions checks the query budget and error rate abort of an Experiment
+// as its queries are sent and complete.
+type stopConditions struct {
+	exp Experiment
+	// sent is the number of queries sent, or about to be sent, to the servers
+	// so far.
+	sent int64
+
+	sync.Mutex
+	// windows holds the recent error rate of each server by address.
+	windows map[string]*errorWindow
+}
+
+// newStopConditions creates the stopConditions of the given Experiment.
+func newStopConditions(e Experiment) *stopConditions {
+	return &stopConditions{
+		exp:     e,
+		windows: make(map[string]*errorWindow, len(e.servers)),
+	}
+}
+
+// reserve takes one query from the MaxQueries budget before the query is
+// sent. It returns false if the budget is already used up and the query must
+// not be sent. The reason the Experiment must stop is returned along with the
+// last query of the budget, otherwise it is "".
+func (sc *stopConditions) reserve() (bool, string) {
+	max := sc.exp.MaxQueries
+	if max <= 0 {
+		return true, ""
+	}
+	switch sent := atomic.AddInt64(&sc.sent, 1); {
+	case sent > max:
+		return false, ""
+	case sent == max:
+		return true, sc.budgetReason()
+	}
+	return true, ""
+}
+
+// refund returns a query taken by reserve to the MaxQueries budget when the
+// query wasn't sent after all.
+func (sc *stopConditions) refund() {
+	if sc.exp.MaxQueries > 0 {
+		atomic.AddInt64(&sc.sent, -1)
+	}
+}
+
+// counted counts a query that was sent without reserve, e.g. by a worker of a
+// coordinator, and returns the reason the Experiment must stop once the
+// MaxQueries budget has been sent, or "".
+func (sc *stopConditions) counted() string {
+	max := sc.exp.MaxQueries
+	if max > 0 && atomic.AddInt64(&sc.sent, 1) >= max {
+		return sc.budgetReason()
+	}
+	return ""
+}
+
+// budgetReason returns the stop reason of an Experiment that has sent its
+// MaxQueries.
+func (sc *stopConditions) budgetReason() string {
+	return fmt.Sprintf("query budget of %d queries used", sc.exp.MaxQueries)
+}
+
+// observe records a query that was sent to the server at address and
+// completed at the given time, and returns the reason the Experiment must
+// stop, or "" if it can go on. A failure is an outcome that counts against the
+// server's circuit breaker: a timeout, a network or TLS error or a SERVFAIL.
+func (sc *stopConditions) observe(address string, now time.Time, err error) string {
+	if sc.exp.AbortErrorRate <= 0 {
+		return ""
+	}
+
+	sc.Lock()
+	defer sc.Unlock()
+	w, ok := sc.windows[address]
+	if !ok {
+		w = &errorWindow{width: sc.exp.AbortWindow / abortWindowSlots}
+		sc.windows[address] = w
+	}
+	w.observe(now, breakerFailure(err))
+	queries, failures := w.totals(now)
+	if queries < int64(sc.exp.AbortMinQueries) {
+		return ""
+	}
+	if rate := float64(failures) / float64(queries); rate > sc.exp.AbortErrorRate {
+		return fmt.Sprintf("error rate of %s was %.1f%% over the last %s (%d of %d queries), above the abort rate of %.1f%%",
+			address, rate*100, sc.exp.AbortWindow, failures, queries, sc.exp.AbortErrorRate*100)
+	}
+	return ""
+}
+
+// An errorWindow counts the queries to a server and how many of them failed
+// over a sliding window of abortWindowSlots slots of the given width.
+type errorWindow struct {
+	width time.Duration
+	slots [abortWindowSlots]windowSlot
+}
+
+// A windowSlot counts the queries of one slot of an errorWindow. Its index is
+// the number of slot widths since the Unix epoch.
+type windowSlot struct {
+	index    int64
+	queries  int64
+	failures int64
+}
+
+// slot returns the index of the slot of the given time.
+func (w *errorWindow) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(w.width)
+}
+
+// observe counts a query that completed at the given time.
+func (w *errorWindow) observe(now time.Time, failed bool) {
+	index := w.slot(now)
+	s := &w.slots[index%abortWindowSlots]
+	if s.index != index {
+		*s = windowSlot{index: index}
+	}
+	s.queries++
+	if failed {
+		s.failures++
+	}
+}
+
+// totals returns the queries and failures counted in the window ending at the
+// given time.
+func (w *errorWindow) totals(now time.Time) (int64, int64) {
+	index := w.slot(now)
+	var queries, failures int64
+	for _, s := range w.slots {
+		if s.index > index-abortWindowSlots && s.index <= index {
+			queries += s.queries
+			failures += s.failures
+		}
+	}
+	return queries, failures
+}
+
+// stopAfter stops the Experiment once its MaxDuration has passed, unless done
+// is closed first.
+func (e Experiment) stopAfter(d time.Duration, done <-chan struct{}) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		e.stopFor(fmt.Sprintf("maximum duration of %s reached", d))
+	}
+}
+
+// admit returns whether the given query may be sent and whether it is the
+// probe of its server's half-open circuit breaker. A query that may not be sent
+// is skipped with the returned error: the Experiment's MaxQueries budget is
+// used up or the server's circuit breaker is open.
+func (e Experiment) admit(q query) (bool, bool, error) {
+	if e.stopConditions != nil {
+		ok, reason := e.stopConditions.reserve()
+		if reason != "" {
+			e.stopFor(reason)
+		}
+		if !ok {
+			return false, false, errQueryBudget
+		}
+	}
+	b := e.breakers[q.Server.address]
+	if b == nil {
+		return true, false, nil
+	}
+	allowed, probe := b.allow()
+	if !allowed {
+		if e.stopConditions != nil {
+			e.stopConditions.refund()
+		}
+		return false, false, errBreakerOpen
+	}
+	return true, probe, nil
+}
@@ -0,0 +1,143 @@
+package dnslol
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestErrorWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	type observation struct {
+		at     time.Duration
+		failed bool
+	}
+	testCases := []struct {
+		name         string
+		observations []observation
+		at           time.Duration
+		wantQueries  int64
+		wantFailures int64
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "all in the window",
+			observations: []observation{
+				{at: 0}, {at: 100 * time.Millisecond, failed: true}, {at: 900 * time.Millisecond},
+			},
+			at:           900 * time.Millisecond,
+			wantQueries:  3,
+			wantFailures: 1,
+		},
+		{
+			name: "old slots slide out",
+			observations: []observation{
+				{at: 0, failed: true}, {at: 50 * time.Millisecond, failed: true},
+				{at: 500 * time.Millisecond}, {at: 1050 * time.Millisecond, failed: true},
+			},
+			at:           1050 * time.Millisecond,
+			wantQueries:  2,
+			wantFailures: 1,
+		},
+		{
+			name: "reused slot is reset",
+			observations: []observation{
+				{at: 0, failed: true}, {at: 2 * time.Second},
+			},
+			at:          2 * time.Second,
+			wantQueries: 1,
+		},
+		{
+			name: "everything slid out",
+			observations: []observation{
+				{at: 0, failed: true}, {at: 500 * time.Millisecond, failed: true},
+			},
+			at: 5 * time.Second,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &errorWindow{width: time.Second / abortWindowSlots}
+			for _, o := range tc.observations {
+				w.observe(start.Add(o.at), o.failed)
+			}
+			queries, failures := w.totals(start.Add(tc.at))
+			if queries != tc.wantQueries || failures != tc.wantFailures {
+				t.Errorf("expected %d queries and %d failures, got %d and %d",
+					tc.wantQueries, tc.wantFailures, queries, failures)
+			}
+		})
+	}
+}
+
+func TestStopConditionsObserve(t *testing.T) {
+	timeout := &queryError{class: outcomeTimeout, err: errors.New("i/o timeout")}
+	nxdomain := rcodeError(dns.RcodeNameError)
+	testCases := []struct {
+		name       string
+		errs       []error
+		wantReason bool
+	}{
+		{
+			name: "too few queries",
+			errs: []error{timeout, timeout, timeout},
+		},
+		{
+			name: "below the abort rate",
+			errs: []error{timeout, nil, nil, nil, nil},
+		},
+		{
+			name:       "above the abort rate",
+			errs:       []error{timeout, timeout, nil, nil},
+			wantReason: true,
+		},
+		{
+			name: "answers aren't failures",
+			errs: []error{nxdomain, nxdomain, nxdomain, nxdomain},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sc := newStopConditions(Experiment{
+				AbortErrorRate:  0.25,
+				AbortWindow:     time.Minute,
+				AbortMinQueries: 4,
+			})
+			now := time.Now()
+			var reason string
+			for _, err := range tc.errs {
+				reason = sc.observe("127.0.0.1:53", now, err)
+			}
+			if got := reason != ""; got != tc.wantReason {
+				t.Errorf("expected a stop reason %v, got %q", tc.wantReason, reason)
+			}
+		})
+	}
+}
+
+func TestStopConditionsReserve(t *testing.T) {
+	sc := newStopConditions(Experiment{MaxQueries: 3})
+	for i, want := range []struct {
+		ok     bool
+		reason bool
+	}{{true, false}, {true, false}, {true, true}, {false, false}, {false, false}} {
+		ok, reason := sc.reserve()
+		if ok != want.ok || (reason != "") != want.reason {
+			t.Errorf("query %d: expected %v with a reason %v, got %v with %q",
+				i+1, want.ok, want.reason, ok, reason)
+		}
+	}
+
+	sc = newStopConditions(Experiment{MaxQueries: 1})
+	if ok, _ := sc.reserve(); !ok {
+		t.Fatal("expected the first query to be allowed")
+	}
+	sc.refund()
+	if ok, reason := sc.reserve(); !ok || reason == "" {
+		t.Errorf("expected the refunded query to be allowed with a reason, got %v with %q", ok, reason)
+	}
+}
@@ -0,0 +1,536 @@
+package dnslol
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// summaryQuantiles are the latency percentiles included in a run summary.
+var summaryQuantiles = []float64{0.5, 0.9, 0.99, 0.999, 1}
+
+// serverSummary holds the statistics for one server that are reported while
+// a run is in progress and at the end of a run.
+type serverSummary struct {
+	// attempts is the number of queries sent.
+	attempts uint64
+	// successes is the number of queries with the outcomeOK outcome.
+	successes uint64
+	// inflight is the number of queries waiting for a response.
+	inflight int64
+	// outcomes is the number of queries with each outcome class.
+	outcomes map[string]uint64
+	// latency holds the round trip time of each query.
+	latency latencyHist
+	// corrected holds the round trip time of each query plus the delay between
+	// when the query was scheduled to be sent and when it was actually sent.
+	corrected latencyHist
+
+	// retries is the number of attempts sent to the server that were retried.
+	retries uint64
+	// queries is the number of queries first sent to the server whose last
+	// attempt has completed. Without retries it is the same as attempts.
+	queries uint64
+	// effectiveSuccesses is the number of those queries whose last attempt had
+	// the outcomeOK outcome.
+	effectiveSuccesses uint64
+	// effectiveOutcomes is the number of those queries with each outcome class
+	// of their last attempt.
+	effectiveOutcomes map[string]uint64
+	// effective holds the time from when the first attempt of each of those
+	// queries was sent until its last attempt completed.
+	effective latencyHist
+
+	// unhedged holds the latency of the first attempt of each hedged query,
+	// which is what a client that doesn't hedge would have waited. It is only
+	// kept for the resolver set.
+	unhedged latencyHist
+	// hedges is the number of hedges sent for the resolver set's queries and
+	// hedgeWins the number of them whose result was the effective result.
+	hedges    uint64
+	hedgeWins uint64
+
+	// skipped is the number of queries to the server that were skipped
+	// because its circuit breaker was open or the query budget was used up.
+	// They aren't attempts.
+	skipped uint64
+}
+
+// newServerSummary creates an empty serverSummary.
+func newServerSummary() *serverSummary {
+	return &serverSummary{
+		outcomes:          make(map[string]uint64),
+		effectiveOutcomes: make(map[string]uint64),
+	}
+}
+
+// runSummary collects per-server statistics over the course of an Experiment
+// for progress reports and the end-of-run summary. Unlike the Prometheus
+// metrics these are kept in process so that accurate percentiles can be
+// reported.
+type runSummary struct {
+	sync.Mutex
+	// start is when the summary was created.
+	start time.Time
+	// end is when the run finished for a summary of finished runs, e.g. the
+	// aggregate of the shards of a sharded run. It is zero while a run is in
+	// progress.
+	end time.Time
+	// names is the number of names whose queries have all completed.
+	names   uint64
+	servers map[string]*serverSummary
+}
+
+// newRunSummary creates a runSummary for the given servers.
+func newRunSummary(servers []server) *runSummary {
+	rs := &runSummary{
+		start:   time.Now(),
+		servers: make(map[string]*serverSummary, len(servers)),
+	}
+	for _, s := range servers {
+		rs.servers[s.address] = newServerSummary()
+	}
+	return rs
+}
+
+// queryStarted records that a query to the given server was sent.
+func (rs *runSummary) queryStarted(address string) {
+	rs.Lock()
+	defer rs.Unlock()
+	if s, ok := rs.servers[address]; ok {
+		s.attempts++
+		s.inflight++
+	}
+}
+
+// queryFinished records the result of a query to the given server: its
+// outcome, round trip time and the delay between when the query was scheduled
+// and when it was sent.
+func (rs *runSummary) queryFinished(address string, rtt, delay time.Duration, err error) {
+	rs.Lock()
+	defer rs.Unlock()
+	s, ok := rs.servers[address]
+	if !ok {
+		return
+	}
+	s.inflight--
+	class := outcome(err)
+	s.outcomes[class]++
+	if class == outcomeOK {
+		s.successes++
+	}
+	s.latency.Observe(rtt)
+	s.corrected.Observe(rtt + delay)
+}
+
+// queryCompleted records the effective result of a query first sent to the
+// given server once its last attempt has completed: the outcome of the last
+// attempt and the time since the first attempt was sent.
+func (rs *runSummary) queryCompleted(address string, latency time.Duration, err error) {
+	rs.Lock()
+	defer rs.Unlock()
+	s, ok := rs.servers[address]
+	if !ok {
+		return
+	}
+	s.queries++
+	class := outcome(err)
+	s.effectiveOutcomes[class]++
+	if class == outcomeOK {
+		s.effectiveSuccesses++
+	}
+	s.effective.Observe(latency)
+}
+
+// querySkipped records that a query to the given server was skipped because
+// its circuit breaker was open or the query budget was used up.
+func (rs *runSummary) querySkipped(address string) {
+	rs.Lock()
+	defer rs.Unlock()
+	if s, ok := rs.servers[address]; ok {
+		s.skipped++
+	}
+}
+
+// unhedgedCompleted records the latency of the first attempt of a hedged query.
+func (rs *runSummary) unhedgedCompleted(latency time.Duration) {
+	rs.Lock()
+	defer rs.Unlock()
+	if s, ok := rs.servers[resolverSetAddress]; ok {
+		s.unhedged.Observe(latency)
+	}
+}
+
+// hedgeCompleted records the result of a hedge, and whether it won.
+func (rs *runSummary) hedgeCompleted(won bool) {
+	rs.Lock()
+	defer rs.Unlock()
+	if s, ok := rs.servers[resolverSetAddress]; ok {
+		s.hedges++
+		if won {
+			s.hedgeWins++
+		}
+	}
+}
+
+// latencyQuantile returns the given quantile of the round trip times of the
+// queries sent to the given server so far and the number of them.
+func (rs *runSummary) latencyQuantile(address string, q float64) (time.Duration, uint64) {
+	rs.Lock()
+	defer rs.Unlock()
+	s, ok := rs.servers[address]
+	if !ok {
+		return 0, 0
+	}
+	return s.latency.Quantile(q), s.latency.Count()
+}
+
+// queryRetried records that an attempt sent to the given server was retried.
+func (rs *runSummary) queryRetried(address string) {
+	rs.Lock()
+	defer rs.Unlock()
+	if s, ok := rs.servers[address]; ok {
+		s.retries++
+	}
+}
+
+// retried returns whether any query in the summary was retried. The caller
+// must hold rs.
+func (rs *runSummary) retried() bool {
+	for _, s := range rs.servers {
+		if s.retries > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// effective returns whether the summary's effective outcomes differ from its
+// attempts: queries were retried or sent to a resolver set. The caller must
+// hold rs.
+func (rs *runSummary) effective() bool {
+	_, set := rs.servers[resolverSetAddress]
+	return set || rs.retried()
+}
+
+// nameFinished records that all of the queries for a name have completed.
+func (rs *runSummary) nameFinished() {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.names++
+}
+
+// addresses returns the sorted server addresses in the summary.
+func (rs *runSummary) addresses() []string {
+	addrs := make([]string, 0, len(rs.servers))
+	for addr := range rs.servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// String returns human readable tables of the summary: the attempts and
+// outcomes for each server followed by latency percentiles. The corrected
+// latency percentiles include time queries spent waiting to be sent after
+// their scheduled send time and are only meaningful for rate limited
+// experiments. If queries were retried the effective outcomes and latency of
+// the queries first sent to each server, as seen by a client, are included.
+// For a resolver set they are those of the whole set, which has no attempts
+// of its own. Hedged queries add the number of hedges sent and won and the
+// set's unhedged latency, that of the first attempt of each query.
+func (rs *runSummary) String() string {
+	rs.Lock()
+	defer rs.Unlock()
+
+	duration := time.Since(rs.start)
+	if !rs.end.IsZero() {
+		duration = rs.end.Sub(rs.start)
+	}
+	var out strings.Builder
+	fmt.Fprintf(&out, "Names: %d, duration: %s\n\n",
+		rs.names, duration.Round(time.Second))
+
+	fmt.Fprintf(&out, "%-30s %12s %12s %9s  %s\n",
+		"Server", "Attempts", "Successes", "Success", "Outcomes")
+	for _, addr := range rs.addresses() {
+		if addr == resolverSetAddress {
+			continue
+		}
+		s := rs.servers[addr]
+		fmt.Fprintf(&out, "%-30s %12d %12d %8.2f%%  %s\n",
+			addr, s.attempts, s.successes,
+			percent(s.successes, s.attempts), formatOutcomes(s.outcomes))
+	}
+	out.WriteString("\n")
+
+	var skipped []string
+	for _, addr := range rs.addresses() {
+		if n := rs.servers[addr].skipped; n > 0 {
+			skipped = append(skipped, fmt.Sprintf("%s=%d", addr, n))
+		}
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(&out, "Skipped queries: %s\n\n", strings.Join(skipped, " "))
+	}
+
+	effective := rs.effective()
+	if effective {
+		fmt.Fprintf(&out, "%-30s %12s %12s %9s  %s\n",
+			"Server", "Queries", "Effective", "Success", "Effective outcomes")
+		for _, addr := range rs.addresses() {
+			s := rs.servers[addr]
+			if s.queries == 0 {
+				continue
+			}
+			fmt.Fprintf(&out, "%-30s %12d %12d %8.2f%%  %s\n",
+				addr, s.queries, s.effectiveSuccesses,
+				percent(s.effectiveSuccesses, s.queries), formatOutcomes(s.effectiveOutcomes))
+		}
+		out.WriteString("\n")
+	}
+	if s, ok := rs.servers[resolverSetAddress]; ok && s.unhedged.Count() > 0 {
+		fmt.Fprintf(&out,
+			"Hedges: %d for %d queries (%.2f%% extra queries), %d won (%.2f%% of hedges)\n\n",
+			s.hedges, s.queries, percent(s.hedges, s.queries),
+			s.hedgeWins, percent(s.hedgeWins, s.hedges))
+	}
+
+	fmt.Fprintf(&out, "%-30s %-10s", "Server", "Latency")
+	for _, q := range summaryQuantiles {
+		fmt.Fprintf(&out, " %12s", quantileName(q))
+	}
+	out.WriteString("\n")
+	for _, addr := range rs.addresses() {
+		s := rs.servers[addr]
+		var rows []struct {
+			name string
+			hist *latencyHist
+		}
+		if addr != resolverSetAddress {
+			rows = append(rows, []struct {
+				name string
+				hist *latencyHist
+			}{
+				{"raw", &s.latency},
+				{"corrected", &s.corrected},
+			}...)
+		}
+		if effective && s.queries > 0 {
+			rows = append(rows, struct {
+				name string
+				hist *latencyHist
+			}{"effective", &s.effective})
+		}
+		if s.unhedged.Count() > 0 {
+			rows = append(rows, struct {
+				name string
+				hist *latencyHist
+			}{"unhedged", &s.unhedged})
+		}
+		for _, row := range rows {
+			fmt.Fprintf(&out, "%-30s %-10s", addr, row.name)
+			for _, q := range summaryQuantiles {
+				fmt.Fprintf(&out, " %12s", roundLatency(row.hist.Quantile(q)))
+			}
+			out.WriteString("\n")
+		}
+	}
+	return out.String()
+}
+
+// summaryJSON is the JSON encoding of a runSummary, used to store the summary
+// of each shard of a sharded run so that they can be merged.
+type summaryJSON struct {
+	Start   time.Time                    `json:"start"`
+	End     time.Time                    `json:"end"`
+	Names   uint64                       `json:"names"`
+	Servers map[string]serverSummaryJSON `json:"servers"`
+}
+
+// serverSummaryJSON is the JSON encoding of a serverSummary.
+type serverSummaryJSON struct {
+	Attempts  uint64            `json:"attempts"`
+	Successes uint64            `json:"successes"`
+	Outcomes  map[string]uint64 `json:"outcomes"`
+	Latency   *latencyHist      `json:"latency"`
+	Corrected *latencyHist      `json:"corrected"`
+
+	Retries            uint64            `json:"retries,omitempty"`
+	Queries            uint64            `json:"queries,omitempty"`
+	EffectiveSuccesses uint64            `json:"effectiveSuccesses,omitempty"`
+	EffectiveOutcomes  map[string]uint64 `json:"effectiveOutcomes,omitempty"`
+	Effective          *latencyHist      `json:"effective,omitempty"`
+
+	Unhedged  *latencyHist `json:"unhedged,omitempty"`
+	Hedges    uint64       `json:"hedges,omitempty"`
+	HedgeWins uint64       `json:"hedgeWins,omitempty"`
+	Skipped   uint64       `json:"skipped,omitempty"`
+}
+
+// MarshalJSON encodes the summary with the current time as its end. Queries
+// in flight aren't included.
+func (rs *runSummary) MarshalJSON() ([]byte, error) {
+	rs.Lock()
+	defer rs.Unlock()
+	sj := summaryJSON{
+		Start:   rs.start,
+		End:     rs.end,
+		Names:   rs.names,
+		Servers: make(map[string]serverSummaryJSON, len(rs.servers)),
+	}
+	if sj.End.IsZero() {
+		sj.End = time.Now()
+	}
+	for addr, s := range rs.servers {
+		sj.Servers[addr] = serverSummaryJSON{
+			Attempts:  s.attempts,
+			Successes: s.successes,
+			Outcomes:  s.outcomes,
+			Latency:   &s.latency,
+			Corrected: &s.corrected,
+
+			Retries:            s.retries,
+			Queries:            s.queries,
+			EffectiveSuccesses: s.effectiveSuccesses,
+			EffectiveOutcomes:  s.effectiveOutcomes,
+			Effective:          &s.effective,
+
+			Unhedged:  &s.unhedged,
+			Hedges:    s.hedges,
+			HedgeWins: s.hedgeWins,
+			Skipped:   s.skipped,
+		}
+	}
+	return json.Marshal(sj)
+}
+
+// UnmarshalJSON decodes a summary encoded by MarshalJSON, replacing the
+// contents of rs.
+func (rs *runSummary) UnmarshalJSON(data []byte) error {
+	var sj summaryJSON
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return err
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	rs.start, rs.end, rs.names = sj.Start, sj.End, sj.Names
+	rs.servers = make(map[string]*serverSummary, len(sj.Servers))
+	for addr, ssj := range sj.Servers {
+		s := newServerSummary()
+		s.attempts, s.successes = ssj.Attempts, ssj.Successes
+		s.retries, s.queries, s.effectiveSuccesses = ssj.Retries, ssj.Queries, ssj.EffectiveSuccesses
+		for class, n := range ssj.Outcomes {
+			s.outcomes[class] = n
+		}
+		for class, n := range ssj.EffectiveOutcomes {
+			s.effectiveOutcomes[class] = n
+		}
+		if ssj.Latency != nil {
+			s.latency = *ssj.Latency
+		}
+		if ssj.Corrected != nil {
+			s.corrected = *ssj.Corrected
+		}
+		if ssj.Effective != nil {
+			s.effective = *ssj.Effective
+		}
+		if ssj.Unhedged != nil {
+			s.unhedged = *ssj.Unhedged
+		}
+		s.hedges, s.hedgeWins, s.skipped = ssj.Hedges, ssj.HedgeWins, ssj.Skipped
+		rs.servers[addr] = s
+	}
+	return nil
+}
+
+// merge adds the statistics of other, a summary of a finished run, to rs. The
+// merged summary runs from the earliest start to the latest end of the two.
+func (rs *runSummary) merge(other *runSummary) {
+	rs.Lock()
+	defer rs.Unlock()
+	other.Lock()
+	defer other.Unlock()
+	if rs.start.IsZero() || other.start.Before(rs.start) {
+		rs.start = other.start
+	}
+	if other.end.After(rs.end) {
+		rs.end = other.end
+	}
+	rs.names += other.names
+	for addr, o := range other.servers {
+		s, ok := rs.servers[addr]
+		if !ok {
+			s = newServerSummary()
+			rs.servers[addr] = s
+		}
+		s.attempts += o.attempts
+		s.successes += o.successes
+		for class, n := range o.outcomes {
+			s.outcomes[class] += n
+		}
+		s.latency.Merge(&o.latency)
+		s.corrected.Merge(&o.corrected)
+		s.retries += o.retries
+		s.queries += o.queries
+		s.effectiveSuccesses += o.effectiveSuccesses
+		for class, n := range o.effectiveOutcomes {
+			s.effectiveOutcomes[class] += n
+		}
+		s.effective.Merge(&o.effective)
+		s.unhedged.Merge(&o.unhedged)
+		s.hedges += o.hedges
+		s.hedgeWins += o.hedgeWins
+		s.skipped += o.skipped
+	}
+}
+
+// formatOutcomes returns the given outcome counts as space separated
+// "class=count" pairs, most common first.
+func formatOutcomes(outcomes map[string]uint64) string {
+	classes := make([]string, 0, len(outcomes))
+	for class := range outcomes {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if outcomes[classes[i]] != outcomes[classes[j]] {
+			return outcomes[classes[i]] > outcomes[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+	pairs := make([]string, len(classes))
+	for i, class := range classes {
+		pairs[i] = fmt.Sprintf("%s=%d", class, outcomes[class])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// percent returns n as a percentage of total, or zero if total is zero.
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total) * 100
+}
+
+// quantileName returns a short column name for the given quantile, e.g. "p99".
+func quantileName(q float64) string {
+	if q >= 1 {
+		return "max"
+	}
+	return fmt.Sprintf("p%g", q*100)
+}
+
+// roundLatency rounds a latency to a precision suitable for display.
+func roundLatency(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,167 @@
+package dnslol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// summaryTimeout is an error with the outcomeTimeout outcome class.
+var summaryTimeout = &queryError{class: outcomeTimeout, err: errors.New("i/o timeout")}
+
+func TestRunSummaryString(t *testing.T) {
+	testCases := []struct {
+		name    string
+		servers []server
+		record  func(rs *runSummary)
+		// expected are lines the summary must include, without trailing
+		// spaces, and absent are substrings it must not include.
+		expected []string
+		absent   []string
+	}{
+		{
+			name:    "attempts",
+			servers: []server{{address: "192.0.2.1:53"}, {address: "192.0.2.2:53"}},
+			record: func(rs *runSummary) {
+				for i := 0; i < 4; i++ {
+					var err error
+					if i == 3 {
+						err = summaryTimeout
+					}
+					rs.queryStarted("192.0.2.1:53")
+					rs.queryFinished("192.0.2.1:53", 10*time.Millisecond, 0, err)
+				}
+				rs.nameFinished()
+				rs.nameFinished()
+			},
+			expected: []string{
+				"Names: 2, duration: 1m30s",
+				"Server                             Attempts    Successes   Success  Outcomes",
+				"192.0.2.1:53                              4            3    75.00%  ok=3 timeout=1",
+				"192.0.2.2:53                              0            0     0.00%",
+				"Server                         Latency             p50          p90          p99        p99.9          max",
+				"192.0.2.1:53                   raw             10.08ms      10.08ms      10.08ms      10.08ms      10.08ms",
+				"192.0.2.2:53                   corrected            0s           0s           0s           0s           0s",
+			},
+			absent: []string{"Skipped queries", "Effective outcomes", "Hedges", "effective", "unhedged"},
+		},
+		{
+			name:    "corrected latency",
+			servers: []server{{address: "192.0.2.1:53"}},
+			record: func(rs *runSummary) {
+				rs.queryStarted("192.0.2.1:53")
+				rs.queryFinished("192.0.2.1:53", 10*time.Millisecond, 10*time.Millisecond, nil)
+			},
+			expected: []string{
+				"192.0.2.1:53                   raw             10.08ms      10.08ms      10.08ms      10.08ms      10.08ms",
+				"192.0.2.1:53                   corrected       20.02ms      20.02ms      20.02ms      20.02ms      20.02ms",
+			},
+		},
+		{
+			name:    "skipped",
+			servers: []server{{address: "192.0.2.1:53"}, {address: "192.0.2.2:53"}},
+			record: func(rs *runSummary) {
+				rs.querySkipped("192.0.2.2:53")
+				rs.querySkipped("192.0.2.2:53")
+			},
+			expected: []string{"Skipped queries: 192.0.2.2:53=2"},
+		},
+		{
+			name:    "retried",
+			servers: []server{{address: "192.0.2.1:53"}},
+			record: func(rs *runSummary) {
+				rs.queryStarted("192.0.2.1:53")
+				rs.queryFinished("192.0.2.1:53", time.Second, 0, summaryTimeout)
+				rs.queryRetried("192.0.2.1:53")
+				rs.queryStarted("192.0.2.1:53")
+				rs.queryFinished("192.0.2.1:53", 10*time.Millisecond, 0, nil)
+				rs.queryCompleted("192.0.2.1:53", 2*time.Second, nil)
+			},
+			expected: []string{
+				"192.0.2.1:53                              2            1    50.00%  ok=1 timeout=1",
+				"Server                              Queries    Effective   Success  Effective outcomes",
+				"192.0.2.1:53                              1            1   100.00%  ok=1",
+				"192.0.2.1:53                   effective        2.006s       2.006s       2.006s       2.006s       2.006s",
+			},
+			absent: []string{"Hedges", "unhedged"},
+		},
+		{
+			name:    "hedged resolver set",
+			servers: []server{{address: "192.0.2.1:53"}, {address: resolverSetAddress}},
+			record: func(rs *runSummary) {
+				rs.queryCompleted(resolverSetAddress, 10*time.Millisecond, nil)
+				rs.queryCompleted(resolverSetAddress, 10*time.Millisecond, summaryTimeout)
+				rs.unhedgedCompleted(20 * time.Millisecond)
+				rs.hedgeCompleted(true)
+			},
+			expected: []string{
+				"resolver-set                              2            1    50.00%  ok=1 timeout=1",
+				"Hedges: 1 for 2 queries (50.00% extra queries), 1 won (100.00% of hedges)",
+				"resolver-set                   effective       10.08ms      10.08ms      10.08ms      10.08ms      10.08ms",
+				"resolver-set                   unhedged        20.02ms      20.02ms      20.02ms      20.02ms      20.02ms",
+			},
+			// The resolver set has no attempts or raw latency of its own.
+			absent: []string{"resolver-set                              0", "resolver-set                   raw"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := newRunSummary(tc.servers)
+			rs.end = rs.start.Add(90 * time.Second)
+			tc.record(rs)
+			summary := rs.String()
+			lines := make(map[string]bool)
+			for _, line := range strings.Split(summary, "\n") {
+				lines[strings.TrimRight(line, " ")] = true
+			}
+			for _, line := range tc.expected {
+				if !lines[line] {
+					t.Errorf("expected summary to include %q, got:\n%s", line, summary)
+				}
+			}
+			for _, s := range tc.absent {
+				if strings.Contains(summary, s) {
+					t.Errorf("expected summary not to include %q, got:\n%s", s, summary)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatOutcomes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		outcomes map[string]uint64
+		expected string
+	}{
+		{name: "none", expected: ""},
+		{name: "most common first", outcomes: map[string]uint64{"timeout": 2, "ok": 5, "SERVFAIL": 1}, expected: "ok=5 timeout=2 SERVFAIL=1"},
+		{name: "ties by name", outcomes: map[string]uint64{"timeout": 2, "SERVFAIL": 2}, expected: "SERVFAIL=2 timeout=2"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := formatOutcomes(tc.outcomes); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRoundLatency(t *testing.T) {
+	testCases := []struct {
+		latency  time.Duration
+		expected time.Duration
+	}{
+		{latency: 1234567890, expected: 1235 * time.Millisecond},
+		{latency: 12345678, expected: 12350 * time.Microsecond},
+		{latency: 123456, expected: 123 * time.Microsecond},
+		{latency: 0, expected: 0},
+	}
+	for _, tc := range testCases {
+		if got := roundLatency(tc.latency); got != tc.expected {
+			t.Errorf("expected %s rounded to %s, got %s", tc.latency, tc.expected, got)
+		}
+	}
+}
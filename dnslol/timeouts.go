@@ -0,0 +1,173 @@
+package dnslol
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The phases of an attempt of a query, reported for attempts that time out.
+const (
+	phaseDial  = "dial"
+	phaseTLS   = "tls"
+	phaseWrite = "write"
+	phaseRead  = "read"
+	// phaseTotal is reported when the attempt's timeout passed before the
+	// timeout of the phase it was in.
+	phaseTotal = "total"
+)
+
+// knownPhase returns true if phase is one of the phases of an attempt.
+func knownPhase(phase string) bool {
+	switch phase {
+	case phaseDial, phaseTLS, phaseWrite, phaseRead, phaseTotal:
+		return true
+	}
+	return false
+}
+
+// validTimeouts checks the Experiment's Timeout and phase timeout settings.
+func (e Experiment) validTimeouts() error {
+	if e.Timeout <= 0 {
+		return errors.New("Experiment must have a Timeout greater than 0")
+	}
+	if e.DialTimeout < 0 || e.TLSHandshakeTimeout < 0 ||
+		e.WriteTimeout < 0 || e.ReadTimeout < 0 {
+		return errors.New(
+			"Experiment must not have a negative DialTimeout, TLSHandshakeTimeout, WriteTimeout or ReadTimeout")
+	}
+	return nil
+}
+
+// A phaseError is an error that happened in one phase of an attempt.
+type phaseError struct {
+	phase string
+	err   error
+}
+
+// Error returns the text of the underlying error.
+func (pe *phaseError) Error() string {
+	return pe.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (pe *phaseError) Unwrap() error {
+	return pe.err
+}
+
+// timeoutPhase returns the phase of the attempt that timed out for the given
+// query error, or "" if the attempt didn't time out.
+func timeoutPhase(err error) string {
+	var pe *phaseError
+	if outcome(err) != outcomeTimeout || !errors.As(err, &pe) {
+		return ""
+	}
+	return pe.phase
+}
+
+// phaseDeadline returns the deadline of a phase starting now with the given
+// timeout, which is limited by the attempt's deadline, and the phase to report
+// if it passes. Without a timeout of its own the phase runs until the
+// attempt's deadline.
+func phaseDeadline(phase string, timeout time.Duration, deadline time.Time) (time.Time, string) {
+	if timeout <= 0 {
+		return deadline, phaseTotal
+	}
+	if d := time.Now().Add(timeout); d.Before(deadline) {
+		return d, phase
+	}
+	return deadline, phaseTotal
+}
+
+// dial connects to the server at address with the protocol of the given
+// dnsClient. Connecting is limited by the DialTimeout and, for DNS over TLS,
+// the TLS handshake by the TLSHandshakeTimeout, both within the attempt's
+// deadline. Errors are phaseErrors.
+func (e Experiment) dial(dnsClient *dns.Client, address string, deadline time.Time) (*dns.Conn, error) {
+	network := dnsClient.Net
+	if network == "" {
+		network = "udp"
+	}
+	useTLS := strings.HasSuffix(network, "-tls")
+	network = strings.TrimSuffix(network, "-tls")
+
+	dialDeadline, phase := phaseDeadline(phaseDial, e.DialTimeout, deadline)
+	d := net.Dialer{Deadline: dialDeadline}
+	conn, err := d.Dial(network, address)
+	if err != nil {
+		return nil, &phaseError{phase: phase, err: err}
+	}
+	if !useTLS {
+		return &dns.Conn{Conn: conn}, nil
+	}
+
+	// Like tls.Dial, verify the certificate for the host of the address
+	// unless the config names a server.
+	config := dnsClient.TLSConfig
+	if config == nil || config.ServerName == "" {
+		if config == nil {
+			config = new(tls.Config)
+		} else {
+			config = config.Clone()
+		}
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsDeadline, phase := phaseDeadline(phaseTLS, e.TLSHandshakeTimeout, deadline)
+	tlsConn := tls.Client(conn, config)
+	_ = tlsConn.SetDeadline(tlsDeadline)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, &phaseError{phase: phase, err: err}
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return &dns.Conn{Conn: tlsConn}, nil
+}
+
+// exchange sends the query m to the server at address on a new connection and
+// waits for its response, like dns.Client.Exchange, within the given attempt
+// timeout. Each phase of the attempt is also limited by its own timeout:
+// connecting by the DialTimeout, the TLS handshake by the TLSHandshakeTimeout,
+// sending the query by the WriteTimeout and waiting for the response by the
+// ReadTimeout. Like dns.Client.Exchange the returned round trip time doesn't
+// include connecting, and UDP responses with another ID are discarded since
+// they may be late responses to earlier queries. Errors are phaseErrors.
+func (e Experiment) exchange(dnsClient *dns.Client, m *dns.Msg, address string, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	deadline := time.Now().Add(timeout)
+	co, err := e.dial(dnsClient, address, deadline)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer co.Close()
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	} else if opt == nil && dnsClient.UDPSize >= dns.MinMsgSize {
+		co.UDPSize = dnsClient.UDPSize
+	}
+
+	start := time.Now()
+	writeDeadline, phase := phaseDeadline(phaseWrite, e.WriteTimeout, deadline)
+	_ = co.SetWriteDeadline(writeDeadline)
+	if err := co.WriteMsg(m); err != nil {
+		return nil, 0, &phaseError{phase: phase, err: err}
+	}
+	readDeadline, phase := phaseDeadline(phaseRead, e.ReadTimeout, deadline)
+	_ = co.SetReadDeadline(readDeadline)
+	_, datagram := co.Conn.(net.PacketConn)
+	for {
+		in, err := co.ReadMsg()
+		rtt := time.Since(start)
+		if err != nil {
+			return in, rtt, &phaseError{phase: phase, err: err}
+		}
+		if in.Id == m.Id {
+			return in, rtt, nil
+		}
+		if !datagram {
+			return in, rtt, dns.ErrId
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package dnslol
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidTimeouts(t *testing.T) {
+	testCases := []struct {
+		name    string
+		exp     Experiment
+		wantErr bool
+	}{
+		{name: "sub-second timeout", exp: Experiment{Timeout: 250 * time.Millisecond}},
+		{name: "phase timeouts", exp: Experiment{Timeout: time.Second, DialTimeout: 100 * time.Millisecond, ReadTimeout: 800 * time.Millisecond}},
+		{name: "zero timeout", exp: Experiment{}, wantErr: true},
+		{name: "negative timeout", exp: Experiment{Timeout: -time.Second}, wantErr: true},
+		{name: "negative phase timeout", exp: Experiment{Timeout: time.Second, WriteTimeout: -time.Millisecond}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.exp.validTimeouts(); (err != nil) != tc.wantErr {
+				t.Errorf("expected an error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPhaseDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	testCases := []struct {
+		name        string
+		timeout     time.Duration
+		wantPhase   string
+		wantAttempt bool
+	}{
+		{name: "no phase timeout", timeout: 0, wantPhase: phaseTotal, wantAttempt: true},
+		{name: "phase timeout first", timeout: 100 * time.Millisecond, wantPhase: phaseRead},
+		{name: "attempt timeout first", timeout: time.Minute, wantPhase: phaseTotal, wantAttempt: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, phase := phaseDeadline(phaseRead, tc.timeout, deadline)
+			if phase != tc.wantPhase {
+				t.Errorf("expected phase %q, got %q", tc.wantPhase, phase)
+			}
+			if got := d.Equal(deadline); got != tc.wantAttempt {
+				t.Errorf("expected the attempt's deadline %v, got %v", tc.wantAttempt, d)
+			}
+		})
+	}
+}
+
+// mismatchedServer starts a UDP or TCP DNS server that answers every query
+// with a response with another ID, followed for UDP by the real response.
+func mismatchedServer(t *testing.T, network string) string {
+	reply := func(r *dns.Msg, id uint16) []byte {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Id = id
+		buf, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		go func() {
+			buf := make([]byte, dns.MaxMsgSize)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				r := new(dns.Msg)
+				if r.Unpack(buf[:n]) != nil {
+					continue
+				}
+				_, _ = pc.WriteTo(reply(r, r.Id+1), addr)
+				_, _ = pc.WriteTo(reply(r, r.Id), addr)
+			}
+		}()
+		return pc.LocalAddr().String()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			co := &dns.Conn{Conn: c}
+			if r, err := co.ReadMsg(); err == nil {
+				_, _ = co.Write(reply(r, r.Id+1))
+			}
+			co.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestExchangeMismatchedID(t *testing.T) {
+	testCases := []struct {
+		network string
+		wantErr error
+	}{
+		{network: "udp"},
+		{network: "tcp", wantErr: dns.ErrId},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.network, func(t *testing.T) {
+			addr := mismatchedServer(t, tc.network)
+			e := Experiment{Timeout: time.Second}
+			m := new(dns.Msg)
+			m.SetQuestion("example.com.", dns.TypeA)
+			in, _, err := e.exchange(&dns.Client{Net: tc.network}, m, addr, e.Timeout)
+			if err != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if err == nil && in.Id != m.Id {
+				t.Errorf("expected response ID %d, got %d", m.Id, in.Id)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package dnslol
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// tldOther is the tld label value used for TLDs that aren't labelled
+	// individually.
+	tldOther = "other"
+)
+
+// topTLDs is a static list of the most common TLDs by number of registered
+// domains, most common first. It is not derived from the names an Experiment
+// looks up: an Experiment's TLDLabels setting chooses how many of these get
+// their own tld label value unless it has an explicit list of TLDs.
+var topTLDs = []string{
+	"com", "net", "org", "de", "cn", "uk", "ru", "nl", "br", "info",
+	"au", "fr", "it", "eu", "xyz", "ca", "pl", "in", "jp", "es",
+	"ch", "online", "top", "io", "co", "be", "se", "us", "dk", "at",
+	"cz", "ir", "site", "shop", "biz", "vn", "za", "tk", "mx", "ar",
+	"kr", "hu", "gr", "no", "ro", "tw", "pt", "sk", "fi", "club",
+}
+
+// reverseZones are the reverse DNS zones that always get their own tld label
+// value so that reverse lookups aren't all labelled "arpa" or tldOther.
+var reverseZones = []string{"in-addr.arpa", "ip6.arpa"}
+
+// validTLDs checks the Experiment's explicit list of labelled TLDs.
+func (e Experiment) validTLDs() error {
+	for _, tld := range e.TLDs {
+		tld = strings.Trim(tld, ".")
+		if tld == "" || strings.Contains(tld, ".") {
+			return fmt.Errorf("Experiment must have TLDs with a single label each, not %q", tld)
+		}
+	}
+	return nil
+}
+
+// tldSet returns the set of TLDs that get their own label value: the given
+// list of TLDs, or if it is empty the given number of topTLDs.
+func tldSet(tlds []string, n int) map[string]bool {
+	if len(tlds) == 0 {
+		if n > len(topTLDs) {
+			n = len(topTLDs)
+		}
+		tlds = topTLDs[:n]
+	}
+	set := make(map[string]bool, len(tlds))
+	for _, tld := range tlds {
+		set[strings.ToLower(strings.Trim(tld, "."))] = true
+	}
+	return set
+}
+
+// tldLabel returns the tld label value for the given name. Names in one of the
+// reverseZones get the zone as the label value, names in one of the labelled
+// TLDs get the TLD and all others get tldOther.
+func (e Experiment) tldLabel(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, zone := range reverseZones {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return zone
+		}
+	}
+	tld := name[strings.LastIndex(name, ".")+1:]
+	if e.tlds[tld] {
+		return tld
+	}
+	return tldOther
+}
@@ -0,0 +1,54 @@
+package dnslol
+
+import (
+	"testing"
+)
+
+func TestTLDLabel(t *testing.T) {
+	testCases := []struct {
+		name      string
+		tlds      []string
+		tldLabels int
+		lookup    string
+		expected  string
+	}{
+		{name: "common TLD", tldLabels: 20, lookup: "www.example.com.", expected: "com"},
+		{name: "uppercase TLD", tldLabels: 20, lookup: "EXAMPLE.ORG", expected: "org"},
+		{name: "uncommon TLD", tldLabels: 20, lookup: "example.nu", expected: tldOther},
+		{name: "no labels", lookup: "example.com", expected: tldOther},
+		{name: "explicit TLD", tlds: []string{"nu", ".SE"}, lookup: "example.se.", expected: "se"},
+		{name: "explicit list replaces common TLDs", tlds: []string{"nu"}, tldLabels: 20, lookup: "example.com", expected: tldOther},
+		{name: "IPv4 reverse zone", lookup: "4.3.2.1.in-addr.arpa.", expected: "in-addr.arpa"},
+		{name: "IPv6 reverse zone", tldLabels: 20, lookup: "b.a.9.8.ip6.arpa", expected: "ip6.arpa"},
+		{name: "other arpa name", tldLabels: 20, lookup: "example.arpa", expected: tldOther},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := Experiment{tlds: tldSet(tc.tlds, tc.tldLabels)}
+			if label := e.tldLabel(tc.lookup); label != tc.expected {
+				t.Errorf("expected tld label %q, got %q", tc.expected, label)
+			}
+		})
+	}
+}
+
+func TestValidTLDs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		tlds    []string
+		wantErr bool
+	}{
+		{name: "no TLDs"},
+		{name: "TLDs", tlds: []string{"com", ".se."}},
+		{name: "empty TLD", tlds: []string{"com", ""}, wantErr: true},
+		{name: "name instead of TLD", tlds: []string{"co.uk"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Experiment{TLDs: tc.tlds}.validTLDs()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected an error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
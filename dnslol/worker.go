@@ -0,0 +1,392 @@
+package dnslol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// workerHTTPTimeout is the timeout of a worker's requests to the
+	// coordinator.
+	workerHTTPTimeout = 2 * time.Minute
+	// maxCoordinatorFailures is the number of failed requests to the
+	// coordinator in a row after which a worker gives up.
+	maxCoordinatorFailures = 30
+)
+
+// errLeasesDone is returned by coordinatorClient.lease when the coordinator
+// has no more targets to lease.
+var errLeasesDone = errors.New("no more leases")
+
+// coordinatorClient is a worker's client for the coordinator's HTTP API.
+type coordinatorClient struct {
+	// url is the base URL of the coordinator.
+	url string
+	// worker is the name the worker is known by to the coordinator.
+	worker string
+	// token is the bearer token sent to the coordinator.
+	token string
+	http  *http.Client
+	// posts tracks the lease completion requests in progress.
+	posts sync.WaitGroup
+}
+
+// do sends a request to the coordinator's API at path with the client's
+// bearer token.
+func (cc *coordinatorClient) do(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, cc.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cc.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return cc.http.Do(req)
+}
+
+// postForm sends a POST request with the given form values to the
+// coordinator's API at path.
+func (cc *coordinatorClient) postForm(path string, values url.Values) (*http.Response, error) {
+	return cc.do(http.MethodPost, path, "application/x-www-form-urlencoded",
+		strings.NewReader(values.Encode()))
+}
+
+// httpError returns an error for an unexpected response from the coordinator.
+func httpError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("coordinator returned %s: %s",
+		resp.Status, strings.TrimSpace(string(body)))
+}
+
+// config returns the coordinator's workerConfig.
+func (cc *coordinatorClient) config() (workerConfig, error) {
+	var cfg workerConfig
+	resp, err := cc.do(http.MethodGet, "/experiment", "", nil)
+	if err != nil {
+		return cfg, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cfg, httpError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&cfg)
+	return cfg, err
+}
+
+// lease asks the coordinator for a lease of at most size targets. It returns a
+// nil lease if there are no targets to lease right now, and errLeasesDone if
+// there won't be any more.
+func (cc *coordinatorClient) lease(size int) (*leaseResponse, error) {
+	resp, err := cc.postForm("/leases", url.Values{
+		"worker": {cc.worker},
+		"size":   {strconv.Itoa(size)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var l leaseResponse
+		if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+			return nil, err
+		}
+		return &l, nil
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusGone:
+		return nil, errLeasesDone
+	}
+	return nil, httpError(resp)
+}
+
+// extend extends the lease with the given ID. It returns errLeaseExpired if
+// the lease is no longer held.
+func (cc *coordinatorClient) extend(id int64) error {
+	resp, err := cc.postForm(fmt.Sprintf("/leases/%d/extend", id), url.Values{
+		"worker": {cc.worker},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errLeaseExpired
+	}
+	return httpError(resp)
+}
+
+// keepLease extends the lease of a batch every third of the lease's timeout
+// until the batch's results have been sent, so that the coordinator doesn't
+// give the targets of a batch that takes long, e.g. because of a low QPS
+// limit, to another worker.
+func (cc *coordinatorClient) keepLease(b *workerBatch, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			err := cc.extend(b.id)
+			if err == errLeaseExpired {
+				log.Printf("Lease %d expired before it was extended\n", b.id)
+				return
+			}
+			if err != nil {
+				log.Printf("Error extending lease %d: %v\n", b.id, err)
+			}
+		}
+	}
+}
+
+// complete sends the results of a finished batch to the coordinator in the
+// background, retrying failed requests. If the lease expired before the
+// results were sent they are discarded by the coordinator.
+func (cc *coordinatorClient) complete(b *workerBatch) {
+	cc.posts.Add(1)
+	go func() {
+		defer cc.posts.Done()
+		defer close(b.done)
+		body, err := json.Marshal(leaseResults{Targets: b.results})
+		if err != nil {
+			log.Printf("Error encoding results of lease %d: %v\n", b.id, err)
+			return
+		}
+		for i := 0; i < maxCoordinatorFailures; i++ {
+			err = cc.post(b.id, body)
+			if err == nil {
+				return
+			}
+			log.Printf("Error sending results of lease %d: %v\n", b.id, err)
+			if err == errLeaseExpired {
+				return
+			}
+			time.Sleep(leasePoll)
+		}
+		log.Printf("Giving up sending results of lease %d\n", b.id)
+	}()
+}
+
+// errLeaseExpired is returned by coordinatorClient.post when the coordinator
+// rejects the results because the lease is no longer held.
+var errLeaseExpired = errors.New("lease expired before its results were sent, they were discarded")
+
+// post sends the encoded leaseResults of a lease to the coordinator.
+func (cc *coordinatorClient) post(id int64, body []byte) error {
+	resp, err := cc.do(http.MethodPost,
+		fmt.Sprintf("/leases/%d", id), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errLeaseExpired
+	}
+	return httpError(resp)
+}
+
+// workerBatch collects the results of the targets of one lease. Once every
+// target is finished the results are sent to the coordinator.
+type workerBatch struct {
+	id     int64
+	client *coordinatorClient
+	// done is closed once the results have been sent, or given up on.
+	done chan struct{}
+
+	sync.Mutex
+	// remaining is the number of targets not yet finished.
+	remaining int
+	// results holds the results of each target, in the lease's order.
+	results [][]workerResult
+}
+
+// newWorkerBatch returns the workerBatch for a lease.
+func newWorkerBatch(l *leaseResponse, client *coordinatorClient) *workerBatch {
+	return &workerBatch{
+		id:        l.ID,
+		client:    client,
+		done:      make(chan struct{}),
+		remaining: len(l.Targets),
+		results:   make([][]workerResult, len(l.Targets)),
+	}
+}
+
+// collect returns a handler for the query results of the batch's target with
+// the given index and a function to call once all of the target's queries are
+// complete.
+func (b *workerBatch) collect(i int) (func(queryResult), func()) {
+	var mu sync.Mutex
+	var results []workerResult
+	handle := func(r queryResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, newWorkerResult(r))
+	}
+	finished := func() {
+		b.Lock()
+		b.results[i] = results
+		b.remaining--
+		done := b.remaining == 0
+		b.Unlock()
+		if done {
+			b.client.complete(b)
+		}
+	}
+	return handle, finished
+}
+
+// validWorker checks the worker settings of the Experiment.
+func (e Experiment) validWorker() error {
+	u, err := url.Parse(e.Coordinator)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Experiment must have an http or https Coordinator URL to work for")
+	}
+	if e.BatchSize < 1 {
+		return errors.New("Experiment must have a BatchSize greater than 0")
+	}
+	if e.ControlToken == "" {
+		return errors.New("Experiment must have the coordinator's ControlToken to work for it")
+	}
+	return nil
+}
+
+// leaseBatches leases batches of targets from the coordinator and sends them
+// to the names channel, adding each to the WaitGroup, until the coordinator
+// has no more targets or the Experiment is stopped. A batch is always sent
+// in full so that its lease can be completed.
+func (e Experiment) leaseBatches(cc *coordinatorClient, names chan<- Target, wg *sync.WaitGroup) error {
+	failures := 0
+	for !e.isStopped() {
+		l, err := cc.lease(e.BatchSize)
+		if err == errLeasesDone {
+			return nil
+		}
+		if err != nil {
+			failures++
+			if failures >= maxCoordinatorFailures {
+				return fmt.Errorf("leasing targets from coordinator: %v", err)
+			}
+			log.Printf("Error leasing targets from coordinator: %v\n", err)
+		} else {
+			failures = 0
+		}
+		if l == nil || len(l.Targets) == 0 {
+			select {
+			case <-time.After(leasePoll):
+			case <-e.Stopped():
+			}
+			continue
+		}
+
+		batch := newWorkerBatch(l, cc)
+		go cc.keepLease(batch, l.Timeout)
+		for i, target := range l.Targets {
+			target.batch, target.batchIndex = batch, i
+			wg.Add(1)
+			names <- target
+		}
+	}
+	return nil
+}
+
+// Work runs the given Experiment as a worker of a distributed run, performing
+// the queries for targets leased from the coordinator (see Coordinate) at the
+// Experiment's Coordinator URL and sending the results back to it. The worker
+// authenticates with its ControlToken, which must be the coordinator's, and
+// extends its leases until their results have been sent. The Experiment's
+// servers, protocol, timeouts, query types, Count, retry policy, resolver set
+// and circuit breaker settings are replaced by the coordinator's so that every
+// worker performs the same queries; the other settings, e.g. Parallel, the
+// rate limits, the ramp schedule and the HealthCheck, are the worker's own. A
+// worker doesn't use a database: its results are saved by the coordinator.
+// Like Start it runs a metrics server with the status and control API. Work
+// blocks until the coordinator has no more targets or the Experiment is
+// stopped, and the results of every leased batch have been sent. It logs the
+// worker's run summary before returning.
+func Work(e *Experiment) error {
+	if err := e.validWorker(); err != nil {
+		return err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	cc := &coordinatorClient{
+		url:    strings.TrimSuffix(e.Coordinator, "/"),
+		worker: fmt.Sprintf("%s-%d", host, os.Getpid()),
+		token:  e.ControlToken,
+		http:   &http.Client{Timeout: workerHTTPTimeout},
+	}
+	cfg, err := cc.config()
+	if err != nil {
+		return fmt.Errorf("getting experiment from coordinator: %v", err)
+	}
+	e.id = cfg.ID
+	e.Servers = cfg.Servers
+	e.Proto = cfg.Proto
+	e.Timeout = cfg.Timeout
+	e.DialTimeout, e.TLSHandshakeTimeout = cfg.DialTimeout, cfg.TLSHandshakeTimeout
+	e.WriteTimeout, e.ReadTimeout = cfg.WriteTimeout, cfg.ReadTimeout
+	e.CheckA, e.CheckAAAA, e.CheckTXT = cfg.CheckA, cfg.CheckAAAA, cfg.CheckTXT
+	e.Count = cfg.Count
+	e.Attempts, e.AttemptTimeout, e.RetryBackoff = cfg.Attempts, cfg.AttemptTimeout, cfg.RetryBackoff
+	e.RetryOn, e.Failover = cfg.RetryOn, cfg.Failover
+	e.ResolverSet, e.HedgeDelay = cfg.ResolverSet, cfg.HedgeDelay
+	e.HedgePercentile = cfg.HedgePercentile
+	e.BreakerFailures, e.BreakerCooldown = cfg.BreakerFailures, cfg.BreakerCooldown
+	if err := e.Valid(); err != nil {
+		return err
+	}
+	if e.HealthCheck {
+		if err := e.checkHealth(); err != nil {
+			return err
+		}
+	}
+	e.servers = make([]server, len(e.Servers))
+	for i, addr := range e.Servers {
+		e.servers[i] = server{address: addr}
+	}
+	dnsClient, err := e.prepare(0)
+	if err != nil {
+		return err
+	}
+
+	names := make(chan Target)
+	var wg sync.WaitGroup
+	spawn(*e, dnsClient, names, &wg)
+	e.startMetrics()
+	log.Printf("Working on experiment %d for coordinator %s as %q\n",
+		e.id, e.Coordinator, cc.worker)
+
+	err = e.leaseBatches(cc, names, &wg)
+	close(names)
+	wg.Wait()
+	cc.posts.Wait()
+	if _, ferr := e.finish(); ferr != nil && err == nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package dnslol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestWorkerBatchOrder(t *testing.T) {
+	c, cc, wg := testCoordinator(t, time.Minute, "a.example", "b.example", "c.example")
+	l, err := cc.lease(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newWorkerBatch(l, cc)
+
+	// The targets finish in another order than they were leased in.
+	for _, i := range []int{2, 0, 1} {
+		handle, finished := b.collect(i)
+		handle(queryResult{query: query{
+			Server:  server{address: testServer},
+			Primary: server{address: testServer},
+			Name:    l.Targets[i].Name,
+			Type:    dns.TypeA,
+			Attempt: 1,
+		}})
+		finished()
+	}
+	select {
+	case <-b.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the batch's results to be sent")
+	}
+	cc.posts.Wait()
+	wg.Wait()
+	if c.held(l.ID) {
+		t.Errorf("expected lease %d to be completed", l.ID)
+	}
+	for i, results := range b.results {
+		if len(results) != 1 || results[0].Name != l.Targets[i].Name {
+			t.Errorf("expected result %d for %q, got %+v", i, l.Targets[i].Name, results)
+		}
+	}
+}
+
+func TestWorkerKeepLease(t *testing.T) {
+	const timeout = 150 * time.Millisecond
+	c, cc, _ := testCoordinator(t, timeout, "a.example")
+	l, err := cc.lease(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newWorkerBatch(l, cc)
+	kept := make(chan struct{})
+	go func() {
+		cc.keepLease(b, l.Timeout)
+		close(kept)
+	}()
+
+	// The lease is kept while the batch is in progress.
+	for end := time.Now().Add(4 * timeout); time.Now().Before(end); {
+		time.Sleep(timeout / 5)
+		c.expire(time.Now())
+		if !c.held(l.ID) {
+			t.Fatalf("expected lease %d to be kept while the batch is in progress", l.ID)
+		}
+	}
+
+	// Once the batch's results are sent it isn't extended anymore.
+	close(b.done)
+	select {
+	case <-kept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected keepLease to return once the batch is done")
+	}
+	time.Sleep(timeout + 10*time.Millisecond)
+	c.expire(time.Now())
+	if c.held(l.ID) {
+		t.Errorf("expected lease %d to expire once it isn't extended", l.ID)
+	}
+}
+
+func TestValidWorker(t *testing.T) {
+	testCases := []struct {
+		name     string
+		exp      Experiment
+		expected string
+	}{
+		{
+			name:     "valid",
+			exp:      Experiment{Coordinator: "http://10.0.0.1:6565", BatchSize: 10, ControlToken: testToken},
+			expected: "",
+		},
+		{
+			name:     "no coordinator",
+			exp:      Experiment{BatchSize: 10, ControlToken: testToken},
+			expected: "Experiment must have an http or https Coordinator URL to work for",
+		},
+		{
+			name:     "not http",
+			exp:      Experiment{Coordinator: "ftp://10.0.0.1", BatchSize: 10, ControlToken: testToken},
+			expected: "Experiment must have an http or https Coordinator URL to work for",
+		},
+		{
+			name:     "no batch size",
+			exp:      Experiment{Coordinator: "http://10.0.0.1:6565", ControlToken: testToken},
+			expected: "Experiment must have a BatchSize greater than 0",
+		},
+		{
+			name:     "no token",
+			exp:      Experiment{Coordinator: "http://10.0.0.1:6565", BatchSize: 10},
+			expected: "Experiment must have the coordinator's ControlToken to work for it",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.exp.validWorker()
+			if tc.expected == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if tc.expected != "" && (err == nil || err.Error() != tc.expected) {
+				t.Errorf("expected error %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Package dnsname validates and normalizes the domain names dnslol looks up,
+// whether they are read from its input or requested from its lookup service.
+package dnsname
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	// maxNameLength is the longest domain name in presentation format without
+	// a trailing dot, in octets. RFC 1035 limits names to 255 octets in wire
+	// format, which includes a length octet for each label and the root.
+	maxNameLength = 253
+	// maxLabelLength is the longest label, in octets.
+	maxLabelLength = 63
+)
+
+// idnaProfile converts Unicode names to ASCII using the UTS #46 lookup mapping
+// with the IDNA2008 (non-transitional) rules, e.g. "faß.de" becomes
+// "xn--fa-hia.de" rather than "fass.de". Underscores and wildcards are allowed
+// since they are common in DNS names even though they aren't valid in host
+// names.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.BidiRule(),
+	idna.StrictDomainName(false))
+
+// isASCII returns true if the given name only has ASCII characters.
+func isASCII(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// isDNSCharacter returns true if the given byte is a valid character for a
+// label of a DNS name: a letter, digit, hyphen or underscore.
+func isDNSCharacter(ch byte) bool {
+	return ('a' <= ch && ch <= 'z') ||
+		('A' <= ch && ch <= 'Z') ||
+		('0' <= ch && ch <= '9') ||
+		ch == '-' || ch == '_'
+}
+
+// Check returns an error if the given name isn't a valid ASCII domain name
+// without a trailing dot. Labels must be 1 to 63 letters, digits, hyphens or
+// underscores, and the name must be at most 253 octets. The first label may be
+// a "*" wildcard.
+func Check(name string) error {
+	if name == "" {
+		return errors.New("name is empty")
+	}
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name is longer than %d octets", maxNameLength)
+	}
+	for i, label := range strings.Split(name, ".") {
+		if label == "" {
+			return errors.New("name has an empty label")
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("label %q is longer than %d octets", label, maxLabelLength)
+		}
+		if label == "*" && i == 0 {
+			continue
+		}
+		for _, ch := range []byte(label) {
+			if !isDNSCharacter(ch) {
+				return fmt.Errorf("label %q has invalid character %q", label, ch)
+			}
+		}
+	}
+	return nil
+}
+
+// Normalize returns the given name in the form dnslol looks it up and compares
+// it in: lower case, without a trailing dot or a "*" wildcard label, and
+// converted to ASCII if it has Unicode characters and toASCII is true. An
+// error is returned if the result isn't a valid domain name.
+func Normalize(name string, toASCII bool) (string, error) {
+	if !isASCII(name) {
+		if !toASCII {
+			return "", errors.New("name isn't ASCII encoded (IDNA conversion is disabled)")
+		}
+		ascii, err := idnaProfile.ToASCII(name)
+		if err != nil {
+			return "", fmt.Errorf("IDNA conversion failed: %v", err)
+		}
+		name = ascii
+	}
+	name = strings.TrimSuffix(name, ".")
+	if err := Check(name); err != nil {
+		return "", err
+	}
+	if name == "*" {
+		return "", errors.New("name is only a wildcard")
+	}
+	return strings.ToLower(strings.TrimPrefix(name, "*.")), nil
+}
@@ -0,0 +1,52 @@
+package dnsname
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	testCases := []struct {
+		name    string
+		toASCII bool
+		want    string
+		wantErr string
+	}{
+		{name: "example.com", want: "example.com"},
+		{name: "example.com.", want: "example.com"},
+		{name: "_dmarc.example.com", want: "_dmarc.example.com"},
+		{name: "Example.COM", want: "example.com"},
+		{name: "*.example.com", want: "example.com"},
+		{name: "*.Example.com.", want: "example.com"},
+		{name: "*", wantErr: "only a wildcard"},
+		{name: "bücher.example", toASCII: true, want: "xn--bcher-kva.example"},
+		{name: "faß.de", toASCII: true, want: "xn--fa-hia.de"},
+		{name: "bücher.example", wantErr: "isn't ASCII encoded"},
+		{name: "", wantErr: "name is empty"},
+		{name: ".", wantErr: "name is empty"},
+		{name: "a..example.com", wantErr: "empty label"},
+		{name: ".example.com", wantErr: "empty label"},
+		{name: "*.*.example.com", wantErr: `label "*" has invalid character`},
+		{name: "www.*.example.com", wantErr: `label "*" has invalid character`},
+		{name: "exa mple.com", wantErr: "invalid character ' '"},
+		{name: strings.Repeat("a", 64) + ".com", wantErr: "longer than 63 octets"},
+		{name: strings.Repeat("a.", 127) + "com", wantErr: "longer than 253 octets"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Normalize(tc.name, tc.toASCII)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
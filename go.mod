@@ -2,9 +2,25 @@ module github.com/letsencrypt/dns-lots-of-lookups
 
 require (
 	github.com/go-sql-driver/mysql v1.4.0
+	github.com/klauspost/compress v1.11.13
 	github.com/miekg/dns v1.0.14
-	github.com/prometheus/client_golang v1.2.1
-	google.golang.org/appengine v1.2.0 // indirect
+	github.com/prometheus/client_golang v1.14.0
+	golang.org/x/net v0.10.0
 )
 
-go 1.13
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/appengine v1.6.6 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
+)
+
+go 1.17
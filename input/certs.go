@@ -0,0 +1,226 @@
+package input
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+	"github.com/letsencrypt/dns-lots-of-lookups/dnsname"
+)
+
+const (
+	// ctX509Entry and ctPrecertEntry are the LogEntryType values of RFC 6962
+	// log entries.
+	ctX509Entry    = 0
+	ctPrecertEntry = 1
+)
+
+// certTargets returns a target for each distinct DNS SAN of the given
+// certificate, with the certificate's serial as the source. SANs are compared
+// as normalized by dnsname.Normalize, so a wildcard SAN and the name it covers
+// are looked up once. SANs that aren't valid names are returned as they are
+// for the Source to report.
+func certTargets(cert *x509.Certificate) []dnslol.Target {
+	// The same format Boulder uses for serials.
+	serial := fmt.Sprintf("%036x", cert.SerialNumber)
+	seen := make(map[string]bool, len(cert.DNSNames))
+	var targets []dnslol.Target
+	for _, san := range cert.DNSNames {
+		key, err := dnsname.Normalize(san, false)
+		if err != nil {
+			key = san
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		targets = append(targets, dnslol.Target{Name: san, Source: serial})
+	}
+	return targets
+}
+
+// certReader reads FormatCert inputs.
+type certReader struct {
+	name string
+	// rest is the PEM input that hasn't been read yet.
+	rest []byte
+	// der holds the remaining certificates of a DER input.
+	der []*x509.Certificate
+	// certs is the number of PEM certificates read.
+	certs int
+	// pending holds the remaining targets of the last certificate.
+	pending []dnslol.Target
+}
+
+func newCertReader(r io.Reader, name string, opts Options) (reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cr := &certReader{name: name}
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		cr.rest = data
+	} else if len(data) > 0 {
+		// The input may be several concatenated DER certificates.
+		if cr.der, err = x509.ParseCertificates(data); err != nil {
+			return nil, fmt.Errorf("parsing DER certificates: %v", err)
+		}
+	}
+	return cr, nil
+}
+
+// next returns the next certificate, or nil if there are no more.
+func (cr *certReader) next() (*x509.Certificate, error) {
+	if len(cr.der) > 0 {
+		cert := cr.der[0]
+		cr.der = cr.der[1:]
+		return cert, nil
+	}
+	for {
+		var block *pem.Block
+		block, cr.rest = pem.Decode(cr.rest)
+		if block == nil {
+			return nil, nil
+		}
+		// Bundles can also have keys, CSRs, etc.
+		if block.Type == "CERTIFICATE" {
+			cr.certs++
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("certificate %d: %v", cr.certs, err)
+			}
+			return cert, nil
+		}
+	}
+}
+
+// Next returns the next DNS SAN of the input's certificates.
+func (cr *certReader) Next() (dnslol.Target, error) {
+	for len(cr.pending) == 0 {
+		cert, err := cr.next()
+		if err != nil {
+			return dnslol.Target{}, fmt.Errorf("%s: %v", cr.name, err)
+		}
+		if cert == nil {
+			return dnslol.Target{}, io.EOF
+		}
+		cr.pending = certTargets(cert)
+	}
+	target := cr.pending[0]
+	cr.pending = cr.pending[1:]
+	return target, nil
+}
+
+// ctEntry is a log entry in the format of the RFC 6962 get-entries API.
+type ctEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// ctReader reads FormatCT inputs.
+type ctReader struct {
+	name string
+	dec  *json.Decoder
+	// entries is the number of entries read.
+	entries int
+	// queued holds the remaining entries of a get-entries response.
+	queued []ctEntry
+	// pending holds the remaining targets of the last entry.
+	pending []dnslol.Target
+}
+
+func newCTReader(r io.Reader, name string, opts Options) (reader, error) {
+	return &ctReader{name: name, dec: json.NewDecoder(r)}, nil
+}
+
+// opaque24 splits a TLS opaque value with a 24 bit length prefix from the
+// start of b.
+func opaque24(b []byte) ([]byte, []byte, error) {
+	if len(b) < 3 {
+		return nil, nil, errors.New("truncated length")
+	}
+	n := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	if len(b) < 3+n {
+		return nil, nil, errors.New("truncated value")
+	}
+	return b[3 : 3+n], b[3+n:], nil
+}
+
+// entryCertificate returns the DER of the certificate or precertificate of a
+// log entry.
+func entryCertificate(entry ctEntry) ([]byte, error) {
+	// A MerkleTreeLeaf has a version, leaf type, timestamp and entry type
+	// before the entry.
+	leaf := entry.LeafInput
+	if len(leaf) < 12 || leaf[0] != 0 || leaf[1] != 0 {
+		return nil, errors.New("unsupported leaf_input")
+	}
+	switch binary.BigEndian.Uint16(leaf[10:12]) {
+	case ctX509Entry:
+		der, _, err := opaque24(leaf[12:])
+		return der, err
+	case ctPrecertEntry:
+		// The leaf only has the TBSCertificate, but the extra data starts
+		// with the whole precertificate.
+		der, _, err := opaque24(entry.ExtraData)
+		return der, err
+	}
+	return nil, errors.New("unknown entry type")
+}
+
+// nextEntry returns the next log entry, or io.EOF if there are no more.
+func (cr *ctReader) nextEntry() (ctEntry, error) {
+	for len(cr.queued) == 0 {
+		var v struct {
+			ctEntry
+			Entries []ctEntry `json:"entries"`
+		}
+		if err := cr.dec.Decode(&v); err != nil {
+			return ctEntry{}, err
+		}
+		if v.LeafInput != nil {
+			cr.queued = append(cr.queued, v.ctEntry)
+		}
+		cr.queued = append(cr.queued, v.Entries...)
+	}
+	entry := cr.queued[0]
+	cr.queued = cr.queued[1:]
+	return entry, nil
+}
+
+// Next returns the next DNS SAN of the log entries' certificates. Entries
+// that can't be parsed are logged and skipped since logs contain certificates
+// that are too malformed for the x509 package.
+func (cr *ctReader) Next() (dnslol.Target, error) {
+	for len(cr.pending) == 0 {
+		entry, err := cr.nextEntry()
+		if err == io.EOF {
+			return dnslol.Target{}, io.EOF
+		}
+		if err != nil {
+			return dnslol.Target{}, fmt.Errorf("%s: %v", cr.name, err)
+		}
+		cr.entries++
+		der, err := entryCertificate(entry)
+		if err == nil {
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(der); err == nil {
+				cr.pending = certTargets(cert)
+			}
+		}
+		if err != nil {
+			log.Printf("%s: skipping entry %d: %v\n", cr.name, cr.entries, err)
+		}
+	}
+	target := cr.pending[0]
+	cr.pending = cr.pending[1:]
+	return target, nil
+}
@@ -0,0 +1,101 @@
+package input
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+)
+
+// testCertificate returns the DER of a self-signed certificate with the given
+// serial and DNS SANs.
+func testCertificate(t *testing.T, serial int64, sans ...string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     sans,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// opaque24Bytes prefixes b with its 24 bit length.
+func opaque24Bytes(b []byte) []byte {
+	return append([]byte{byte(len(b) >> 16), byte(len(b) >> 8), byte(len(b))}, b...)
+}
+
+// ctLeaf returns the leaf_input of a log entry of the given type, with the
+// given value after the entry type.
+func ctLeaf(entryType byte, value []byte) []byte {
+	// Version, leaf type, an 8 byte timestamp and the 2 byte entry type.
+	leaf := append(make([]byte, 11), entryType)
+	return append(leaf, value...)
+}
+
+func TestCertReaders(t *testing.T) {
+	first := testCertificate(t, 0x1234, "*.Example.com", "example.com", "www.example.com.")
+	second := testCertificate(t, 0x5678, "example.org")
+	firstSerial, secondSerial := fmt.Sprintf("%036x", 0x1234), fmt.Sprintf("%036x", 0x5678)
+	expected := []dnslol.Target{
+		{Name: "example.com", Source: firstSerial},
+		{Name: "www.example.com", Source: firstSerial},
+		{Name: "example.org", Source: secondSerial},
+	}
+
+	pemBundle := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("not a certificate")})
+	pemBundle = append(pemBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: first})...)
+	pemBundle = append(pemBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: second})...)
+
+	x509Entry := ctEntry{LeafInput: ctLeaf(ctX509Entry, opaque24Bytes(first))}
+	precertEntry := ctEntry{
+		// The leaf of a precertificate entry has the TBSCertificate, which
+		// isn't used.
+		LeafInput: ctLeaf(ctPrecertEntry, opaque24Bytes([]byte("tbs"))),
+		ExtraData: opaque24Bytes(second),
+	}
+	malformedEntry := ctEntry{LeafInput: []byte{1, 2, 3}}
+	entryLine, err := json.Marshal(x509Entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := json.Marshal(map[string][]ctEntry{"entries": {malformedEntry, precertEntry}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		format   string
+		contents []byte
+	}{
+		{name: "PEM bundle", format: FormatCert, contents: pemBundle},
+		{name: "DER", format: FormatCert, contents: append(append([]byte{}, first...), second...)},
+		{name: "CT entries", format: FormatCT, contents: append(append(entryLine, '\n'), response...)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeInput(t, "certs", tc.contents)
+			if targets := readTargets(t, path, Options{Format: tc.format}); !reflect.DeepEqual(targets, expected) {
+				t.Errorf("expected targets %v, got %v", expected, targets)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package input
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+)
+
+const (
+	// DedupNone doesn't remove duplicate targets.
+	DedupNone = "none"
+	// DedupExact removes duplicate targets by remembering every target seen.
+	// Memory use grows with the number of distinct targets.
+	DedupExact = "exact"
+	// DedupBloom removes duplicate targets using a bloom filter sized for
+	// Options.DedupCapacity targets. Memory use is fixed but a small fraction
+	// of distinct targets (bloomFalsePositiveRate at capacity) are wrongly
+	// removed as duplicates.
+	DedupBloom = "bloom"
+
+	// DefaultDedupCapacity is the default Options.DedupCapacity.
+	DefaultDedupCapacity = 100000000
+	// bloomFalsePositiveRate is the rate at which a DedupBloom filter at
+	// capacity wrongly reports a distinct target as a duplicate.
+	bloomFalsePositiveRate = 0.001
+)
+
+// validFilter checks the dedup, sampling and sharding settings of the Options.
+func (opts Options) validFilter() error {
+	switch opts.Dedup {
+	case "", DedupNone, DedupExact, DedupBloom:
+	default:
+		return fmt.Errorf("unknown dedup mode %q, must be %q, %q or %q",
+			opts.Dedup, DedupNone, DedupExact, DedupBloom)
+	}
+	if opts.DedupCapacity < 0 {
+		return errors.New("dedup capacity must not be negative")
+	}
+	if opts.Sample < 0 || opts.Sample > 1 {
+		return errors.New("sample must be between 0 and 1")
+	}
+	if opts.Shards < 0 {
+		return errors.New("shards must not be negative")
+	}
+	if opts.Shards > 0 && (opts.Shard < 0 || opts.Shard >= opts.Shards) {
+		return fmt.Errorf("shard must be between 0 and %d", opts.Shards-1)
+	}
+	return nil
+}
+
+// A Filter removes duplicate targets, samples targets and keeps the targets
+// of one shard across all of the inputs of an Experiment according to the
+// dedup, sampling and sharding settings of the Options. It is not safe for
+// concurrent use.
+type Filter struct {
+	seen dedupSet
+	// threshold is the largest sampling hash of a kept name. Sampling is
+	// disabled if it is the maximum uint64.
+	threshold uint64
+	seed      [8]byte
+	// shard and shards are the shard of the names that is kept and the number
+	// of shards. Sharding is disabled if shards is zero.
+	shard, shards uint64
+
+	// Duplicates is the number of targets removed as duplicates.
+	Duplicates int64
+	// Unsampled is the number of targets not chosen by sampling.
+	Unsampled int64
+	// OtherShards is the number of targets in other shards.
+	OtherShards int64
+}
+
+// NewFilter creates a Filter for the given Options.
+func NewFilter(opts Options) *Filter {
+	f := &Filter{threshold: math.MaxUint64}
+	switch opts.Dedup {
+	case DedupExact:
+		f.seen = make(exactSet)
+	case DedupBloom:
+		capacity := opts.DedupCapacity
+		if capacity == 0 {
+			capacity = DefaultDedupCapacity
+		}
+		f.seen = newBloomSet(capacity, bloomFalsePositiveRate)
+	}
+	if opts.Sample > 0 && opts.Sample < 1 {
+		f.threshold = uint64(opts.Sample * math.MaxUint64)
+	}
+	binary.BigEndian.PutUint64(f.seed[:], opts.Seed)
+	if opts.Shards > 0 {
+		f.shard, f.shards = uint64(opts.Shard), uint64(opts.Shards)
+	}
+	return f
+}
+
+// Keep returns true if the given target should be looked up. Targets are
+// compared by their name as normalized by their Source. It returns false
+// if the target is in another shard, is a duplicate of a target already kept
+// (the same name and query types) or isn't chosen by sampling. Sharding and
+// sampling are deterministic: for the same Shards, Seed and Sample the same
+// names are chosen in every run and by every process.
+func (f *Filter) Keep(target dnslol.Target) bool {
+	name := target.Name
+	if f.shards > 0 {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		if h.Sum64()%f.shards != f.shard {
+			f.OtherShards++
+			return false
+		}
+	}
+	if f.threshold != math.MaxUint64 {
+		h := fnv.New64a()
+		h.Write(f.seed[:])
+		h.Write([]byte(name))
+		if h.Sum64() > f.threshold {
+			f.Unsampled++
+			return false
+		}
+	}
+	if f.seen != nil {
+		key := name
+		for _, typ := range target.Types {
+			key += fmt.Sprintf("/%d", typ)
+		}
+		if !f.seen.add(key) {
+			f.Duplicates++
+			return false
+		}
+	}
+	return true
+}
+
+// A dedupSet remembers the targets seen by a Filter.
+type dedupSet interface {
+	// add adds the key to the set, returning false if it was already there.
+	add(key string) bool
+}
+
+// exactSet is a dedupSet that remembers every key.
+type exactSet map[string]struct{}
+
+func (s exactSet) add(key string) bool {
+	if _, ok := s[key]; ok {
+		return false
+	}
+	s[key] = struct{}{}
+	return true
+}
+
+// bloomSet is a dedupSet using a bloom filter. A key that wasn't added may
+// be wrongly reported as already in the set, but never the other way around.
+type bloomSet struct {
+	bits []uint64
+	// m is the number of bits and k is the number of hash functions.
+	m, k uint64
+}
+
+// newBloomSet creates a bloomSet sized to hold n keys with the given false
+// positive rate.
+func newBloomSet(n int, rate float64) *bloomSet {
+	m := uint64(math.Ceil(-float64(n) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomSet{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+func (s *bloomSet) add(key string) bool {
+	// Derive the k bit indexes from two 64 bit hashes (Kirsch-Mitzenmacher).
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	h1, h2 := binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:])
+	added := false
+	for i := uint64(0); i < s.k; i++ {
+		bit := (h1 + i*h2) % s.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if s.bits[word]&mask == 0 {
+			s.bits[word] |= mask
+			added = true
+		}
+	}
+	return added
+}
@@ -0,0 +1,202 @@
+package input
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+	"github.com/miekg/dns"
+)
+
+func TestFilterDedup(t *testing.T) {
+	// The targets as a Source returns them, with normalized names.
+	targets := []dnslol.Target{
+		{Name: "example.com"},
+		{Name: "example.org"},
+		{Name: "example.com"},
+		{Name: "example.com", Types: []uint16{dns.TypeTXT}},
+		{Name: "example.com", Types: []uint16{dns.TypeTXT}},
+	}
+	testCases := []struct {
+		dedup    string
+		expected int64
+	}{
+		{dedup: DedupNone},
+		{dedup: DedupExact, expected: 2},
+		{dedup: DedupBloom, expected: 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.dedup, func(t *testing.T) {
+			f := NewFilter(Options{Dedup: tc.dedup, DedupCapacity: 1000})
+			var kept int64
+			for _, target := range targets {
+				if f.Keep(target) {
+					kept++
+				}
+			}
+			if f.Duplicates != tc.expected || kept != int64(len(targets))-tc.expected {
+				t.Errorf("expected %d duplicates, got %d (%d kept)", tc.expected, f.Duplicates, kept)
+			}
+		})
+	}
+}
+
+func TestFilterWildcardDedup(t *testing.T) {
+	// Wildcard names are duplicates of the names they cover once a Source
+	// has normalized them.
+	path := writeInput(t, "names.txt", []byte("*.example.com\nExample.com.\nwww.example.com\n"))
+	n, err := Count([]string{path}, Options{Format: FormatAuto, Dedup: DedupExact})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 distinct names, got %d", n)
+	}
+}
+
+func TestBloomSetFalsePositives(t *testing.T) {
+	const n = 10000
+	s := newBloomSet(n, bloomFalsePositiveRate)
+	var falsePositives int
+	for i := 0; i < n; i++ {
+		if !s.add(fmt.Sprintf("n%d.example", i)) {
+			falsePositives++
+		}
+	}
+	// Well above the expected false positive rate, to keep the test stable.
+	if max := int(n * bloomFalsePositiveRate * 5); falsePositives > max {
+		t.Errorf("expected at most %d false positives, got %d", max, falsePositives)
+	}
+	for i := 0; i < 100; i++ {
+		if s.add(fmt.Sprintf("n%d.example", i)) {
+			t.Fatalf("expected n%d.example to be a duplicate", i)
+		}
+	}
+}
+
+func TestFilterSample(t *testing.T) {
+	const n = 100000
+	// kept returns the names kept by a Filter sampling with the given seed.
+	kept := func(seed uint64) map[string]bool {
+		f := NewFilter(Options{Sample: 0.1, Seed: seed})
+		names := make(map[string]bool)
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("n%d.example", i)
+			if f.Keep(dnslol.Target{Name: name}) {
+				names[name] = true
+			}
+		}
+		if f.Unsampled != int64(n-len(names)) {
+			t.Errorf("expected %d unsampled names, got %d", n-len(names), f.Unsampled)
+		}
+		return names
+	}
+	first, again, other := kept(1), kept(1), kept(2)
+	if len(first) < n/10*9/10 || len(first) > n/10*11/10 {
+		t.Errorf("expected about %d sampled names, got %d", n/10, len(first))
+	}
+	if len(again) != len(first) {
+		t.Errorf("expected the same sample with the same seed, got %d and %d names", len(first), len(again))
+	}
+	for name := range first {
+		if !again[name] {
+			t.Fatalf("expected %s in the sample with the same seed", name)
+		}
+	}
+	var common int
+	for name := range first {
+		if other[name] {
+			common++
+		}
+	}
+	if common == len(first) {
+		t.Errorf("expected a different sample with another seed")
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "defaults", opts: Options{}},
+		{name: "all settings", opts: Options{Dedup: DedupBloom, DedupCapacity: 10, Sample: 0.5, Shard: 1, Shards: 2}},
+		{name: "unknown dedup", opts: Options{Dedup: "fuzzy"}, wantErr: true},
+		{name: "negative capacity", opts: Options{DedupCapacity: -1}, wantErr: true},
+		{name: "sample above 1", opts: Options{Sample: 1.5}, wantErr: true},
+		{name: "negative sample", opts: Options{Sample: -0.1}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.opts.validFilter(); (err != nil) != tc.wantErr {
+				t.Errorf("expected an error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestFilterShard(t *testing.T) {
+	const shards, n = 4, 10000
+	testCases := []struct {
+		name   string
+		shards int
+	}{
+		{name: "unsharded", shards: 0},
+		{name: "one shard", shards: 1},
+		{name: "four shards", shards: shards},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filters := []*Filter{NewFilter(Options{})}
+			if tc.shards > 0 {
+				filters = nil
+				for s := 0; s < tc.shards; s++ {
+					filters = append(filters, NewFilter(Options{Shard: s, Shards: tc.shards}))
+				}
+			}
+			// Every name must be kept by exactly one shard, and the shards
+			// must be roughly even.
+			counts := make([]int, len(filters))
+			for i := 0; i < n; i++ {
+				target := dnslol.Target{Name: fmt.Sprintf("n%d.example.com", i)}
+				kept := 0
+				for s, f := range filters {
+					if f.Keep(target) {
+						kept++
+						counts[s]++
+					}
+				}
+				if kept != 1 {
+					t.Fatalf("expected %s kept by one shard, got %d", target.Name, kept)
+				}
+			}
+			for s, count := range counts {
+				if expected := n / len(filters); count < expected*9/10 || count > expected*11/10 {
+					t.Errorf("expected about %d names in shard %d, got %d", expected, s, count)
+				}
+			}
+		})
+	}
+}
+
+func TestValidShard(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "first shard", opts: Options{Shard: 0, Shards: 4}},
+		{name: "last shard", opts: Options{Shard: 3, Shards: 4}},
+		{name: "shard out of range", opts: Options{Shard: 4, Shards: 4}, wantErr: true},
+		{name: "negative shard", opts: Options{Shard: -1, Shards: 4}, wantErr: true},
+		{name: "negative shards", opts: Options{Shards: -1}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.opts.validFilter(); (err != nil) != tc.wantErr {
+				t.Errorf("expected an error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
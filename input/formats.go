@@ -0,0 +1,269 @@
+package input
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultJSONField is the JSON field holding the name if Options.NameField
+	// is empty.
+	defaultJSONField = "name"
+	// maxLineLength is the longest line accepted by the lines and JSONL
+	// formats, in bytes.
+	maxLineLength = 1 << 20
+)
+
+// lineReader reads FormatLines inputs.
+type lineReader struct {
+	name    string
+	line    int
+	scanner *bufio.Scanner
+}
+
+func newLineReader(r io.Reader, name string, opts Options) (reader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	return &lineReader{name: name, scanner: scanner}, nil
+}
+
+// Next returns the target on the next non-empty line.
+func (lr *lineReader) Next() (dnslol.Target, error) {
+	for lr.scanner.Scan() {
+		lr.line++
+		fields := strings.Fields(lr.scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		types, err := parseTypes(strings.Join(fields[1:], " "))
+		if err != nil {
+			return dnslol.Target{}, fmt.Errorf("%s:%d: %v", lr.name, lr.line, err)
+		}
+		return dnslol.Target{Name: fields[0], Types: types}, nil
+	}
+	if err := lr.scanner.Err(); err != nil {
+		return dnslol.Target{}, fmt.Errorf("%s: %v", lr.name, err)
+	}
+	return dnslol.Target{}, io.EOF
+}
+
+// csvReader reads FormatCSV inputs.
+type csvReader struct {
+	name string
+	row  int
+	r    *csv.Reader
+	// nameCol and typeCol are the 0 based indexes of the name and type
+	// columns. typeCol is -1 if there is no type column.
+	nameCol, typeCol int
+}
+
+func newCSVReader(r io.Reader, name string, opts Options) (reader, error) {
+	cr := &csvReader{name: name, r: csv.NewReader(r), typeCol: -1}
+	cr.r.FieldsPerRecord = -1
+	cr.r.ReuseRecord = true
+
+	// Columns given by name are found in the header row.
+	var header []string
+	for _, field := range []string{opts.NameField, opts.TypeField} {
+		if _, err := strconv.Atoi(field); field != "" && err != nil {
+			row, err := cr.r.Read()
+			if err != nil {
+				return nil, fmt.Errorf("reading CSV header: %v", err)
+			}
+			header = append(header, row...)
+			cr.row++
+			break
+		}
+	}
+	var err error
+	if opts.NameField != "" {
+		if cr.nameCol, err = csvColumn(opts.NameField, header); err != nil {
+			return nil, err
+		}
+	}
+	if opts.TypeField != "" {
+		if cr.typeCol, err = csvColumn(opts.TypeField, header); err != nil {
+			return nil, err
+		}
+	}
+	return cr, nil
+}
+
+// csvColumn returns the 0 based index of the column given by a 1 based index
+// or a name in the header row.
+func csvColumn(field string, header []string) (int, error) {
+	if i, err := strconv.Atoi(field); err == nil {
+		if i < 1 {
+			return 0, fmt.Errorf("CSV column %d must be 1 or more", i)
+		}
+		return i - 1, nil
+	}
+	for i, h := range header {
+		if strings.TrimSpace(h) == field {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("CSV header has no %q column", field)
+}
+
+// Next returns the target in the next row with a name.
+func (cr *csvReader) Next() (dnslol.Target, error) {
+	for {
+		row, err := cr.r.Read()
+		if err == io.EOF {
+			return dnslol.Target{}, io.EOF
+		}
+		if err != nil {
+			return dnslol.Target{}, fmt.Errorf("%s: %v", cr.name, err)
+		}
+		cr.row++
+		if cr.nameCol >= len(row) || strings.TrimSpace(row[cr.nameCol]) == "" {
+			continue
+		}
+		target := dnslol.Target{Name: strings.TrimSpace(row[cr.nameCol])}
+		if cr.typeCol >= 0 && cr.typeCol < len(row) {
+			if target.Types, err = parseTypes(row[cr.typeCol]); err != nil {
+				return dnslol.Target{}, fmt.Errorf("%s: row %d: %v", cr.name, cr.row, err)
+			}
+		}
+		return target, nil
+	}
+}
+
+// jsonReader reads FormatJSONL inputs.
+type jsonReader struct {
+	name    string
+	line    int
+	scanner *bufio.Scanner
+	// nameField and typeField are the paths of the name and type fields.
+	// typeField is nil if there is no type field.
+	nameField, typeField []string
+	// pending holds the remaining targets of a record with several names.
+	pending []dnslol.Target
+}
+
+func newJSONReader(r io.Reader, name string, opts Options) (reader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	jr := &jsonReader{
+		name:      name,
+		scanner:   scanner,
+		nameField: strings.Split(defaultJSONField, "."),
+	}
+	if opts.NameField != "" {
+		jr.nameField = strings.Split(opts.NameField, ".")
+	}
+	if opts.TypeField != "" {
+		jr.typeField = strings.Split(opts.TypeField, ".")
+	}
+	return jr, nil
+}
+
+// jsonField returns the value at the given path of nested objects in v, or nil
+// if there isn't one.
+func jsonField(v interface{}, path []string) interface{} {
+	for _, key := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[key]
+	}
+	return v
+}
+
+// jsonStrings returns the string or strings in a JSON value. Other values are
+// ignored.
+func jsonStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var strs []string
+		for _, elem := range v {
+			if s, ok := elem.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// Next returns the next target. A record whose name field is an array gives a
+// target for each name.
+func (jr *jsonReader) Next() (dnslol.Target, error) {
+	for len(jr.pending) == 0 {
+		if !jr.scanner.Scan() {
+			if err := jr.scanner.Err(); err != nil {
+				return dnslol.Target{}, fmt.Errorf("%s: %v", jr.name, err)
+			}
+			return dnslol.Target{}, io.EOF
+		}
+		jr.line++
+		line := strings.TrimSpace(jr.scanner.Text())
+		if line == "" {
+			continue
+		}
+		var record interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return dnslol.Target{}, fmt.Errorf("%s:%d: %v", jr.name, jr.line, err)
+		}
+		var types []uint16
+		if jr.typeField != nil {
+			raw := strings.Join(jsonStrings(jsonField(record, jr.typeField)), " ")
+			var err error
+			if types, err = parseTypes(raw); err != nil {
+				return dnslol.Target{}, fmt.Errorf("%s:%d: %v", jr.name, jr.line, err)
+			}
+		}
+		for _, name := range jsonStrings(jsonField(record, jr.nameField)) {
+			if name = strings.TrimSpace(name); name != "" {
+				jr.pending = append(jr.pending, dnslol.Target{Name: name, Types: types})
+			}
+		}
+	}
+	target := jr.pending[0]
+	jr.pending = jr.pending[1:]
+	return target, nil
+}
+
+// zoneReader reads FormatZone inputs.
+type zoneReader struct {
+	parser *dns.ZoneParser
+	// last is the last owner name returned, so that names with several
+	// records are only returned once when the records are together.
+	last string
+}
+
+func newZoneReader(r io.Reader, name string, opts Options) (reader, error) {
+	parser := dns.NewZoneParser(r, opts.ZoneOrigin, name)
+	// $INCLUDE directives could read arbitrary files.
+	parser.SetIncludeAllowed(false)
+	return &zoneReader{parser: parser}, nil
+}
+
+// Next returns the owner name of the next record with a different owner
+// name.
+func (zr *zoneReader) Next() (dnslol.Target, error) {
+	for rr, ok := zr.parser.Next(); ok; rr, ok = zr.parser.Next() {
+		name := strings.TrimSuffix(rr.Header().Name, ".")
+		if name == "" || name == zr.last {
+			continue
+		}
+		zr.last = name
+		return dnslol.Target{Name: name}, nil
+	}
+	if err := zr.parser.Err(); err != nil {
+		return dnslol.Target{}, err
+	}
+	return dnslol.Target{}, io.EOF
+}
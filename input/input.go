@@ -0,0 +1,355 @@
+// Package input reads the targets of a dnslol Experiment from files or
+// standard input in a number of formats, optionally compressed.
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+	"github.com/letsencrypt/dns-lots-of-lookups/dnsname"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Stdin is the path used to read from standard input.
+	Stdin = "-"
+
+	// FormatAuto chooses the format of a file from its extension, ignoring any
+	// compression extension. Standard input is read as FormatLines.
+	FormatAuto = "auto"
+	// FormatLines is one name per line, optionally followed by whitespace and
+	// the query types for the name.
+	FormatLines = "lines"
+	// FormatCSV is comma separated values with a column holding the name.
+	FormatCSV = "csv"
+	// FormatJSONL is newline delimited JSON objects with a field holding the
+	// name, e.g. Rapid7 FDNS or Censys dumps.
+	FormatJSONL = "jsonl"
+	// FormatZone is a DNS master zone file. The owner name of each record is
+	// a name.
+	FormatZone = "zone"
+	// FormatCert is PEM or DER encoded X.509 certificates, e.g. a PEM bundle.
+	// The DNS SANs of each certificate are names.
+	FormatCert = "cert"
+	// FormatCT is Certificate Transparency log entries in the JSON format of
+	// the get-entries API, either one entry per line or whole get-entries
+	// responses. The DNS SANs of each certificate or precertificate are names.
+	FormatCT = "ct"
+	// FormatPTR is IPv4 or IPv6 addresses or CIDR prefixes, one per line. The
+	// in-addr.arpa or ip6.arpa name of each address is looked up with a PTR
+	// query.
+	FormatPTR = "ptr"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Options control how an input is read.
+type Options struct {
+	// The format of the input, one of the Format constants.
+	Format string
+	// The CSV column or JSON field holding the name. A CSV column is either a
+	// header name, in which case the first row is a header, or a 1 based
+	// index. A JSON field can be a dotted path to a nested field and its value
+	// can be a string or an array of strings. Defaults to the first CSV column
+	// and the "name" JSON field.
+	NameField string
+	// The optional CSV column or JSON field holding the query types to perform
+	// for the name, e.g. "A" or "A;TXT". Types can be separated by spaces,
+	// commas, semicolons or "|".
+	TypeField string
+	// The origin used for relative names in zone files that don't have an
+	// $ORIGIN directive.
+	ZoneOrigin string
+	// Whether names are label-wise reversed in the input, e.g.
+	// "org.letsencrypt.www".
+	Reverse bool
+	// Whether Unicode names are converted to ASCII using IDNA2008/UTS #46.
+	// Otherwise names must already be ASCII encoded.
+	IDNA bool
+	// The most addresses looked up for each CIDR prefix of a FormatPTR input.
+	// Larger prefixes are sampled, choosing the addresses by a hash of the
+	// prefix and Seed. Defaults to DefaultPTRMaxAddresses.
+	PTRMaxAddresses int
+	// How a Filter removes duplicate targets, one of the Dedup constants.
+	// Defaults to DedupNone.
+	Dedup string
+	// The number of distinct targets a DedupBloom Filter is sized for.
+	// Defaults to DefaultDedupCapacity.
+	DedupCapacity int
+	// The fraction of names a Filter keeps, chosen by a hash of the name and
+	// Seed. Zero or one disables sampling.
+	Sample float64
+	// The seed for choosing sampled names and the addresses of sampled
+	// FormatPTR prefixes.
+	Seed uint64
+	// The shard of the names a Filter keeps (0 based) when the input is split
+	// between Shards processes, chosen by a hash of the name. Every process
+	// reading the same input with a different Shard looks up a disjoint set of
+	// names. Zero Shards disables sharding.
+	Shard, Shards int
+}
+
+// A reader reads targets from a decompressed input. Next returns io.EOF when
+// the input is exhausted.
+type reader interface {
+	Next() (dnslol.Target, error)
+}
+
+// readers holds the constructor for the reader of each format.
+var readers = map[string]func(r io.Reader, name string, opts Options) (reader, error){
+	FormatLines: newLineReader,
+	FormatCSV:   newCSVReader,
+	FormatJSONL: newJSONReader,
+	FormatZone:  newZoneReader,
+	FormatCert:  newCertReader,
+	FormatCT:    newCTReader,
+	FormatPTR:   newPTRReader,
+}
+
+// extensions maps file extensions to the format chosen by FormatAuto.
+var extensions = map[string]string{
+	".csv":    FormatCSV,
+	".json":   FormatJSONL,
+	".jsonl":  FormatJSONL,
+	".ndjson": FormatJSONL,
+	".zone":   FormatZone,
+	".pem":    FormatCert,
+	".crt":    FormatCert,
+	".cer":    FormatCert,
+	".der":    FormatCert,
+}
+
+// Formats returns the names of the supported formats, not including
+// FormatAuto.
+func Formats() []string {
+	var formats []string
+	for f := range readers {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Valid checks whether the given Options are valid.
+func (opts Options) Valid() error {
+	if _, ok := readers[opts.Format]; !ok && opts.Format != FormatAuto {
+		return fmt.Errorf("unknown input format %q, must be %q or one of %s",
+			opts.Format, FormatAuto, strings.Join(Formats(), ", "))
+	}
+	return opts.validFilter()
+}
+
+// format returns the format to read the input at the given path with.
+func (opts Options) format(path string) string {
+	if opts.Format != FormatAuto {
+		return opts.Format
+	}
+	if path == Stdin {
+		return FormatLines
+	}
+	ext := filepath.Ext(path)
+	switch ext {
+	case ".gz", ".zst", ".zstd":
+		ext = filepath.Ext(strings.TrimSuffix(path, ext))
+	}
+	if f, ok := extensions[strings.ToLower(ext)]; ok {
+		return f
+	}
+	return FormatLines
+}
+
+// A Source reads the targets of one input file.
+type Source struct {
+	r       reader
+	name    string
+	opts    Options
+	closers []io.Closer
+}
+
+// Next returns the next target of the input, or io.EOF if there are no more.
+// If the target's name isn't a valid domain name an *InvalidNameError is
+// returned and the next call returns the following target.
+func (s *Source) Next() (dnslol.Target, error) {
+	target, err := s.r.Next()
+	if err != nil {
+		return target, err
+	}
+	raw := target.Name
+	if s.opts.Reverse {
+		target.Name = ReverseName(target.Name)
+	}
+	if target.Name, err = dnsname.Normalize(target.Name, s.opts.IDNA); err != nil {
+		return target, &InvalidNameError{Input: s.name, Name: raw, Reason: err.Error()}
+	}
+	return target, nil
+}
+
+// Close closes the Source and its file. Standard input is not closed.
+func (s *Source) Close() error {
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if cerr := s.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Open returns a Source reading the targets of the file at the given path, or
+// standard input if the path is Stdin. Gzip and zstd compressed inputs are
+// detected and decompressed automatically.
+func Open(path string, opts Options) (*Source, error) {
+	if err := opts.Valid(); err != nil {
+		return nil, err
+	}
+	var f io.ReadCloser = ioutil.NopCloser(os.Stdin)
+	name := "stdin"
+	if path != Stdin {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		f, name = file, path
+	}
+	s := &Source{name: name, opts: opts, closers: []io.Closer{f}}
+
+	r, err := decompress(f, s)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	s.r, err = readers[opts.format(path)](r, name, opts)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return s, nil
+}
+
+// decompress returns a reader for the decompressed contents of r, detecting
+// the compression from its first bytes. Decompressors that need closing are
+// added to the Source's closers.
+func decompress(r io.Reader, s *Source) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	// A short input can't be compressed; Peek returns what it has.
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		s.closers = append(s.closers, gz)
+		return gz, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		s.closers = append(s.closers, zstdCloser{zr})
+		return zr, nil
+	}
+	return br, nil
+}
+
+// zstdCloser adapts a zstd.Decoder, whose Close doesn't return an error, to
+// io.Closer.
+type zstdCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// Count returns the number of valid targets in the inputs at the given paths
+// that are kept by a Filter for the Options. If any of the inputs can't be
+// read twice (e.g. standard input is a pipe) zero is returned. Standard input
+// is left at the position it started at.
+func Count(paths []string, opts Options) (int64, error) {
+	var count int64
+	filter := NewFilter(opts)
+	for _, path := range paths {
+		n, err := count1(path, opts, filter)
+		if err != nil || n < 0 {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// count1 returns the number of targets in one input kept by the filter, or -1
+// if it can't be counted.
+func count1(path string, opts Options, filter *Filter) (int64, error) {
+	if path != Stdin {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			return -1, err
+		}
+	} else {
+		info, err := os.Stdin.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1, err
+		}
+		start, err := os.Stdin.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1, err
+		}
+		defer func() {
+			_, _ = os.Stdin.Seek(start, io.SeekStart)
+		}()
+	}
+	s, err := Open(path, opts)
+	if err != nil {
+		return -1, err
+	}
+	defer s.Close()
+	var n int64
+	for {
+		target, err := s.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if _, ok := err.(*InvalidNameError); ok {
+			continue
+		}
+		if err != nil {
+			return -1, err
+		}
+		if filter.Keep(target) {
+			n++
+		}
+	}
+}
+
+// parseTypes parses a list of query types separated by spaces, commas,
+// semicolons or "|".
+func parseTypes(raw string) ([]uint16, error) {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ',' || r == ';' || r == '|'
+	})
+	var types []uint16
+	for _, f := range fields {
+		typ, ok := dns.StringToType[strings.ToUpper(f)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", f)
+		}
+		types = append(types, typ)
+	}
+	return types, nil
+}
@@ -0,0 +1,174 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+	"github.com/miekg/dns"
+)
+
+// writeInput writes the given contents to a file with the given name in a
+// temporary directory and returns its path.
+func writeInput(t *testing.T, name string, contents []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readTargets returns all of the targets of the input at the given path.
+func readTargets(t *testing.T, path string, opts Options) []dnslol.Target {
+	t.Helper()
+	src, err := Open(path, opts)
+	if err != nil {
+		t.Fatalf("expected no error opening %s, got %v", path, err)
+	}
+	defer src.Close()
+	var targets []dnslol.Target
+	for {
+		target, err := src.Next()
+		if err == io.EOF {
+			return targets
+		}
+		if err != nil {
+			t.Fatalf("expected no error reading %s, got %v", path, err)
+		}
+		targets = append(targets, target)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	testCases := []struct {
+		path     string
+		format   string
+		expected string
+	}{
+		{path: Stdin, format: FormatAuto, expected: FormatLines},
+		{path: "names.txt", format: FormatAuto, expected: FormatLines},
+		{path: "names.csv", format: FormatAuto, expected: FormatCSV},
+		{path: "fdns_a.json.gz", format: FormatAuto, expected: FormatJSONL},
+		{path: "names.NDJSON.zst", format: FormatAuto, expected: FormatJSONL},
+		{path: "example.com.zone", format: FormatAuto, expected: FormatZone},
+		{path: "bundle.pem", format: FormatAuto, expected: FormatCert},
+		{path: "names.csv", format: FormatLines, expected: FormatLines},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			if format := (Options{Format: tc.format}).format(tc.path); format != tc.expected {
+				t.Errorf("expected format %q, got %q", tc.expected, format)
+			}
+		})
+	}
+}
+
+func TestReaders(t *testing.T) {
+	testCases := []struct {
+		name     string
+		file     string
+		opts     Options
+		contents string
+		expected []dnslol.Target
+	}{
+		{
+			name:     "lines",
+			file:     "names.txt",
+			contents: "example.com\n\n  www.example.com  A,TXT\n",
+			expected: []dnslol.Target{
+				{Name: "example.com"},
+				{Name: "www.example.com", Types: []uint16{dns.TypeA, dns.TypeTXT}},
+			},
+		},
+		{
+			name:     "csv by index",
+			file:     "names.csv",
+			opts:     Options{NameField: "2"},
+			contents: "1,example.com\n2,\n3,example.org\n",
+			expected: []dnslol.Target{{Name: "example.com"}, {Name: "example.org"}},
+		},
+		{
+			name:     "csv by header",
+			file:     "names.csv",
+			opts:     Options{NameField: "domain", TypeField: "type"},
+			contents: "rank,domain,type\n1,example.com,A;AAAA\n2,example.org,\n",
+			expected: []dnslol.Target{
+				{Name: "example.com", Types: []uint16{dns.TypeA, dns.TypeAAAA}},
+				{Name: "example.org"},
+			},
+		},
+		{
+			name:     "jsonl",
+			file:     "names.jsonl",
+			contents: `{"name":"example.com"}` + "\n" + `{"other":"x"}` + "\n",
+			expected: []dnslol.Target{{Name: "example.com"}},
+		},
+		{
+			name:     "jsonl nested array",
+			file:     "names.json",
+			opts:     Options{NameField: "parsed.names", TypeField: "type"},
+			contents: `{"parsed":{"names":["example.com","www.example.com"]},"type":"TXT"}` + "\n",
+			expected: []dnslol.Target{
+				{Name: "example.com", Types: []uint16{dns.TypeTXT}},
+				{Name: "www.example.com", Types: []uint16{dns.TypeTXT}},
+			},
+		},
+		{
+			name:     "zone",
+			file:     "example.com.zone",
+			opts:     Options{ZoneOrigin: "example.com."},
+			contents: "@ 300 IN A 192.0.2.1\n@ 300 IN AAAA 2001:db8::1\nwww 300 IN CNAME @\n",
+			expected: []dnslol.Target{{Name: "example.com"}, {Name: "www.example.com"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Format = FormatAuto
+			path := writeInput(t, tc.file, []byte(tc.contents))
+			if targets := readTargets(t, path, tc.opts); !reflect.DeepEqual(targets, tc.expected) {
+				t.Errorf("expected targets %v, got %v", tc.expected, targets)
+			}
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	const contents = "example.com\nexample.org\n"
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(contents))
+	gw.Close()
+	var zst bytes.Buffer
+	zw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = zw.Write([]byte(contents))
+	zw.Close()
+
+	testCases := []struct {
+		name     string
+		contents []byte
+	}{
+		{name: "plain", contents: []byte(contents)},
+		{name: "gzip", contents: gz.Bytes()},
+		{name: "zstd", contents: zst.Bytes()},
+	}
+	expected := []dnslol.Target{{Name: "example.com"}, {Name: "example.org"}}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The compression is detected from the contents, not the name.
+			path := writeInput(t, "names", tc.contents)
+			if targets := readTargets(t, path, Options{Format: FormatAuto}); !reflect.DeepEqual(targets, expected) {
+				t.Errorf("expected targets %v, got %v", expected, targets)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package input
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InvalidNameError is returned by a Source for a target whose name isn't a
+// valid domain name (or for FormatPTR inputs, a line that isn't a valid
+// address or prefix). The Source can continue to be read after it.
+type InvalidNameError struct {
+	// The input the name was read from.
+	Input string
+	// The name as it was read from the input.
+	Name string
+	// Why the name isn't valid.
+	Reason string
+}
+
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("%s: invalid name %q: %s", e.Input, e.Name, e.Reason)
+}
+
+// ReverseName performs a label-wise reversal of the given domain name. E.g.
+// "com.google.www" -> "www.google.com".
+func ReverseName(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,74 @@
+package input
+
+import (
+	"io"
+	"testing"
+)
+
+func TestReverseName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "com.google.www", expected: "www.google.com"},
+		{name: "org", expected: "org"},
+		{name: "", expected: ""},
+	}
+	for _, tc := range testCases {
+		if reversed := ReverseName(tc.name); reversed != tc.expected {
+			t.Errorf("expected %q reversed to be %q, got %q", tc.name, tc.expected, reversed)
+		}
+	}
+}
+
+func TestSourceNames(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts Options
+		line string
+		// expected is the name read, or "" if it is invalid.
+		expected string
+	}{
+		{name: "valid", line: "www.example.com.", expected: "www.example.com"},
+		{name: "wildcard", line: "*.Example.com", expected: "example.com"},
+		{name: "reversed", opts: Options{Reverse: true}, line: "com.example.www", expected: "www.example.com"},
+		{name: "IDN", opts: Options{IDNA: true}, line: "bücher.example", expected: "xn--bcher-kva.example"},
+		{name: "IDN without IDNA", line: "bücher.example"},
+		{name: "invalid character", line: "exa$mple.com"},
+		{name: "empty label", line: "example..com"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Format = FormatLines
+			// The name is followed by a valid one, which must still be read
+			// after an invalid name. It is a single label so that it reads
+			// the same reversed.
+			path := writeInput(t, "names", []byte(tc.line+"\nexample\n"))
+			src, err := Open(path, tc.opts)
+			if err != nil {
+				t.Fatalf("expected no error opening the input, got %v", err)
+			}
+			defer src.Close()
+
+			target, err := src.Next()
+			if tc.expected == "" {
+				invalid, ok := err.(*InvalidNameError)
+				if !ok {
+					t.Fatalf("expected an *InvalidNameError, got %v", err)
+				}
+				if invalid.Name != tc.line {
+					t.Errorf("expected the invalid name %q, got %q", tc.line, invalid.Name)
+				}
+			} else if err != nil || target.Name != tc.expected {
+				t.Errorf("expected name %q, got %q (%v)", tc.expected, target.Name, err)
+			}
+
+			if target, err := src.Next(); err != nil || target.Name != "example" {
+				t.Errorf("expected the next name to be example, got %q (%v)", target.Name, err)
+			}
+			if _, err := src.Next(); err != io.EOF {
+				t.Errorf("expected io.EOF, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package input
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/big"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/letsencrypt/dns-lots-of-lookups/dnslol"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultPTRMaxAddresses is the default Options.PTRMaxAddresses.
+	DefaultPTRMaxAddresses = 256
+)
+
+// ptrReader reads FormatPTR inputs.
+type ptrReader struct {
+	name    string
+	line    int
+	scanner *bufio.Scanner
+	max     int64
+	seed    [8]byte
+	// pending holds the remaining addresses of the last prefix.
+	pending []net.IP
+}
+
+func newPTRReader(r io.Reader, name string, opts Options) (reader, error) {
+	max := opts.PTRMaxAddresses
+	if max <= 0 {
+		max = DefaultPTRMaxAddresses
+	}
+	pr := &ptrReader{
+		name:    name,
+		scanner: bufio.NewScanner(r),
+		max:     int64(max),
+	}
+	binary.BigEndian.PutUint64(pr.seed[:], opts.Seed)
+	return pr, nil
+}
+
+// sampler returns the source of random offsets for sampling a prefix, seeded
+// by a hash of the Seed and the prefix. The same prefix is sampled the same
+// way every time it is read with the same Seed, wherever it is in the input.
+func (pr *ptrReader) sampler(prefix *net.IPNet) *rand.Rand {
+	h := fnv.New64a()
+	h.Write(pr.seed[:])
+	h.Write([]byte(prefix.String()))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// parseAddresses returns the addresses of an IP address or CIDR prefix. If a
+// prefix has more than the reader's maximum addresses a sample of that many
+// addresses, chosen by the reader's seed, is returned in order.
+func (pr *ptrReader) parseAddresses(raw string) ([]net.IP, error) {
+	if !strings.Contains(raw, "/") {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", raw)
+		}
+		return []net.IP{ip}, nil
+	}
+	_, prefix, err := net.ParseCIDR(raw)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := prefix.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	base := new(big.Int).SetBytes(prefix.IP)
+
+	var offsets []*big.Int
+	if size.Cmp(big.NewInt(pr.max)) <= 0 {
+		for i := int64(0); i < size.Int64(); i++ {
+			offsets = append(offsets, big.NewInt(i))
+		}
+	} else {
+		rng := pr.sampler(prefix)
+		seen := make(map[string]bool, pr.max)
+		for int64(len(offsets)) < pr.max {
+			offset := new(big.Int).Rand(rng, size)
+			if seen[offset.String()] {
+				continue
+			}
+			seen[offset.String()] = true
+			offsets = append(offsets, offset)
+		}
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i].Cmp(offsets[j]) < 0 })
+	}
+
+	addrs := make([]net.IP, len(offsets))
+	for i, offset := range offsets {
+		b := new(big.Int).Add(base, offset).Bytes()
+		ip := make(net.IP, len(prefix.IP))
+		copy(ip[len(ip)-len(b):], b)
+		addrs[i] = ip
+	}
+	return addrs, nil
+}
+
+// Next returns a PTR target for the next address. Lines that aren't an address
+// or prefix give an *InvalidNameError.
+func (pr *ptrReader) Next() (dnslol.Target, error) {
+	for len(pr.pending) == 0 {
+		if !pr.scanner.Scan() {
+			if err := pr.scanner.Err(); err != nil {
+				return dnslol.Target{}, fmt.Errorf("%s: %v", pr.name, err)
+			}
+			return dnslol.Target{}, io.EOF
+		}
+		pr.line++
+		raw := strings.TrimSpace(pr.scanner.Text())
+		if raw == "" {
+			continue
+		}
+		addrs, err := pr.parseAddresses(raw)
+		if err != nil {
+			return dnslol.Target{}, &InvalidNameError{Input: pr.name, Name: raw, Reason: err.Error()}
+		}
+		pr.pending = addrs
+	}
+	ip := pr.pending[0]
+	pr.pending = pr.pending[1:]
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return dnslol.Target{}, fmt.Errorf("%s:%d: %v", pr.name, pr.line, err)
+	}
+	return dnslol.Target{
+		Name:   strings.TrimSuffix(name, "."),
+		Types:  []uint16{dns.TypePTR},
+		Source: ip.String(),
+	}, nil
+}
@@ -0,0 +1,106 @@
+package input
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPTRReader(t *testing.T) {
+	testCases := []struct {
+		name         string
+		line         string
+		maxAddresses int
+		// expected is the names read. For sampled prefixes it is nil and only
+		// the count of names is checked.
+		expected []string
+		count    int
+	}{
+		{name: "IPv4 address", line: "192.0.2.1", expected: []string{"1.2.0.192.in-addr.arpa"}},
+		{name: "IPv6 address", line: "2001:db8::1", expected: []string{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"}},
+		{
+			name: "small prefix",
+			line: "192.0.2.7/30",
+			expected: []string{
+				"4.2.0.192.in-addr.arpa", "5.2.0.192.in-addr.arpa",
+				"6.2.0.192.in-addr.arpa", "7.2.0.192.in-addr.arpa",
+			},
+		},
+		{name: "sampled IPv4 prefix", line: "10.0.0.0/8", maxAddresses: 16, count: 16},
+		{name: "sampled IPv6 prefix", line: "2001:db8::/32", count: DefaultPTRMaxAddresses},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeInput(t, "addresses", []byte(tc.line+"\n"))
+			targets := readTargets(t, path, Options{Format: FormatPTR, PTRMaxAddresses: tc.maxAddresses})
+			var names []string
+			seen := make(map[string]bool)
+			for _, target := range targets {
+				if len(target.Types) != 1 || target.Types[0] != dns.TypePTR {
+					t.Errorf("expected a PTR query for %s, got %v", target.Name, target.Types)
+				}
+				if seen[target.Name] {
+					t.Errorf("expected distinct addresses, got %s twice", target.Name)
+				}
+				seen[target.Name] = true
+				names = append(names, target.Name)
+			}
+			if tc.expected != nil {
+				if strings.Join(names, " ") != strings.Join(tc.expected, " ") {
+					t.Errorf("expected names %v, got %v", tc.expected, names)
+				}
+			} else if len(names) != tc.count {
+				t.Errorf("expected %d names, got %d", tc.count, len(names))
+			}
+		})
+	}
+}
+
+func TestPTRReaderInvalid(t *testing.T) {
+	path := writeInput(t, "addresses", []byte("not-an-address\n192.0.2.1\n"))
+	src, err := Open(path, Options{Format: FormatPTR})
+	if err != nil {
+		t.Fatalf("expected no error opening the input, got %v", err)
+	}
+	defer src.Close()
+	if _, err := src.Next(); err == nil {
+		t.Fatalf("expected an error for an invalid address, got nil")
+	} else if _, ok := err.(*InvalidNameError); !ok {
+		t.Errorf("expected an *InvalidNameError, got %v", err)
+	}
+	target, err := src.Next()
+	if err != nil || target.Source != "192.0.2.1" {
+		t.Errorf("expected the next address to be 192.0.2.1, got %q (%v)", target.Source, err)
+	}
+}
+
+func TestPTRReaderSeed(t *testing.T) {
+	// sample returns the sources of the addresses read from the prefix on the
+	// given line of the input with the given seed.
+	sample := func(lines []string, line int, seed uint64) string {
+		path := writeInput(t, "addresses", []byte(strings.Join(lines, "\n")+"\n"))
+		targets := readTargets(t, path, Options{Format: FormatPTR, PTRMaxAddresses: 16, Seed: seed})
+		var sources []string
+		for _, target := range targets[16*line : 16*(line+1)] {
+			sources = append(sources, target.Source)
+		}
+		return strings.Join(sources, " ")
+	}
+
+	lines := []string{"10.0.0.0/8", "2001:db8::/32"}
+	first := sample(lines, 0, 42)
+	if again := sample(lines, 0, 42); again != first {
+		t.Errorf("expected the same seed to sample %s, got %s", first, again)
+	}
+	if other := sample(lines, 0, 43); other == first {
+		t.Errorf("expected another seed to sample other addresses than %s", first)
+	}
+	reordered := []string{"2001:db8::/32", "10.0.0.0/8"}
+	if moved := sample(reordered, 1, 42); moved != first {
+		t.Errorf("expected the prefix to be sampled the same wherever it is, expected %s, got %s", first, moved)
+	}
+	if other := sample(lines, 1, 42); other == sample(reordered, 1, 42) {
+		t.Errorf("expected different prefixes to be sampled differently")
+	}
+}